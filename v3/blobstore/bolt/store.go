@@ -0,0 +1,104 @@
+package bolt
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"go.etcd.io/bbolt"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+// DefaultBucket is the default bucket holding claim-check blobs.
+const DefaultBucket = "casbin_watcher_blobs"
+
+// timestampSize is the size of the creation timestamp prefixed to every stored value.
+const timestampSize = 8
+
+// Store implements watcher.BlobStore on top of a BoltDB database.
+// Each value is stored with its creation time so that old blobs can be garbage collected.
+type Store struct {
+	db     *bbolt.DB
+	bucket []byte
+}
+
+// NewStore creates a new BoltDB blob store using the given bucket, creating it if needed.
+// An empty bucket name selects DefaultBucket.
+func NewStore(db *bbolt.DB, bucket string) (*Store, error) {
+	if bucket == "" {
+		bucket = DefaultBucket
+	}
+	s := &Store{db: db, bucket: []byte(bucket)}
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.bucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blob bucket: %w", err)
+	}
+	return s, nil
+}
+
+// Put stores data under key.
+func (s *Store) Put(_ context.Context, key string, data []byte) error {
+	value := make([]byte, timestampSize+len(data))
+	binary.BigEndian.PutUint64(value, uint64(time.Now().UnixNano()))
+	copy(value[timestampSize:], data)
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(s.bucket).Put([]byte(key), value)
+	})
+}
+
+// Get returns the data stored under key.
+func (s *Store) Get(_ context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(s.bucket).Get([]byte(key))
+		if value == nil {
+			return watcher.ErrBlobNotFound
+		}
+		if len(value) < timestampSize {
+			return fmt.Errorf("corrupt blob: %s", key)
+		}
+		// The value is only valid during the transaction, so it must be copied.
+		data = append([]byte(nil), value[timestampSize:]...)
+		return nil
+	})
+	return data, err
+}
+
+// Delete removes the data stored under key.
+func (s *Store) Delete(_ context.Context, key string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(key))
+	})
+}
+
+// DeleteOlderThan removes all blobs stored before the given time.
+func (s *Store) DeleteOlderThan(_ context.Context, before time.Time) error {
+	cutoff := uint64(before.UnixNano())
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		// Keys are collected first because deleting while iterating with a cursor skips entries.
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if len(v) < timestampSize || binary.BigEndian.Uint64(v) < cutoff {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+var _ watcher.BlobStore = (*Store)(nil)
@@ -0,0 +1,117 @@
+package file
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/multierr"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+// Store implements watcher.BlobStore on the local filesystem.
+// Every blob is stored as a separate file in the configured directory.
+type Store struct {
+	dir string
+}
+
+// NewStore creates a new filesystem blob store rooted at dir, creating the directory if needed.
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Put writes data to a file named after key.
+// The data is written to a temporary file first so that readers never observe partial blobs.
+func (s *Store) Put(_ context.Context, key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads the file named after key.
+func (s *Store) Get(_ context.Context, key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, watcher.ErrBlobNotFound
+	}
+	return data, err
+}
+
+// Delete removes the file named after key.
+func (s *Store) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DeleteOlderThan removes all files modified before the given time.
+func (s *Store) DeleteOlderThan(ctx context.Context, before time.Time) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var allErrors error
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return multierr.Append(allErrors, err)
+		}
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				allErrors = multierr.Append(allErrors, err)
+			}
+			continue
+		}
+		if info.ModTime().Before(before) {
+			err := os.Remove(filepath.Join(s.dir, entry.Name()))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				allErrors = multierr.Append(allErrors, err)
+			}
+		}
+	}
+	return allErrors
+}
+
+// path returns the file path for key, rejecting keys that would escape the blob directory.
+func (s *Store) path(key string) (string, error) {
+	if key == "" || key != filepath.Base(key) || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid blob key: %q", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+var _ watcher.BlobStore = (*Store)(nil)
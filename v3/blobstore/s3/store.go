@@ -0,0 +1,119 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"go.uber.org/multierr"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+// maxDeleteObjects is the maximum number of keys accepted by a single DeleteObjects request.
+const maxDeleteObjects = 1000
+
+// Store implements watcher.BlobStore on Amazon S3 or any S3-compatible endpoint (MinIO, Ceph, R2, ...).
+// S3-compatible endpoints are selected when creating the client, for example with s3.Options.BaseEndpoint
+// and s3.Options.UsePathStyle.
+type Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+// NewStore creates a new S3 blob store that keeps blobs in bucket under the given key prefix.
+func NewStore(client *s3.Client, bucket, prefix string) (*Store, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("s3 bucket is not specified")
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &Store{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+// Put uploads data as an object named after key.
+func (s *Store) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+// Get downloads the object named after key.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, watcher.ErrBlobNotFound
+		}
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+// Delete removes the object named after key.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + key),
+	})
+	return err
+}
+
+// DeleteOlderThan removes all objects under the prefix that were last modified before the given time.
+func (s *Store) DeleteOlderThan(ctx context.Context, before time.Time) error {
+	var expired []types.ObjectIdentifier
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if obj.LastModified != nil && obj.LastModified.Before(before) {
+				expired = append(expired, types.ObjectIdentifier{Key: obj.Key})
+			}
+		}
+	}
+
+	var allErrors error
+	for start := 0; start < len(expired); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(expired) {
+			end = len(expired)
+		}
+		out, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &types.Delete{Objects: expired[start:end], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			allErrors = multierr.Append(allErrors, err)
+			continue
+		}
+		for _, e := range out.Errors {
+			allErrors = multierr.Append(allErrors, fmt.Errorf("failed to delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message)))
+		}
+	}
+	return allErrors
+}
+
+var _ watcher.BlobStore = (*Store)(nil)
@@ -0,0 +1,128 @@
+package sql
+
+import (
+	"context"
+	stdSQL "database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+// DefaultTable is the default name of the table holding claim-check blobs.
+const DefaultTable = "casbin_watcher_blobs"
+
+// Supported SQL dialects.
+const (
+	DialectPostgres = "postgres"
+	DialectMySQL    = "mysql"
+)
+
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Config holds the configuration for the SQL blob store.
+type Config struct {
+	// Dialect selects the SQL dialect, either DialectPostgres or DialectMySQL.
+	Dialect string
+	// Table is the table holding the blobs. Defaults to DefaultTable.
+	Table string
+	// InitializeSchema creates the table if it does not exist.
+	InitializeSchema bool
+}
+
+// Store implements watcher.BlobStore on top of a PostgreSQL or MySQL database,
+// typically the same database used by the sql driver or the casbin adapter.
+type Store struct {
+	db      *stdSQL.DB
+	dialect string
+	table   string
+}
+
+// NewStore creates a new SQL blob store using db.
+func NewStore(ctx context.Context, db *stdSQL.DB, config Config) (*Store, error) {
+	if config.Table == "" {
+		config.Table = DefaultTable
+	}
+	if !tableNamePattern.MatchString(config.Table) {
+		return nil, fmt.Errorf("invalid table name: %s", config.Table)
+	}
+	switch config.Dialect {
+	case DialectPostgres, DialectMySQL:
+	default:
+		return nil, fmt.Errorf("unsupported sql dialect: %s", config.Dialect)
+	}
+
+	s := &Store{
+		db:      db,
+		dialect: config.Dialect,
+		table:   config.Table,
+	}
+
+	if config.InitializeSchema {
+		if _, err := db.ExecContext(ctx, s.schema()); err != nil {
+			return nil, fmt.Errorf("failed to initialize blob table: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Store) schema() string {
+	if s.dialect == DialectMySQL {
+		return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	blob_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	data LONGBLOB NOT NULL,
+	created_at TIMESTAMP(6) NOT NULL
+)`, s.table)
+	}
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	blob_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	data BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+)`, s.table)
+}
+
+// placeholder returns the bind parameter for the n-th argument, starting at 1.
+func (s *Store) placeholder(n int) string {
+	if s.dialect == DialectMySQL {
+		return "?"
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// Put inserts data under key.
+func (s *Store) Put(ctx context.Context, key string, data []byte) error {
+	query := fmt.Sprintf("INSERT INTO %s (blob_key, data, created_at) VALUES (%s, %s, %s)",
+		s.table, s.placeholder(1), s.placeholder(2), s.placeholder(3))
+	_, err := s.db.ExecContext(ctx, query, key, data, time.Now().UTC())
+	return err
+}
+
+// Get selects the data stored under key.
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	query := fmt.Sprintf("SELECT data FROM %s WHERE blob_key = %s", s.table, s.placeholder(1))
+	var data []byte
+	err := s.db.QueryRowContext(ctx, query, key).Scan(&data)
+	if errors.Is(err, stdSQL.ErrNoRows) {
+		return nil, watcher.ErrBlobNotFound
+	}
+	return data, err
+}
+
+// Delete deletes the data stored under key.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE blob_key = %s", s.table, s.placeholder(1))
+	_, err := s.db.ExecContext(ctx, query, key)
+	return err
+}
+
+// DeleteOlderThan deletes all blobs created before the given time.
+func (s *Store) DeleteOlderThan(ctx context.Context, before time.Time) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE created_at < %s", s.table, s.placeholder(1))
+	_, err := s.db.ExecContext(ctx, query, before.UTC())
+	return err
+}
+
+var _ watcher.BlobStore = (*Store)(nil)
@@ -0,0 +1,133 @@
+package watcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Metadata keys used by the claim-check pattern.
+const (
+	// MetadataClaimCheckKey records the blob store key of a payload that was not published inline.
+	MetadataClaimCheckKey = "claim-check-key"
+	// MetadataClaimCheckSHA256 records the hex-encoded SHA-256 checksum of the stored payload.
+	MetadataClaimCheckSHA256 = "claim-check-sha256"
+)
+
+// ErrBlobNotFound is returned by a BlobStore when the requested blob does not exist.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// ErrChecksumMismatch is returned when a fetched payload does not match its published checksum.
+var ErrChecksumMismatch = errors.New("claim-check payload checksum mismatch")
+
+// BlobStore stores payloads that are too large to be sent through the message broker.
+// Implementations are available in the blobstore directory.
+type BlobStore interface {
+	// Put stores data under the given key.
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the data stored under the given key, or ErrBlobNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Delete removes the data stored under the given key.
+	Delete(ctx context.Context, key string) error
+	// DeleteOlderThan removes all blobs stored before the given time.
+	DeleteOlderThan(ctx context.Context, before time.Time) error
+}
+
+// ClaimCheck configures the claim-check pattern for oversized payloads.
+// Payloads larger than Threshold bytes are written to Store and only a reference
+// plus checksum is published. Receivers fetch and verify the payload before
+// invoking the callback.
+type ClaimCheck struct {
+	// Store is the blob store holding oversized payloads.
+	Store BlobStore
+	// Threshold is the payload size in bytes above which the claim-check is used.
+	Threshold int
+	// TTL is the age after which stored blobs are garbage collected. Zero disables garbage collection.
+	TTL time.Duration
+	// GCInterval is how often garbage collection runs. Defaults to TTL.
+	GCInterval time.Duration
+	// Timeout bounds each blob store operation. Defaults to 30 seconds.
+	Timeout time.Duration
+}
+
+// defaultClaimCheckTimeout is the deadline of blob store operations if ClaimCheck.Timeout is not set.
+const defaultClaimCheckTimeout = 30 * time.Second
+
+// WithClaimCheck enables the claim-check pattern for payloads larger than the configured threshold.
+// Creating a watcher fails if the Store is not set.
+func WithClaimCheck(claimCheck ClaimCheck) Option {
+	return func(o *options) {
+		o.ClaimCheck = &claimCheck
+	}
+}
+
+// withTimeout returns a context for a blob store operation, which ends when parent ends or the timeout expires.
+func (c *ClaimCheck) withTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultClaimCheckTimeout
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// checkOut replaces the payload of msg with a reference to a blob if it exceeds the threshold.
+func (c *ClaimCheck) checkOut(ctx context.Context, msg *message.Message) error {
+	if len(msg.Payload) <= c.Threshold {
+		return nil
+	}
+	sum := sha256.Sum256(msg.Payload)
+	if err := c.Store.Put(ctx, msg.UUID, msg.Payload); err != nil {
+		return fmt.Errorf("failed to store claim-check payload: %w", err)
+	}
+	msg.Metadata.Set(MetadataClaimCheckKey, msg.UUID)
+	msg.Metadata.Set(MetadataClaimCheckSHA256, hex.EncodeToString(sum[:]))
+	msg.Payload = nil
+	return nil
+}
+
+// checkIn fetches and verifies the payload referenced by msg, if any.
+func (c *ClaimCheck) checkIn(ctx context.Context, msg *message.Message) error {
+	key := msg.Metadata.Get(MetadataClaimCheckKey)
+	if key == "" {
+		return nil
+	}
+	payload, err := c.Store.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to fetch claim-check payload %s: %w", key, err)
+	}
+	sum := sha256.Sum256(payload)
+	if hex.EncodeToString(sum[:]) != msg.Metadata.Get(MetadataClaimCheckSHA256) {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, key)
+	}
+	msg.Payload = payload
+	return nil
+}
+
+// collectGarbage periodically removes blobs older than TTL until ctx is done.
+func (c *ClaimCheck) collectGarbage(ctx context.Context, logger watermill.LoggerAdapter) {
+	interval := c.GCInterval
+	if interval <= 0 {
+		interval = c.TTL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			gcCtx, cancel := context.WithTimeout(ctx, interval)
+			if err := c.Store.DeleteOlderThan(gcCtx, time.Now().Add(-c.TTL)); err != nil && ctx.Err() == nil {
+				logger.Error("failed to collect claim-check garbage", err, nil)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
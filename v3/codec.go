@@ -4,6 +4,21 @@ import (
 	"bytes"
 	"encoding/gob"
 	"encoding/json"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MetadataContentType is the message metadata key used to record the content type of an UpdateMessage payload.
+const MetadataContentType = "content-type"
+
+// Content types of the built-in codecs.
+const (
+	ContentTypeGob     = "application/x-gob"
+	ContentTypeJSON    = "application/json"
+	ContentTypeMsgpack = "application/msgpack"
+	ContentTypeCBOR    = "application/cbor"
 )
 
 // MarshalUnmarshaler is the interface for serializing and deserializing UpdateMessage.
@@ -12,6 +27,46 @@ type MarshalUnmarshaler interface {
 	Unmarshal(data []byte, v interface{}) error
 }
 
+// ContentTyper is implemented by codecs that can report the content type of their output.
+// Ex writes it to the MetadataContentType metadata field so that receivers can select
+// a matching codec regardless of their own WithCodec setting.
+type ContentTyper interface {
+	ContentType() string
+}
+
+// Global codec registry, keyed by content type.
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]MarshalUnmarshaler{
+		ContentTypeGob:     &gobMarshalUnmarshaler{},
+		ContentTypeJSON:    &jsonMarshalUnmarshaler{},
+		ContentTypeMsgpack: &msgpackMarshalUnmarshaler{},
+		ContentTypeCBOR:    &cborMarshalUnmarshaler{},
+	}
+)
+
+// RegisterCodec registers a codec for the given content type (e.g., "application/x-protobuf").
+// Receivers use the registry to decode messages whose metadata carries that content type.
+func RegisterCodec(contentType string, codec MarshalUnmarshaler) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if codec == nil {
+		panic("watcher: Register codec is nil")
+	}
+	if _, dup := codecs[contentType]; dup {
+		panic("watcher: Register called twice for codec " + contentType)
+	}
+	codecs[contentType] = codec
+}
+
+// CodecForContentType returns the codec registered for the given content type.
+func CodecForContentType(contentType string) (MarshalUnmarshaler, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[contentType]
+	return codec, ok
+}
+
 // gobMarshalUnmarshaler provides a default gob implementation for MarshalUnmarshaler.
 type gobMarshalUnmarshaler struct{}
 
@@ -32,6 +87,11 @@ func (g *gobMarshalUnmarshaler) Unmarshal(data []byte, v interface{}) error {
 	return dec.Decode(v)
 }
 
+// ContentType returns the gob content type.
+func (g *gobMarshalUnmarshaler) ContentType() string {
+	return ContentTypeGob
+}
+
 // jsonMarshalUnmarshaler provides a JSON implementation for MarshalUnmarshaler.
 type jsonMarshalUnmarshaler struct{}
 
@@ -45,6 +105,47 @@ func (j *jsonMarshalUnmarshaler) Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
+// ContentType returns the JSON content type.
+func (j *jsonMarshalUnmarshaler) ContentType() string {
+	return ContentTypeJSON
+}
+
+// msgpackMarshalUnmarshaler provides a MessagePack implementation for MarshalUnmarshaler.
+type msgpackMarshalUnmarshaler struct{}
+
+// Marshal uses MessagePack to marshal the value.
+func (m *msgpackMarshalUnmarshaler) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal uses MessagePack to unmarshal the data.
+func (m *msgpackMarshalUnmarshaler) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// ContentType returns the MessagePack content type.
+func (m *msgpackMarshalUnmarshaler) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+// cborMarshalUnmarshaler provides a CBOR implementation for MarshalUnmarshaler.
+type cborMarshalUnmarshaler struct{}
+
+// Marshal uses CBOR to marshal the value.
+func (c *cborMarshalUnmarshaler) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+// Unmarshal uses CBOR to unmarshal the data.
+func (c *cborMarshalUnmarshaler) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+// ContentType returns the CBOR content type.
+func (c *cborMarshalUnmarshaler) ContentType() string {
+	return ContentTypeCBOR
+}
+
 // DefaultCodec returns the default gob codec.
 func DefaultCodec() MarshalUnmarshaler {
 	return &gobMarshalUnmarshaler{}
@@ -54,3 +155,13 @@ func DefaultCodec() MarshalUnmarshaler {
 func JSONCodec() MarshalUnmarshaler {
 	return &jsonMarshalUnmarshaler{}
 }
+
+// MsgpackCodec returns a MessagePack codec.
+func MsgpackCodec() MarshalUnmarshaler {
+	return &msgpackMarshalUnmarshaler{}
+}
+
+// CBORCodec returns a CBOR codec.
+func CBORCodec() MarshalUnmarshaler {
+	return &cborMarshalUnmarshaler{}
+}
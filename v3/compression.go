@@ -0,0 +1,261 @@
+package watcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// MetadataContentEncoding is the message metadata key used to record the compression algorithm of a payload.
+const MetadataContentEncoding = "content-encoding"
+
+// Compression algorithms supported by CompressionCodec.
+const (
+	CompressionGzip   = "gzip"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+// DefaultMaxDecompressedSize is the default limit of the size of a decompressed payload.
+const DefaultMaxDecompressedSize = 64 << 20
+
+// errDecompressedTooLarge is returned when a payload decompresses to more than the allowed size.
+var errDecompressedTooLarge = errors.New("decompressed payload exceeds the maximum size")
+
+// MetadataMarshalUnmarshaler is implemented by codecs that record encoding details in the message metadata.
+// Ex prefers these methods over Marshal and Unmarshal when they are available.
+type MetadataMarshalUnmarshaler interface {
+	MarshalUnmarshaler
+	MarshalWithMetadata(v interface{}, metadata message.Metadata) ([]byte, error)
+	UnmarshalWithMetadata(data []byte, metadata message.Metadata, v interface{}) error
+}
+
+// compressionMarshalUnmarshaler wraps a MarshalUnmarshaler and compresses payloads above a size threshold.
+type compressionMarshalUnmarshaler struct {
+	codec     MarshalUnmarshaler
+	algorithm string
+	threshold int
+	maxSize   int64
+}
+
+// CompressionOption configures a codec returned by CompressionCodec.
+type CompressionOption func(*compressionMarshalUnmarshaler)
+
+// WithMaxDecompressedSize sets the maximum size of a decompressed payload. Larger payloads are rejected, so that a
+// small compressed message cannot exhaust the memory of the receivers. It defaults to DefaultMaxDecompressedSize.
+func WithMaxDecompressedSize(size int64) CompressionOption {
+	return func(c *compressionMarshalUnmarshaler) {
+		c.maxSize = size
+	}
+}
+
+// CompressionCodec returns a codec that compresses the output of codec with the given algorithm
+// when it is larger than threshold bytes. Smaller payloads are sent uncompressed.
+// The algorithm is recorded in the MetadataContentEncoding metadata field so that receivers can
+// decompress the payload regardless of their own codec configuration.
+// It panics if algorithm is not one of CompressionGzip, CompressionZstd and CompressionSnappy.
+func CompressionCodec(codec MarshalUnmarshaler, algorithm string, threshold int, opts ...CompressionOption) MarshalUnmarshaler {
+	switch algorithm {
+	case CompressionGzip, CompressionZstd, CompressionSnappy:
+	default:
+		panic("watcher: unsupported compression algorithm " + algorithm)
+	}
+	c := &compressionMarshalUnmarshaler{
+		codec:     codec,
+		algorithm: algorithm,
+		threshold: threshold,
+		maxSize:   DefaultMaxDecompressedSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Marshal marshals the value with the wrapped codec and compresses it if it exceeds the threshold.
+func (c *compressionMarshalUnmarshaler) Marshal(v interface{}) ([]byte, error) {
+	return c.MarshalWithMetadata(v, message.Metadata{})
+}
+
+// Unmarshal detects a compressed payload by its magic number, decompresses it and
+// unmarshals it with the wrapped codec. Payloads that fail to decompress are treated as uncompressed.
+func (c *compressionMarshalUnmarshaler) Unmarshal(data []byte, v interface{}) error {
+	if algorithm := detectCompression(data); algorithm != "" {
+		if decompressed, err := decompress(algorithm, data, c.maxSize); err == nil {
+			return c.codec.Unmarshal(decompressed, v)
+		}
+	}
+	return c.codec.Unmarshal(data, v)
+}
+
+// MarshalWithMetadata marshals the value and records the compression algorithm in metadata if it was applied.
+func (c *compressionMarshalUnmarshaler) MarshalWithMetadata(v interface{}, metadata message.Metadata) ([]byte, error) {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) <= c.threshold {
+		return data, nil
+	}
+	compressed, err := compress(c.algorithm, data)
+	if err != nil {
+		return nil, err
+	}
+	metadata.Set(MetadataContentEncoding, c.algorithm)
+	return compressed, nil
+}
+
+// UnmarshalWithMetadata decompresses the payload according to metadata and unmarshals it with the wrapped codec.
+func (c *compressionMarshalUnmarshaler) UnmarshalWithMetadata(data []byte, metadata message.Metadata, v interface{}) error {
+	data, err := decompress(metadata.Get(MetadataContentEncoding), data, c.maxSize)
+	if err != nil {
+		return err
+	}
+	return c.codec.Unmarshal(data, v)
+}
+
+// ContentType returns the content type of the wrapped codec, if it reports one.
+func (c *compressionMarshalUnmarshaler) ContentType() string {
+	if ct, ok := c.codec.(ContentTyper); ok {
+		return ct.ContentType()
+	}
+	return ""
+}
+
+// zstd encoders and decoders are safe for concurrent use with EncodeAll and DecodeAll,
+// so a single encoder and a single decoder per size limit are shared.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdErr     error
+
+	zstdMu       sync.Mutex
+	zstdDecoders = make(map[int64]*zstd.Decoder)
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+	})
+	return zstdErr
+}
+
+// zstdDecoder returns the shared decoder that rejects payloads larger than maxSize.
+func zstdDecoder(maxSize int64) (*zstd.Decoder, error) {
+	zstdMu.Lock()
+	defer zstdMu.Unlock()
+	if d, ok := zstdDecoders[maxSize]; ok {
+		return d, nil
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(maxSize)))
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoders[maxSize] = d
+	return d, nil
+}
+
+// compress compresses data with the given algorithm.
+func compress(algorithm string, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case CompressionSnappy:
+		// The framed format is used so that compressed payloads can be recognised by their stream identifier.
+		var buf bytes.Buffer
+		sw := snappy.NewBufferedWriter(&buf)
+		if _, err := sw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := sw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
+
+// decompress decompresses data with the given algorithm. An empty algorithm returns data unchanged.
+// It fails if the decompressed data is larger than maxSize bytes.
+func decompress(algorithm string, data []byte, maxSize int64) ([]byte, error) {
+	switch algorithm {
+	case "":
+		return data, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return readLimited(zr, maxSize)
+	case CompressionZstd:
+		d, err := zstdDecoder(maxSize)
+		if err != nil {
+			return nil, err
+		}
+		decompressed, err := d.DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || int64(len(decompressed)) > maxSize {
+			return nil, errDecompressedTooLarge
+		}
+		return decompressed, err
+	case CompressionSnappy:
+		return readLimited(snappy.NewReader(bytes.NewReader(data)), maxSize)
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm: %s", algorithm)
+	}
+}
+
+// readLimited reads r to the end. It fails if r holds more than maxSize bytes.
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errDecompressedTooLarge
+	}
+	return data, nil
+}
+
+// Magic numbers of the supported compression formats.
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// detectCompression returns the compression algorithm of data based on its magic number,
+// or an empty string if data is not compressed.
+func detectCompression(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		return CompressionGzip
+	case bytes.HasPrefix(data, zstdMagic):
+		return CompressionZstd
+	case bytes.HasPrefix(data, snappyMagic):
+		return CompressionSnappy
+	default:
+		return ""
+	}
+}
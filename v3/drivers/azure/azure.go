@@ -0,0 +1,101 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+var errClosed = errors.New("azure pubsub is closed")
+
+// credentials holds how a client authenticates to a namespace: with a connection string that carries a shared access
+// key, or with a token credential.
+type credentials struct {
+	Namespace        string
+	ConnectionString string
+	TokenCredential  azcore.TokenCredential
+}
+
+// parseCredentials reads the namespace from the URL host and the shared access key from the URL user info. Without a
+// key, the default Azure credential chain is used, which reads environment variables, workload and managed identities
+// and the Azure CLI login.
+func parseCredentials(u *url.URL, query url.Values) (*credentials, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("azure namespace is not specified in URL host")
+	}
+	creds := &credentials{Namespace: u.Host}
+
+	emulator := false
+	if e := query.Get("emulator"); e != "" {
+		val, err := strconv.ParseBool(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'emulator' param: %w", err)
+		}
+		emulator = val
+	}
+
+	if keyName := u.User.Username(); keyName != "" {
+		key, _ := u.User.Password()
+		creds.ConnectionString = fmt.Sprintf("Endpoint=sb://%s;SharedAccessKeyName=%s;SharedAccessKey=%s",
+			u.Host, keyName, key)
+		if emulator {
+			creds.ConnectionString += ";UseDevelopmentEmulator=true"
+		}
+		return creds, nil
+	}
+	if emulator {
+		return nil, fmt.Errorf("'emulator' param requires a shared access key in the URL")
+	}
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load azure credentials: %w", err)
+	}
+	creds.TokenCredential = cred
+	return creds, nil
+}
+
+// setMetadata copies the string values of properties to the metadata of msg.
+func setMetadata(msg *message.Message, properties map[string]any) {
+	for k, v := range properties {
+		if s, ok := v.(string); ok {
+			msg.Metadata.Set(k, s)
+		}
+	}
+}
+
+// properties returns the metadata of msg as application properties.
+func properties(msg *message.Message) map[string]any {
+	if len(msg.Metadata) == 0 {
+		return nil
+	}
+	props := make(map[string]any, len(msg.Metadata))
+	for k, v := range msg.Metadata {
+		props[k] = v
+	}
+	return props
+}
+
+// deliver sends msg to output and waits until it is acknowledged. It returns whether the message was acked, and false
+// if the subscription has ended.
+func deliver(ctx context.Context, msg *message.Message, output chan<- *message.Message) (bool, bool) {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false, false
+	}
+	select {
+	case <-msg.Acked():
+		return true, true
+	case <-msg.Nacked():
+		return false, true
+	case <-ctx.Done():
+		return false, false
+	}
+}
@@ -0,0 +1,310 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azeventhubs/v2"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.uber.org/multierr"
+
+	watcher "github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("eventhubs", &EventHubsDriver{})
+}
+
+// EventHubsDriver publishes to Azure Event Hubs and subscribes by reading all partitions of the event hub.
+type EventHubsDriver struct{}
+
+// NewPubSub creates a new Pub/Sub instance for Azure Event Hubs. The topic is the name of the event hub.
+func (d *EventHubsDriver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseEventHubsURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse eventhubs url: %w", err)
+	}
+
+	return &eventHubsPubSub{
+		config:    config,
+		logger:    logger,
+		producers: make(map[string]*azeventhubs.ProducerClient),
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+type eventHubsPubSub struct {
+	config *eventHubsConfig
+	logger watermill.LoggerAdapter
+
+	mu        sync.Mutex
+	producers map[string]*azeventhubs.ProducerClient
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// producer returns the producer of the event hub, which is created on first use.
+func (p *eventHubsPubSub) producer(eventHub string) (*azeventhubs.ProducerClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		return nil, errClosed
+	default:
+	}
+	if producer, ok := p.producers[eventHub]; ok {
+		return producer, nil
+	}
+	var (
+		producer *azeventhubs.ProducerClient
+		err      error
+	)
+	if p.config.ConnectionString != "" {
+		producer, err = azeventhubs.NewProducerClientFromConnectionString(p.config.ConnectionString, eventHub, nil)
+	} else {
+		producer, err = azeventhubs.NewProducerClient(p.config.Namespace, eventHub, p.config.TokenCredential, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.producers[eventHub] = producer
+	return producer, nil
+}
+
+// Publish sends the messages to the event hub in one batch. The metadata is sent in the event properties.
+func (p *eventHubsPubSub) Publish(topic string, messages ...*message.Message) error {
+	producer, err := p.producer(topic)
+	if err != nil {
+		return fmt.Errorf("failed to create producer for event hub %q: %w", topic, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+	batch, err := producer.NewEventDataBatch(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create batch for event hub %q: %w", topic, err)
+	}
+	for _, msg := range messages {
+		err := batch.AddEventData(&azeventhubs.EventData{
+			MessageID:  to.Ptr(msg.UUID),
+			Body:       msg.Payload,
+			Properties: properties(msg),
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to add message %s to batch: %w", msg.UUID, err)
+		}
+	}
+	if err := producer.SendEventDataBatch(ctx, batch, nil); err != nil {
+		return fmt.Errorf("failed to publish messages to event hub %q: %w", topic, err)
+	}
+	return nil
+}
+
+// Subscribe reads all partitions of the event hub in the consumer group. Event Hubs delivers every event to every
+// reader, so the watchers can share a consumer group. Reading starts at the latest event, or at the earliest with
+// start=earliest.
+func (p *eventHubsPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	var (
+		consumer *azeventhubs.ConsumerClient
+		err      error
+	)
+	if p.config.ConnectionString != "" {
+		consumer, err = azeventhubs.NewConsumerClientFromConnectionString(p.config.ConnectionString, topic,
+			p.config.ConsumerGroup, nil)
+	} else {
+		consumer, err = azeventhubs.NewConsumerClient(p.config.Namespace, topic, p.config.ConsumerGroup,
+			p.config.TokenCredential, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to event hub %q: %w", topic, err)
+	}
+
+	propsCtx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	props, err := consumer.GetEventHubProperties(propsCtx, nil)
+	cancel()
+	if err != nil {
+		_ = consumer.Close(context.Background())
+		return nil, fmt.Errorf("failed to get partitions of event hub %q: %w", topic, err)
+	}
+
+	// Receiving is cancelled through ctx, so it is also cancelled when the Pub/Sub is closed.
+	ctx, cancel = context.WithCancel(ctx)
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case <-ctx.Done():
+		case <-p.closed:
+			cancel()
+		}
+	}()
+
+	var partitions sync.WaitGroup
+	for _, partitionID := range props.PartitionIDs {
+		partitions.Add(1)
+		go func() {
+			defer partitions.Done()
+			p.readPartition(ctx, consumer, topic, partitionID, output)
+		}()
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		partitions.Wait()
+		cancel()
+		close(output)
+		closeCtx, closeCancel := context.WithTimeout(context.Background(), p.config.Timeout)
+		defer closeCancel()
+		_ = consumer.Close(closeCtx)
+	}()
+
+	return output, nil
+}
+
+// readPartition delivers the events of the partition until ctx is done. When receiving fails or an event is nacked,
+// the partition is read again after reconnect_wait from the first event that has not been handled.
+func (p *eventHubsPubSub) readPartition(ctx context.Context, consumer *azeventhubs.ConsumerClient, eventHub, partitionID string, output chan<- *message.Message) {
+	logFields := watermill.LogFields{"event_hub": eventHub, "partition": partitionID}
+	start := azeventhubs.StartPosition{Latest: to.Ptr(true)}
+	if p.config.Earliest {
+		start = azeventhubs.StartPosition{Earliest: to.Ptr(true)}
+	}
+
+	for {
+		p.receive(ctx, consumer, partitionID, &start, output, logFields)
+		select {
+		case <-time.After(p.config.ReconnectWait):
+		case <-ctx.Done():
+			p.logger.Info("Event Hubs subscriber stopped.", logFields)
+			return
+		}
+		p.logger.Info("Resuming Event Hubs partition.", logFields)
+	}
+}
+
+// receive delivers the events of the partition from start, which it moves past each event that has been handled,
+// until receiving fails, an event is nacked or ctx is done.
+func (p *eventHubsPubSub) receive(ctx context.Context, consumer *azeventhubs.ConsumerClient, partitionID string, start *azeventhubs.StartPosition, output chan<- *message.Message, logFields watermill.LogFields) {
+	partition, err := consumer.NewPartitionClient(partitionID, &azeventhubs.PartitionClientOptions{StartPosition: *start})
+	if err != nil {
+		p.logger.Error("Failed to open Event Hubs partition.", err, logFields)
+		return
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+		defer cancel()
+		_ = partition.Close(closeCtx)
+	}()
+
+	for {
+		// Events are prefetched, so receiving them one at a time delivers each as soon as it arrives.
+		events, err := partition.ReceiveEvents(ctx, 1, nil)
+		if err != nil {
+			if ctx.Err() == nil {
+				p.logger.Error("Failed to receive Event Hubs events.", err, logFields)
+			}
+			return
+		}
+		for _, event := range events {
+			uuid := watermill.NewUUID()
+			if event.MessageID != nil {
+				uuid = *event.MessageID
+			}
+			msg := message.NewMessage(uuid, event.Body)
+			setMetadata(msg, event.Properties)
+			acked, ok := deliver(ctx, msg, output)
+			if !ok {
+				return
+			}
+			if !acked {
+				// The partition is read again from this event.
+				*start = azeventhubs.StartPosition{SequenceNumber: to.Ptr(event.SequenceNumber), Inclusive: true}
+				return
+			}
+			*start = azeventhubs.StartPosition{SequenceNumber: to.Ptr(event.SequenceNumber)}
+		}
+	}
+}
+
+func (p *eventHubsPubSub) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		close(p.closed)
+		producers := p.producers
+		p.producers = nil
+		p.mu.Unlock()
+		p.wg.Wait()
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+		defer cancel()
+		for _, producer := range producers {
+			err = multierr.Append(err, producer.Close(ctx))
+		}
+	})
+	return err
+}
+
+type eventHubsConfig struct {
+	credentials
+	ConsumerGroup string
+	Earliest      bool
+	Timeout       time.Duration
+	ReconnectWait time.Duration
+}
+
+func parseEventHubsURL(u *url.URL) (*eventHubsConfig, error) {
+	query := u.Query()
+	creds, err := parseCredentials(u, query)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &eventHubsConfig{
+		credentials:   *creds,
+		ConsumerGroup: azeventhubs.DefaultConsumerGroup,
+		Timeout:       30 * time.Second,
+		ReconnectWait: time.Second,
+	}
+
+	if cg := query.Get("consumer_group"); cg != "" {
+		config.ConsumerGroup = cg
+	}
+
+	if start := query.Get("start"); start != "" {
+		switch start {
+		case "latest":
+		case "earliest":
+			config.Earliest = true
+		default:
+			return nil, fmt.Errorf("invalid 'start' param: %s", start)
+		}
+	}
+
+	if timeout := query.Get("timeout"); timeout != "" {
+		val, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timeout' param: %w", err)
+		}
+		config.Timeout = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.ReconnectWait = val
+	}
+
+	return config, nil
+}
@@ -0,0 +1,333 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus/admin"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.uber.org/multierr"
+
+	watcher "github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("azuresb", &ServiceBusDriver{})
+}
+
+// ServiceBusDriver publishes to Azure Service Bus topics and subscribes through a subscription per watcher.
+type ServiceBusDriver struct{}
+
+// NewPubSub creates a new Pub/Sub instance for Azure Service Bus.
+func (d *ServiceBusDriver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseServiceBusURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse azuresb url: %w", err)
+	}
+
+	var client *azservicebus.Client
+	if config.ConnectionString != "" {
+		client, err = azservicebus.NewClientFromConnectionString(config.ConnectionString, nil)
+	} else {
+		client, err = azservicebus.NewClient(config.Namespace, config.TokenCredential, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create service bus client: %w", err)
+	}
+
+	return &serviceBusPubSub{
+		client:  client,
+		config:  config,
+		logger:  logger,
+		senders: make(map[string]*azservicebus.Sender),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+type serviceBusPubSub struct {
+	client *azservicebus.Client
+	config *serviceBusConfig
+	logger watermill.LoggerAdapter
+
+	mu      sync.Mutex
+	senders map[string]*azservicebus.Sender
+	// created holds the subscriptions created by the Pub/Sub, by topic, which are deleted when it is closed.
+	created map[string][]string
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// sender returns the sender of the topic, which is created on first use.
+func (p *serviceBusPubSub) sender(topic string) (*azservicebus.Sender, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		return nil, errClosed
+	default:
+	}
+	if sender, ok := p.senders[topic]; ok {
+		return sender, nil
+	}
+	sender, err := p.client.NewSender(topic, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.senders[topic] = sender
+	return sender, nil
+}
+
+// Publish sends the messages to the topic. The metadata is sent in the application properties.
+func (p *serviceBusPubSub) Publish(topic string, messages ...*message.Message) error {
+	sender, err := p.sender(topic)
+	if err != nil {
+		return fmt.Errorf("failed to create sender for topic %q: %w", topic, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+	for _, msg := range messages {
+		err := sender.SendMessage(ctx, &azservicebus.Message{
+			MessageID:             to.Ptr(msg.UUID),
+			Body:                  msg.Payload,
+			ApplicationProperties: properties(msg),
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe receives the messages of the topic through the configured subscription, or through a new subscription
+// that Service Bus deletes once it has been idle for auto_delete_on_idle.
+func (p *serviceBusPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	subscription := p.config.Subscription
+	if subscription == "" {
+		subscription = "casbin-watcher-" + watermill.NewShortUUID()
+		if err := p.createSubscription(ctx, topic, subscription); err != nil {
+			return nil, fmt.Errorf("failed to create subscription for topic %q: %w", topic, err)
+		}
+	}
+
+	receiver, err := p.client.NewReceiverForSubscription(topic, subscription, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to topic %q: %w", topic, err)
+	}
+
+	// Receiving is cancelled through ctx, so it is also cancelled when the Pub/Sub is closed.
+	ctx, cancel := context.WithCancel(ctx)
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case <-ctx.Done():
+		case <-p.closed:
+			cancel()
+		}
+	}()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer cancel()
+		defer close(output)
+		defer func() {
+			closeCtx, closeCancel := context.WithTimeout(context.Background(), p.config.Timeout)
+			defer closeCancel()
+			_ = receiver.Close(closeCtx)
+		}()
+
+		logFields := watermill.LogFields{"topic": topic, "subscription": subscription}
+		for {
+			received, err := receiver.ReceiveMessages(ctx, 1, nil)
+			if err != nil {
+				if ctx.Err() != nil {
+					p.logger.Info("Service Bus subscriber stopped.", logFields)
+					return
+				}
+				p.logger.Error("Failed to receive Service Bus messages.", err, logFields)
+				select {
+				case <-time.After(p.config.ReconnectWait):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			for _, m := range received {
+				msg := message.NewMessage(m.MessageID, m.Body)
+				setMetadata(msg, m.ApplicationProperties)
+				acked, ok := deliver(ctx, msg, output)
+				if !ok {
+					// The lock of the message expires, so it is delivered to the subscription again.
+					return
+				}
+				if acked {
+					err = receiver.CompleteMessage(ctx, m, nil)
+				} else {
+					err = receiver.AbandonMessage(ctx, m, nil)
+				}
+				if err != nil {
+					p.logger.Error("Failed to settle Service Bus message.", err, logFields)
+				}
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// createSubscription creates a subscription that is deleted by Service Bus once it has been idle for
+// auto_delete_on_idle, so that no subscriptions are left behind by watchers that are gone.
+func (p *serviceBusPubSub) createSubscription(ctx context.Context, topic, subscription string) error {
+	adminClient, err := p.adminClient()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+	_, err = adminClient.CreateSubscription(ctx, topic, subscription, &admin.CreateSubscriptionOptions{
+		Properties: &admin.SubscriptionProperties{
+			AutoDeleteOnIdle:         to.Ptr(isoDuration(p.config.AutoDeleteOnIdle)),
+			DefaultMessageTimeToLive: to.Ptr(isoDuration(p.config.MessageTTL)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.created == nil {
+		p.created = make(map[string][]string)
+	}
+	p.created[topic] = append(p.created[topic], subscription)
+	return nil
+}
+
+func (p *serviceBusPubSub) adminClient() (*admin.Client, error) {
+	if p.config.ConnectionString != "" {
+		return admin.NewClientFromConnectionString(p.config.ConnectionString, nil)
+	}
+	return admin.NewClient(p.config.Namespace, p.config.TokenCredential, nil)
+}
+
+func (p *serviceBusPubSub) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		close(p.closed)
+		senders := p.senders
+		p.senders = nil
+		p.mu.Unlock()
+		p.wg.Wait()
+
+		// A subscription created by a concurrent Subscribe after this point is left to be deleted when idle.
+		p.mu.Lock()
+		created := p.created
+		p.created = nil
+		p.mu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+		defer cancel()
+		for _, sender := range senders {
+			err = multierr.Append(err, sender.Close(ctx))
+		}
+		if len(created) > 0 {
+			// Service Bus deletes the subscriptions by itself when they have been idle, so this is only a shortcut.
+			if adminClient, adminErr := p.adminClient(); adminErr == nil {
+				for topic, subscriptions := range created {
+					for _, subscription := range subscriptions {
+						if _, deleteErr := adminClient.DeleteSubscription(ctx, topic, subscription, nil); deleteErr != nil {
+							p.logger.Error("Failed to delete Service Bus subscription.", deleteErr,
+								watermill.LogFields{"topic": topic, "subscription": subscription})
+						}
+					}
+				}
+			}
+		}
+		err = multierr.Append(err, p.client.Close(ctx))
+	})
+	return err
+}
+
+// isoDuration formats d as an ISO 8601 duration, as used by the Service Bus management API.
+func isoDuration(d time.Duration) string {
+	return "PT" + strconv.FormatInt(int64(d/time.Second), 10) + "S"
+}
+
+type serviceBusConfig struct {
+	credentials
+	Subscription     string
+	AutoDeleteOnIdle time.Duration
+	MessageTTL       time.Duration
+	Timeout          time.Duration
+	ReconnectWait    time.Duration
+}
+
+func parseServiceBusURL(u *url.URL) (*serviceBusConfig, error) {
+	query := u.Query()
+	creds, err := parseCredentials(u, query)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &serviceBusConfig{
+		credentials:      *creds,
+		Subscription:     query.Get("subscription"),
+		AutoDeleteOnIdle: 5 * time.Minute,
+		MessageTTL:       time.Hour,
+		Timeout:          30 * time.Second,
+		ReconnectWait:    time.Second,
+	}
+
+	if adi := query.Get("auto_delete_on_idle"); adi != "" {
+		val, err := time.ParseDuration(adi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'auto_delete_on_idle' param: %w", err)
+		}
+		if val < 5*time.Minute {
+			return nil, fmt.Errorf("invalid 'auto_delete_on_idle' param: must be at least 5m")
+		}
+		config.AutoDeleteOnIdle = val
+	}
+
+	if ttl := query.Get("message_ttl"); ttl != "" {
+		val, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'message_ttl' param: %w", err)
+		}
+		if val < time.Second {
+			return nil, fmt.Errorf("invalid 'message_ttl' param: must be at least 1s")
+		}
+		config.MessageTTL = val
+	}
+
+	if timeout := query.Get("timeout"); timeout != "" {
+		val, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timeout' param: %w", err)
+		}
+		config.Timeout = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.ReconnectWait = val
+	}
+
+	return config, nil
+}
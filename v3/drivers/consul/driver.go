@@ -0,0 +1,479 @@
+package consul
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hashicorp/consul/api"
+	"go.uber.org/multierr"
+
+	watcher "github.com/origadmin/casbin-watcher/v3"
+	"github.com/origadmin/casbin-watcher/v3/internal/tlsconfig"
+)
+
+func init() {
+	watcher.RegisterDriver("consul", &Driver{})
+}
+
+const (
+	// ModeKV stores each message under a KV prefix, which subscribers watch with blocking queries.
+	ModeKV = "kv"
+	// ModeEvent fires each message as a Consul user event, which is spread to all agents by gossip.
+	ModeEvent = "event"
+)
+
+// Driver for Consul.
+type Driver struct{}
+
+// NewPubSub creates a new Pub/Sub instance for Consul. The client talks to the agent in the URL host.
+func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseConsulURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse consul url: %w", err)
+	}
+
+	clientConfig := api.DefaultNonPooledConfig()
+	clientConfig.Address = config.Address
+	clientConfig.Datacenter = config.Datacenter
+	clientConfig.Token = config.Token
+	clientConfig.TokenFile = config.TokenFile
+	if config.TLS != nil {
+		clientConfig.Scheme = "https"
+		clientConfig.Transport.TLSClientConfig = config.TLS
+	}
+	client, err := api.NewClient(clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consulPubSub{
+		client: client,
+		config: config,
+		logger: logger,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// envelope is the JSON representation of a message as it is stored in Consul.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type consulPubSub struct {
+	client *api.Client
+	config *consulConfig
+	logger watermill.LoggerAdapter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish stores the messages under the topic's KV prefix, or fires them as user events named after the topic.
+func (p *consulPubSub) Publish(topic string, messages ...*message.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	var allErrors error
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		if p.config.Mode == ModeEvent {
+			_, _, err = p.client.Event().Fire(&api.UserEvent{Name: topic, Payload: data}, p.writeOptions(ctx))
+		} else {
+			// The publish time is part of the key, so that expired keys can be found without reading them.
+			key := fmt.Sprintf("%s/%020d-%s", p.kvPrefix(topic), time.Now().UnixNano(), msg.UUID)
+			_, err = p.client.KV().Put(&api.KVPair{Key: key, Value: data}, p.writeOptions(ctx))
+		}
+		if err != nil {
+			p.logger.Error("Failed to publish message to consul", err, watermill.LogFields{"topic": topic})
+			allErrors = multierr.Append(allErrors, fmt.Errorf("failed to publish message %s: %w", msg.UUID, err))
+		}
+	}
+
+	if p.config.Mode == ModeKV && p.config.TTL > 0 {
+		if err := p.deleteExpired(ctx, topic); err != nil {
+			// The keys are deleted again on the next publish, so this is not an error of the publish.
+			p.logger.Error("Failed to delete expired consul keys", err, watermill.LogFields{"topic": topic})
+		}
+	}
+	return allErrors
+}
+
+// deleteExpired deletes the keys under the topic's prefix that were published more than the TTL ago.
+func (p *consulPubSub) deleteExpired(ctx context.Context, topic string) error {
+	prefix := p.kvPrefix(topic) + "/"
+	keys, _, err := p.client.KV().Keys(prefix, "", p.queryOptions(ctx))
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-p.config.TTL).UnixNano()
+	var allErrors error
+	for _, key := range keys {
+		ts, _, ok := strings.Cut(strings.TrimPrefix(key, prefix), "-")
+		if !ok {
+			continue
+		}
+		published, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || published >= deadline {
+			continue
+		}
+		if _, err := p.client.KV().Delete(key, p.writeOptions(ctx)); err != nil {
+			allErrors = multierr.Append(allErrors, err)
+		}
+	}
+	return allErrors
+}
+
+// Subscribe watches the topic with blocking queries. Only messages published after the subscription are delivered.
+func (p *consulPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	var (
+		watch func(ctx context.Context, topic string, index uint64, output chan<- *message.Message) (uint64, bool)
+		index uint64
+		err   error
+	)
+	initCtx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	if p.config.Mode == ModeEvent {
+		watch = p.watchEvents
+		index, err = p.lastEventIndex(initCtx, topic)
+	} else {
+		watch = p.watchKV
+		var meta *api.QueryMeta
+		_, meta, err = p.client.KV().Keys(p.kvPrefix(topic)+"/", "", p.queryOptions(initCtx))
+		if err == nil {
+			index = meta.LastIndex
+		}
+	}
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to topic %q: %w", topic, err)
+	}
+
+	// The blocking queries are cancelled through ctx, so it is also cancelled when the Pub/Sub is closed.
+	ctx, cancel = context.WithCancel(ctx)
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case <-ctx.Done():
+		case <-p.closed:
+			cancel()
+		}
+	}()
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer cancel()
+		defer close(output)
+
+		for {
+			var ok bool
+			index, ok = watch(ctx, topic, index, output)
+			if !ok {
+				p.logger.Info("Consul subscriber stopped.", watermill.LogFields{"topic": topic})
+				return
+			}
+			select {
+			case <-time.After(p.config.ReconnectWait):
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+			p.logger.Info("Resuming consul watch.", watermill.LogFields{"topic": topic, "index": index})
+		}
+	}()
+
+	return output, nil
+}
+
+// watchKV delivers the keys put under the topic's prefix with a modify index above index, until a query fails or
+// a message is nacked. It returns the modify index of the last key handled, and false if the subscription has ended.
+func (p *consulPubSub) watchKV(ctx context.Context, topic string, index uint64, output chan<- *message.Message) (uint64, bool) {
+	prefix := p.kvPrefix(topic) + "/"
+	waitIndex := index
+	for {
+		q := p.queryOptions(ctx)
+		q.WaitIndex = waitIndex
+		q.WaitTime = p.config.WaitTime
+		pairs, meta, err := p.client.KV().List(prefix, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return index, false
+			}
+			p.logger.Error("Consul KV query failed.", err, watermill.LogFields{"topic": topic})
+			return index, true
+		}
+
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].ModifyIndex < pairs[j].ModifyIndex })
+		for _, pair := range pairs {
+			if pair.ModifyIndex <= index {
+				continue
+			}
+			acked, ok := p.deliverData(ctx, topic, pair.Value, output)
+			if !ok {
+				return index, false
+			}
+			if !acked {
+				// The next watch starts below the nacked key, so that it is delivered again.
+				return index, true
+			}
+			index = pair.ModifyIndex
+		}
+
+		// The index of a prefix goes backwards when tombstones of deleted keys are reaped, in which case
+		// the query is restarted from the beginning. An index of 0 would not block, so 1 is used instead.
+		if meta.LastIndex < waitIndex {
+			waitIndex = 0
+		}
+		waitIndex = max(waitIndex, meta.LastIndex, 1)
+	}
+}
+
+// lastEventIndex returns the index of the newest user event of the topic that the agent knows of.
+func (p *consulPubSub) lastEventIndex(ctx context.Context, topic string) (uint64, error) {
+	_, meta, err := p.client.Event().List(topic, p.queryOptions(ctx))
+	if err != nil {
+		return 0, err
+	}
+	return meta.LastIndex, nil
+}
+
+// watchEvents delivers the user events of the topic that follow the event with the given index, until a query
+// fails or a message is nacked. The index of a user event is derived from its ID, as is the index that the agent
+// returns for a list, so it identifies the newest event that has been handled.
+// It returns the index to resume from, and false if the subscription has ended.
+func (p *consulPubSub) watchEvents(ctx context.Context, topic string, index uint64, output chan<- *message.Message) (uint64, bool) {
+	for {
+		q := p.queryOptions(ctx)
+		q.WaitIndex = index
+		q.WaitTime = p.config.WaitTime
+		events, meta, err := p.client.Event().List(topic, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return index, false
+			}
+			p.logger.Error("Consul event query failed.", err, watermill.LogFields{"topic": topic})
+			return index, true
+		}
+		if meta.LastIndex == index {
+			continue
+		}
+
+		// The agent keeps a limited number of recent events, oldest first.
+		// While it has none, it returns an index of 1, which matches no event.
+		start := 0
+		if index > 1 {
+			start = -1
+			for i, event := range events {
+				if p.client.Event().IDToIndex(event.ID) == index {
+					start = i + 1
+					break
+				}
+			}
+			if start < 0 {
+				// The last handled event has been dropped from the agent's buffer, so updates may have been missed.
+				p.logger.Error("Consul user events were dropped, requesting a full reload.", nil,
+					watermill.LogFields{"topic": topic})
+				if !p.deliver(ctx, watcher.NewReloadMessage(), output) {
+					return index, false
+				}
+				index = meta.LastIndex
+				continue
+			}
+		}
+
+		for _, event := range events[start:] {
+			acked, ok := p.deliverData(ctx, topic, event.Payload, output)
+			if !ok {
+				return index, false
+			}
+			if !acked {
+				return index, true
+			}
+			index = p.client.Event().IDToIndex(event.ID)
+		}
+	}
+}
+
+// deliverData unmarshals data and delivers it. It returns whether the message was acked,
+// and false if the subscription has ended. Data that cannot be unmarshalled is skipped.
+func (p *consulPubSub) deliverData(ctx context.Context, topic string, data []byte, output chan<- *message.Message) (bool, bool) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		p.logger.Error("failed to unmarshal consul message", err, watermill.LogFields{"topic": topic})
+		return true, true
+	}
+	msg := message.NewMessage(env.UUID, env.Payload)
+	for k, v := range env.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false, false
+	case <-p.closed:
+		return false, false
+	}
+	select {
+	case <-msg.Acked():
+		return true, true
+	case <-msg.Nacked():
+		return false, true
+	case <-ctx.Done():
+		return false, false
+	case <-p.closed:
+		return false, false
+	}
+}
+
+// deliver sends msg to output and waits until it is acknowledged. It returns false if the subscription has ended.
+func (p *consulPubSub) deliver(ctx context.Context, msg *message.Message, output chan<- *message.Message) bool {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	return true
+}
+
+func (p *consulPubSub) queryOptions(ctx context.Context) *api.QueryOptions {
+	return (&api.QueryOptions{}).WithContext(ctx)
+}
+
+func (p *consulPubSub) writeOptions(ctx context.Context) *api.WriteOptions {
+	return (&api.WriteOptions{}).WithContext(ctx)
+}
+
+func (p *consulPubSub) kvPrefix(topic string) string {
+	return p.config.Prefix + topic
+}
+
+func (p *consulPubSub) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+	})
+	return nil
+}
+
+type consulConfig struct {
+	Address       string
+	Mode          string
+	Prefix        string
+	Token         string
+	TokenFile     string
+	Datacenter    string
+	TTL           time.Duration
+	WaitTime      time.Duration
+	Timeout       time.Duration
+	ReconnectWait time.Duration
+	TLS           *tls.Config
+}
+
+func parseConsulURL(u *url.URL) (*consulConfig, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("consul agent address is not specified in URL host")
+	}
+
+	query := u.Query()
+	config := &consulConfig{
+		Address:       u.Host,
+		Mode:          ModeKV,
+		Prefix:        "casbin-watcher/",
+		Token:         query.Get("token"),
+		TokenFile:     query.Get("token_file"),
+		Datacenter:    query.Get("datacenter"),
+		TTL:           time.Hour,
+		WaitTime:      time.Minute,
+		Timeout:       10 * time.Second,
+		ReconnectWait: time.Second,
+	}
+
+	if mode := query.Get("mode"); mode != "" {
+		switch mode {
+		case ModeKV, ModeEvent:
+			config.Mode = mode
+		default:
+			return nil, fmt.Errorf("invalid 'mode' param: %s", mode)
+		}
+	}
+
+	if prefix, ok := query["prefix"]; ok {
+		config.Prefix = prefix[0]
+	}
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		val, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'ttl' param: %w", err)
+		}
+		if val < 0 {
+			return nil, fmt.Errorf("invalid 'ttl' param: must not be negative")
+		}
+		config.TTL = val
+	}
+
+	if wt := query.Get("wait_time"); wt != "" {
+		val, err := time.ParseDuration(wt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'wait_time' param: %w", err)
+		}
+		config.WaitTime = val
+	}
+
+	if timeout := query.Get("timeout"); timeout != "" {
+		val, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timeout' param: %w", err)
+		}
+		config.Timeout = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.ReconnectWait = val
+	}
+
+	tlsConfig, err := tlsconfig.FromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	config.TLS = tlsConfig
+
+	return config, nil
+}
@@ -2,6 +2,8 @@ package etcd
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/url"
 	"strings"
@@ -10,10 +12,13 @@ import (
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/namespace"
 	"go.uber.org/multierr"
 
 	"github.com/origadmin/casbin-watcher/v3"
+	"github.com/origadmin/casbin-watcher/v3/internal/tlsconfig"
 )
 
 func init() {
@@ -30,20 +35,36 @@ func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.Logge
 		return nil, fmt.Errorf("failed to parse etcd url: %w", err)
 	}
 
+	// With a username and password, the client re-authenticates by itself when its auth token expires.
 	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   config.Endpoints,
-		DialTimeout: config.DialTimeout,
-		Username:    config.User,
-		Password:    config.Password,
+		Endpoints:            config.Endpoints,
+		DialTimeout:          config.DialTimeout,
+		DialKeepAliveTime:    config.KeepAliveTime,
+		DialKeepAliveTimeout: config.KeepAliveTimeout,
+		Username:             config.User,
+		Password:             config.Password,
+		TLS:                  config.TLS,
 	})
 	if err != nil {
 		return nil, err
 	}
+	if config.Namespace != "" {
+		// All keys, watches and leases are confined to the namespace.
+		cli.KV = namespace.NewKV(cli.KV, config.Namespace)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, config.Namespace)
+		cli.Lease = namespace.NewLease(cli.Lease, config.Namespace)
+	}
 
 	// Both publisher and subscriber will share the same client.
 	// The client will be closed by the pubSub wrapper.
-	publisher := &Publisher{cli: cli, logger: logger}
-	subscriber := &Subscriber{cli: cli, logger: logger}
+	publisher := &Publisher{cli: cli, logger: logger, ttl: config.TTL}
+	subscriber := &Subscriber{
+		cli:           cli,
+		logger:        logger,
+		dialTimeout:   config.DialTimeout,
+		reconnectWait: config.ReconnectWait,
+		closed:        make(chan struct{}),
+	}
 
 	return &pubSub{
 		cli:        cli,
@@ -70,10 +91,11 @@ func (e *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.M
 	return e.subscriber.Subscribe(ctx, topic)
 }
 
-// Close ensures the underlying etcd client is closed only once.
+// Close stops the subscriptions and ensures the underlying etcd client is closed only once.
 func (e *pubSub) Close() error {
 	var err error
 	e.closeOnce.Do(func() {
+		e.subscriber.stop()
 		err = e.cli.Close()
 	})
 	return err
@@ -83,15 +105,27 @@ func (e *pubSub) Close() error {
 type Publisher struct {
 	cli    *clientv3.Client
 	logger watermill.LoggerAdapter
+	ttl    time.Duration
 }
 
 // Publish publishes messages to etcd.
+// If a TTL is configured, the keys are attached to a new lease, so that they are deleted when it expires.
 func (p *Publisher) Publish(topic string, messages ...*message.Message) error {
+	var opts []clientv3.OpOption
+	if p.ttl > 0 {
+		lease, err := p.cli.Grant(context.Background(), int64((p.ttl+time.Second-1)/time.Second))
+		if err != nil {
+			p.logger.Error("Failed to grant lease for etcd messages", err, watermill.LogFields{"topic": topic})
+			return err
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+
 	var allErrors error
 	for _, msg := range messages {
 		// Use a key structure that is easy to watch with a prefix.
 		key := topic + "/" + msg.UUID
-		_, err := p.cli.Put(context.Background(), key, string(msg.Payload))
+		_, err := p.cli.Put(context.Background(), key, string(msg.Payload), opts...)
 		if err != nil {
 			p.logger.Error("Failed to publish message to etcd", err, watermill.LogFields{"topic": topic, "key": key})
 			allErrors = multierr.Append(allErrors, err)
@@ -107,50 +141,125 @@ func (p *Publisher) Close() error {
 
 // Subscriber implements message.Subscriber for etcd.
 type Subscriber struct {
-	cli    *clientv3.Client
-	logger watermill.LoggerAdapter
+	cli           *clientv3.Client
+	logger        watermill.LoggerAdapter
+	dialTimeout   time.Duration
+	reconnectWait time.Duration
+
+	closed   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 // Subscribe subscribes to a topic in etcd.
+// The subscriber keeps track of the last revision it has seen and resumes watching after it when the watch fails.
+// If that revision has been compacted, updates may have been missed, so a reload message is delivered
+// (see watcher.NewReloadMessage) and watching resumes from the oldest revision that is still available.
 func (s *Subscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
-	output := make(chan *message.Message)
+	// Start watching after the current revision to avoid getting old messages.
+	getCtx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+	resp, err := s.cli.Get(getCtx, topic, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current etcd revision: %w", err)
+	}
+	revision := resp.Header.Revision
 
+	output := make(chan *message.Message)
+	s.wg.Add(1)
 	go func() {
+		defer s.wg.Done()
 		defer close(output)
 
-		// Start watching from the current revision to avoid getting old messages.
-		watchChan := s.cli.Watch(ctx, topic, clientv3.WithPrefix())
-
+		logFields := watermill.LogFields{"topic": topic}
 		for {
+			var ok bool
+			revision, ok = s.watch(ctx, topic, revision, output)
+			if !ok {
+				s.logger.Info("Etcd subscriber stopped.", logFields)
+				return
+			}
 			select {
+			case <-time.After(s.reconnectWait):
 			case <-ctx.Done():
-				s.logger.Info("Etcd subscriber context done, stopping watch.", watermill.LogFields{"topic": topic})
 				return
-			case watchResp, ok := <-watchChan:
-				if !ok {
-					s.logger.Error("Etcd watch channel closed.", nil, watermill.LogFields{"topic": topic})
-					return
-				}
-				if err := watchResp.Err(); err != nil {
-					s.logger.Error("Etcd watch error.", err, watermill.LogFields{"topic": topic})
-					// The watch might be compacted or cancelled. The consumer should handle reconnection if needed.
-					return
+			case <-s.closed:
+				return
+			}
+			s.logger.Info("Resuming etcd watch.", watermill.LogFields{"topic": topic, "revision": revision})
+		}
+	}()
+
+	return output, nil
+}
+
+// watch delivers the values put under topic after revision until the watch fails.
+// It returns the last revision seen, and false if the subscription has ended.
+func (s *Subscriber) watch(ctx context.Context, topic string, revision int64, output chan<- *message.Message) (int64, bool) {
+	// WithRequireLeader makes the watch fail if the member is cut off from the cluster,
+	// so that it can be resumed on another member.
+	watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	watchChan := s.cli.Watch(watchCtx, topic, clientv3.WithPrefix(), clientv3.WithRev(revision+1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return revision, false
+		case <-s.closed:
+			return revision, false
+		case watchResp, ok := <-watchChan:
+			if !ok {
+				s.logger.Error("Etcd watch channel closed.", nil, watermill.LogFields{"topic": topic})
+				return revision, true
+			}
+			if err := watchResp.Err(); err != nil {
+				if errors.Is(err, rpctypes.ErrCompacted) {
+					s.logger.Error("Etcd watch revision compacted, requesting a full reload.", err,
+						watermill.LogFields{"topic": topic, "revision": revision, "compact_revision": watchResp.CompactRevision})
+					if !s.deliver(ctx, watcher.NewReloadMessage(), output) {
+						return revision, false
+					}
+					return watchResp.CompactRevision - 1, true
 				}
+				s.logger.Error("Etcd watch error.", err, watermill.LogFields{"topic": topic})
+				return revision, true
+			}
 
-				for _, event := range watchResp.Events {
-					// We only care about new values being put.
-					if event.Type == clientv3.EventTypePut {
-						// Create a new message and send it to the output channel.
-						// The UUID is newly generated as we are creating a new watermill message.
-						msg := message.NewMessage(watermill.NewUUID(), event.Kv.Value)
-						output <- msg
+			for _, event := range watchResp.Events {
+				// We only care about new values being put.
+				if event.Type == clientv3.EventTypePut {
+					// Create a new message and send it to the output channel.
+					// The UUID is newly generated as we are creating a new watermill message.
+					msg := message.NewMessage(watermill.NewUUID(), event.Kv.Value)
+					if !s.deliver(ctx, msg, output) {
+						return revision, false
 					}
 				}
+				revision = event.Kv.ModRevision
 			}
 		}
-	}()
+	}
+}
 
-	return output, nil
+// deliver sends msg to output and waits until it is acknowledged. It returns false if the subscription has ended.
+func (s *Subscriber) deliver(ctx context.Context, msg *message.Message, output chan<- *message.Message) bool {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	case <-s.closed:
+		return false
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return false
+	case <-s.closed:
+		return false
+	}
+	return true
 }
 
 // Close is a no-op because the client is managed by the pubSub wrapper.
@@ -158,11 +267,25 @@ func (s *Subscriber) Close() error {
 	return nil
 }
 
+// stop ends all subscriptions and waits for them to return.
+func (s *Subscriber) stop() {
+	s.stopOnce.Do(func() {
+		close(s.closed)
+	})
+	s.wg.Wait()
+}
+
 type etcdConfig struct {
-	Endpoints   []string
-	DialTimeout time.Duration
-	User        string
-	Password    string
+	Endpoints        []string
+	DialTimeout      time.Duration
+	KeepAliveTime    time.Duration
+	KeepAliveTimeout time.Duration
+	User             string
+	Password         string
+	TLS              *tls.Config
+	Namespace        string
+	TTL              time.Duration
+	ReconnectWait    time.Duration
 }
 
 func parseEtcdURL(u *url.URL) (*etcdConfig, error) {
@@ -172,8 +295,9 @@ func parseEtcdURL(u *url.URL) (*etcdConfig, error) {
 
 	query := u.Query()
 	config := &etcdConfig{
-		Endpoints:   strings.Split(u.Host, ","),
-		DialTimeout: 5 * time.Second, // Default dial timeout
+		Endpoints:     strings.Split(u.Host, ","),
+		DialTimeout:   5 * time.Second, // Default dial timeout
+		ReconnectWait: time.Second,
 	}
 
 	if dt := query.Get("dial_timeout"); dt != "" {
@@ -184,6 +308,48 @@ func parseEtcdURL(u *url.URL) (*etcdConfig, error) {
 		config.DialTimeout = val
 	}
 
+	if kt := query.Get("keepalive_time"); kt != "" {
+		val, err := time.ParseDuration(kt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'keepalive_time' param: %w", err)
+		}
+		config.KeepAliveTime = val
+	}
+
+	if kt := query.Get("keepalive_timeout"); kt != "" {
+		val, err := time.ParseDuration(kt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'keepalive_timeout' param: %w", err)
+		}
+		config.KeepAliveTimeout = val
+	}
+
+	tlsConfig, err := tlsconfig.FromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	config.TLS = tlsConfig
+	config.Namespace = query.Get("namespace")
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		val, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'ttl' param: %w", err)
+		}
+		if val < 0 {
+			return nil, fmt.Errorf("invalid 'ttl' param: must not be negative")
+		}
+		config.TTL = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.ReconnectWait = val
+	}
+
 	if user := u.User.Username(); user != "" {
 		config.User = user
 		if pass, ok := u.User.Password(); ok {
@@ -0,0 +1,437 @@
+package fswatch
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/multierr"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("fswatch", &Driver{})
+}
+
+const (
+	// eventFileSuffix is the suffix of event files. Files without it, and hidden files, are ignored.
+	eventFileSuffix = ".json"
+	// tmpFileSuffix is the suffix of the hidden files that event files are written to before they are renamed.
+	tmpFileSuffix = ".tmp"
+)
+
+// Driver implements the watcher.Driver interface for a directory shared between processes.
+type Driver struct{}
+
+// NewPubSub creates a new Pub/Sub that exchanges messages as event files in the directory given by the 'dir' param.
+func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseFSWatchURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fswatch url: %w", err)
+	}
+
+	return &fsPubSub{
+		config: config,
+		logger: logger,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// envelope is the JSON representation of a message in an event file.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type fsPubSub struct {
+	config *fsWatchConfig
+	logger watermill.LoggerAdapter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish writes each message to an event file in the topic's directory. The file is written under a hidden name
+// and renamed when it is complete, so subscribers never read a partially written file.
+func (p *fsPubSub) Publish(topic string, messages ...*message.Message) error {
+	topicDir, err := p.topicDir(topic)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(topicDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for topic %q: %w", topic, err)
+	}
+
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		// The publish time is part of the name, so that expired files can be found without reading them.
+		name := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), msg.UUID, eventFileSuffix)
+		if err := writeFile(topicDir, name, data); err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+
+	if p.config.TTL > 0 {
+		if err := p.deleteExpired(topicDir); err != nil {
+			// The files are deleted again on the next publish, so this is not an error of the publish.
+			p.logger.Error("Failed to delete expired event files", err, watermill.LogFields{"topic": topic})
+		}
+	}
+	return nil
+}
+
+// writeFile writes data to a hidden file in dir, syncs it and renames it to name.
+func writeFile(dir, name string, data []byte) error {
+	tmpPath := filepath.Join(dir, "."+name+tmpFileSuffix)
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(dir, name))
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+	}
+	return err
+}
+
+// deleteExpired deletes the event files in topicDir that were published more than the TTL ago, and the hidden files
+// left behind by publishers that failed while writing.
+func (p *fsPubSub) deleteExpired(topicDir string) error {
+	entries, err := os.ReadDir(topicDir)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-p.config.TTL).UnixNano()
+	var allErrors error
+	for _, entry := range entries {
+		name := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), "."), tmpFileSuffix)
+		published, ok := parseFileName(name)
+		if !ok || published >= deadline {
+			continue
+		}
+		if err := os.Remove(filepath.Join(topicDir, entry.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			// Another publisher may have deleted the file first.
+			allErrors = multierr.Append(allErrors, err)
+		}
+	}
+	return allErrors
+}
+
+// Subscribe delivers the event files that appear in the topic's directory from now on. The directory is watched
+// with fsnotify and also scanned every poll_interval, which picks up files written by other hosts to network file
+// systems that do not report changes. With poll=true, or where fsnotify is not available, it is only scanned.
+func (p *fsPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	topicDir, err := p.topicDir(topic)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(topicDir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for topic %q: %w", topic, err)
+	}
+
+	// The watch is added before the first scan, so that no file is missed in between.
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	var fsw *fsnotify.Watcher
+	if !p.config.Poll {
+		fsw, err = fsnotify.NewWatcher()
+		if err == nil {
+			err = fsw.Add(topicDir)
+		}
+		if err != nil {
+			p.logger.Error("Failed to watch directory, falling back to polling", err, watermill.LogFields{"dir": topicDir})
+			if fsw != nil {
+				_ = fsw.Close()
+			}
+			fsw = nil
+		} else {
+			events, errs = fsw.Events, fsw.Errors
+		}
+	}
+
+	// Files that exist when subscribing have been published before and are not delivered.
+	names, err := listEventFiles(topicDir)
+	if err != nil {
+		if fsw != nil {
+			_ = fsw.Close()
+		}
+		return nil, fmt.Errorf("failed to read directory for topic %q: %w", topic, err)
+	}
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		seen[name] = struct{}{}
+	}
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		if fsw != nil {
+			defer fsw.Close()
+		}
+
+		logFields := watermill.LogFields{"topic": topic, "dir": topicDir}
+		ticker := time.NewTicker(p.config.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				// Events may have been lost, for example when the event queue overflowed; the scan picks them up.
+				p.logger.Error("Error while watching directory", err, logFields)
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+
+			if !p.scan(ctx, topicDir, seen, output, logFields) {
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// scan delivers the event files in topicDir that are not in seen, in the order they were published, and adds them
+// to seen once they are acked. When a message is nacked, scan waits for retry_wait and delivers it again. Files that
+// no longer exist are removed from seen. It returns false if the subscription has ended.
+func (p *fsPubSub) scan(ctx context.Context, topicDir string, seen map[string]struct{}, output chan<- *message.Message, logFields watermill.LogFields) bool {
+	for {
+		names, err := listEventFiles(topicDir)
+		if err != nil {
+			p.logger.Error("Failed to read directory", err, logFields)
+			return true
+		}
+
+		nacked := false
+		for _, name := range names {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			acked, ok := p.deliverFile(ctx, filepath.Join(topicDir, name), output, logFields)
+			if !ok {
+				return false
+			}
+			if !acked {
+				nacked = true
+				break
+			}
+			seen[name] = struct{}{}
+		}
+
+		current := make(map[string]struct{}, len(names))
+		for _, name := range names {
+			current[name] = struct{}{}
+		}
+		for name := range seen {
+			if _, ok := current[name]; !ok {
+				delete(seen, name)
+			}
+		}
+		if !nacked {
+			return true
+		}
+
+		select {
+		case <-time.After(p.config.RetryWait):
+		case <-ctx.Done():
+			return false
+		case <-p.closed:
+			return false
+		}
+	}
+}
+
+// deliverFile reads the event file at path and delivers it. It returns whether the message was acked,
+// and false if the subscription has ended. Files that have been deleted or cannot be unmarshalled are skipped.
+func (p *fsPubSub) deliverFile(ctx context.Context, path string, output chan<- *message.Message, logFields watermill.LogFields) (bool, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			p.logger.Error("Failed to read event file", err, logFields.Add(watermill.LogFields{"file": path}))
+		}
+		return true, true
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		p.logger.Error("Failed to unmarshal event file", err, logFields.Add(watermill.LogFields{"file": path}))
+		return true, true
+	}
+	msg := message.NewMessage(env.UUID, env.Payload)
+	for k, v := range env.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false, false
+	case <-p.closed:
+		return false, false
+	}
+	select {
+	case <-msg.Acked():
+		return true, true
+	case <-msg.Nacked():
+		return false, true
+	case <-ctx.Done():
+		return false, false
+	case <-p.closed:
+		return false, false
+	}
+}
+
+// topicDir returns the directory of the topic. Topics cannot leave the configured directory.
+func (p *fsPubSub) topicDir(topic string) (string, error) {
+	if topic == "" || topic == "." || topic == ".." || strings.ContainsAny(topic, `/\`) {
+		return "", fmt.Errorf("invalid topic %q for fswatch driver", topic)
+	}
+	return filepath.Join(p.config.Dir, topic), nil
+}
+
+func (p *fsPubSub) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+	})
+	return nil
+}
+
+// listEventFiles returns the names of the event files in dir, sorted by publish time.
+func listEventFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || !strings.HasSuffix(name, eventFileSuffix) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// parseFileName returns the publish time in Unix nanoseconds encoded in the name of an event file.
+func parseFileName(name string) (int64, bool) {
+	if !strings.HasSuffix(name, eventFileSuffix) {
+		return 0, false
+	}
+	ts, _, ok := strings.Cut(name, "-")
+	if !ok {
+		return 0, false
+	}
+	published, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return published, true
+}
+
+type fsWatchConfig struct {
+	Dir          string
+	Poll         bool
+	PollInterval time.Duration
+	TTL          time.Duration
+	RetryWait    time.Duration
+}
+
+func parseFSWatchURL(u *url.URL) (*fsWatchConfig, error) {
+	query := u.Query()
+	config := &fsWatchConfig{
+		Dir:          query.Get("dir"),
+		PollInterval: 2 * time.Second,
+		TTL:          time.Hour,
+		RetryWait:    time.Second,
+	}
+	if config.Dir == "" {
+		return nil, fmt.Errorf("fswatch driver requires a directory in the 'dir' query parameter")
+	}
+
+	if poll := query.Get("poll"); poll != "" {
+		val, err := strconv.ParseBool(poll)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'poll' param: %w", err)
+		}
+		config.Poll = val
+	}
+
+	if pi := query.Get("poll_interval"); pi != "" {
+		val, err := time.ParseDuration(pi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'poll_interval' param: %w", err)
+		}
+		if val <= 0 {
+			return nil, fmt.Errorf("invalid 'poll_interval' param: must be positive")
+		}
+		config.PollInterval = val
+	}
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		val, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'ttl' param: %w", err)
+		}
+		if val < 0 {
+			return nil, fmt.Errorf("invalid 'ttl' param: must not be negative")
+		}
+		config.TTL = val
+	}
+
+	if rw := query.Get("retry_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'retry_wait' param: %w", err)
+		}
+		config.RetryWait = val
+	}
+
+	return config, nil
+}
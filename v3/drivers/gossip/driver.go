@@ -0,0 +1,468 @@
+package gossip
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hashicorp/memberlist"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("gossip", &Driver{})
+}
+
+const (
+	// DefaultBindAddr is the address the member binds to if the URL has no host.
+	DefaultBindAddr = "0.0.0.0:7946"
+
+	// maxBroadcastSize is the size up to which a message is gossiped. Larger messages do not fit into a gossip
+	// packet and are sent to every member over TCP instead.
+	maxBroadcastSize = 1024
+	// subscriberQueueSize is the number of messages queued for a slow subscriber before messages are dropped.
+	subscriberQueueSize = 256
+	// seenTTL is how long the UUIDs of received messages are remembered to discard duplicates.
+	seenTTL = 5 * time.Minute
+)
+
+var errClosed = errors.New("gossip pubsub is closed")
+
+// Driver implements the watcher.Driver interface for a gossip cluster.
+type Driver struct{}
+
+// NewPubSub creates a member of the gossip cluster and joins it through the seed nodes.
+// If no seed can be reached, the member keeps trying to join every rejoin_interval.
+func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseGossipURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse gossip url: %w", err)
+	}
+
+	p := &pubSub{
+		config:      config,
+		logger:      logger,
+		subscribers: make(map[string]map[*subscriber]struct{}),
+		seen:        make(map[string]time.Time),
+		closed:      make(chan struct{}),
+	}
+	p.queue = &memberlist.TransmitLimitedQueue{
+		NumNodes:       func() int { return p.list.NumMembers() },
+		RetransmitMult: config.Memberlist.RetransmitMult,
+	}
+	config.Memberlist.Delegate = p
+	config.Memberlist.Logger = log.New(logWriter{logger: logger}, "", 0)
+
+	p.list, err = memberlist.Create(config.Memberlist)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gossip member: %w", err)
+	}
+
+	if len(config.Seeds) > 0 {
+		if _, err := p.list.Join(config.Seeds); err != nil {
+			logger.Error("Failed to join gossip cluster, retrying in the background", err,
+				watermill.LogFields{"seeds": config.Seeds})
+		}
+		p.wg.Add(1)
+		go p.rejoin()
+	}
+	return p, nil
+}
+
+// envelope is the JSON representation of a message as it is gossiped between members.
+type envelope struct {
+	Topic    string            `json:"topic"`
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+// subscriber is a subscription to the messages of a topic.
+type subscriber struct {
+	queue chan *envelope
+}
+
+type pubSub struct {
+	config *gossipConfig
+	logger watermill.LoggerAdapter
+	list   *memberlist.Memberlist
+	queue  *memberlist.TransmitLimitedQueue
+
+	mu          sync.Mutex
+	subscribers map[string]map[*subscriber]struct{}
+	// seen holds the UUIDs of the messages that have been received or published, with the time they were first seen.
+	seen      map[string]time.Time
+	lastPurge time.Time
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish disseminates the messages to all members of the cluster, including this one. Small messages are gossiped,
+// so they reach members that cannot be contacted directly; larger messages are sent to every member over TCP.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	select {
+	case <-p.closed:
+		return errClosed
+	default:
+	}
+
+	for _, msg := range messages {
+		env := &envelope{
+			Topic:    topic,
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		}
+		data, err := json.Marshal(env)
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		if !p.markSeen(msg.UUID) {
+			continue
+		}
+		p.dispatch(env)
+
+		if len(data) <= maxBroadcastSize {
+			p.queue.QueueBroadcast(&broadcast{data: data})
+			continue
+		}
+		local := p.list.LocalNode()
+		for _, node := range p.list.Members() {
+			if node.Name == local.Name {
+				continue
+			}
+			if err := p.list.SendReliable(node, data); err != nil {
+				p.logger.Error("Failed to send message to gossip member", err,
+					watermill.LogFields{"uuid": msg.UUID, "member": node.Name})
+			}
+		}
+	}
+	return nil
+}
+
+// Subscribe delivers the messages of the topic that this member receives from now on. Messages are not redelivered
+// when they are nacked, and messages disseminated while a member is not part of the cluster are not delivered to it.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	select {
+	case <-p.closed:
+		return nil, errClosed
+	default:
+	}
+
+	s := &subscriber{queue: make(chan *envelope, subscriberQueueSize)}
+	p.mu.Lock()
+	if p.subscribers[topic] == nil {
+		p.subscribers[topic] = make(map[*subscriber]struct{})
+	}
+	p.subscribers[topic][s] = struct{}{}
+	p.mu.Unlock()
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer func() {
+			p.mu.Lock()
+			delete(p.subscribers[topic], s)
+			if len(p.subscribers[topic]) == 0 {
+				delete(p.subscribers, topic)
+			}
+			p.mu.Unlock()
+		}()
+
+		for {
+			select {
+			case env := <-s.queue:
+				if !p.deliver(ctx, env, output) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// deliver sends env to output as a message and waits until it is acknowledged. It returns false if the
+// subscription has ended.
+func (p *pubSub) deliver(ctx context.Context, env *envelope, output chan<- *message.Message) bool {
+	msg := message.NewMessage(env.UUID, env.Payload)
+	for k, v := range env.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	return true
+}
+
+// dispatch queues env for the subscribers of its topic. It does not block; messages for a subscriber that cannot
+// keep up are dropped.
+func (p *pubSub) dispatch(env *envelope) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for s := range p.subscribers[env.Topic] {
+		select {
+		case s.queue <- env:
+		default:
+			p.logger.Error("Gossip subscriber is too slow, dropping message", nil,
+				watermill.LogFields{"topic": env.Topic, "uuid": env.UUID})
+		}
+	}
+}
+
+// markSeen records uuid and reports whether it has not been seen before.
+func (p *pubSub) markSeen(uuid string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.lastPurge) > seenTTL {
+		for id, t := range p.seen {
+			if now.Sub(t) > seenTTL {
+				delete(p.seen, id)
+			}
+		}
+		p.lastPurge = now
+	}
+	if _, ok := p.seen[uuid]; ok {
+		return false
+	}
+	p.seen[uuid] = now
+	return true
+}
+
+// rejoin joins the cluster through the seed nodes every rejoin_interval while no other member is known, for example
+// because no seed was reachable at startup or the member has been partitioned from the cluster.
+func (p *pubSub) rejoin() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-time.After(p.config.RejoinInterval):
+		case <-p.closed:
+			return
+		}
+		if p.list.NumMembers() > 1 {
+			continue
+		}
+		if _, err := p.list.Join(p.config.Seeds); err != nil {
+			p.logger.Error("Failed to join gossip cluster", err, watermill.LogFields{"seeds": p.config.Seeds})
+		}
+	}
+}
+
+// NodeMeta implements memberlist.Delegate.
+func (p *pubSub) NodeMeta(int) []byte {
+	return nil
+}
+
+// NotifyMsg implements memberlist.Delegate. It dispatches messages that have not been seen before and gossips them
+// on, so that they reach all members even if the publisher fails.
+func (p *pubSub) NotifyMsg(data []byte) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		p.logger.Error("Failed to unmarshal gossip message", err, nil)
+		return
+	}
+	if !p.markSeen(env.UUID) {
+		return
+	}
+	p.dispatch(&env)
+	if len(data) <= maxBroadcastSize {
+		p.queue.QueueBroadcast(&broadcast{data: append([]byte(nil), data...)})
+	}
+}
+
+// GetBroadcasts implements memberlist.Delegate.
+func (p *pubSub) GetBroadcasts(overhead, limit int) [][]byte {
+	return p.queue.GetBroadcasts(overhead, limit)
+}
+
+// LocalState implements memberlist.Delegate. Messages are not part of the state exchanged between members.
+func (p *pubSub) LocalState(bool) []byte {
+	return nil
+}
+
+// MergeRemoteState implements memberlist.Delegate.
+func (p *pubSub) MergeRemoteState([]byte, bool) {}
+
+func (p *pubSub) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+
+		if leaveErr := p.list.Leave(p.config.LeaveTimeout); leaveErr != nil {
+			p.logger.Error("Failed to leave gossip cluster", leaveErr, nil)
+		}
+		err = p.list.Shutdown()
+	})
+	return err
+}
+
+// broadcast is a message in the gossip queue. Every message is unique, so it never invalidates another.
+type broadcast struct {
+	data []byte
+}
+
+func (b *broadcast) Invalidates(memberlist.Broadcast) bool {
+	return false
+}
+
+func (b *broadcast) Message() []byte {
+	return b.data
+}
+
+func (b *broadcast) Finished() {}
+
+func (b *broadcast) UniqueBroadcast() {}
+
+// logWriter forwards the log output of memberlist to the watermill logger.
+type logWriter struct {
+	logger watermill.LoggerAdapter
+}
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w.logger.Debug(strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+type gossipConfig struct {
+	Memberlist     *memberlist.Config
+	Seeds          []string
+	RejoinInterval time.Duration
+	LeaveTimeout   time.Duration
+}
+
+func parseGossipURL(u *url.URL) (*gossipConfig, error) {
+	query := u.Query()
+
+	var ml *memberlist.Config
+	switch profile := query.Get("profile"); profile {
+	case "", "lan":
+		ml = memberlist.DefaultLANConfig()
+	case "wan":
+		ml = memberlist.DefaultWANConfig()
+	case "local":
+		ml = memberlist.DefaultLocalConfig()
+	default:
+		return nil, fmt.Errorf("invalid 'profile' param: %s", profile)
+	}
+
+	config := &gossipConfig{
+		Memberlist:     ml,
+		RejoinInterval: 30 * time.Second,
+		LeaveTimeout:   5 * time.Second,
+	}
+
+	bindAddr := u.Host
+	if bindAddr == "" {
+		bindAddr = DefaultBindAddr
+	}
+	host, port, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bind address in URL host: %w", err)
+	}
+	ml.BindAddr = host
+	if ml.BindPort, err = strconv.Atoi(port); err != nil {
+		return nil, fmt.Errorf("invalid bind address in URL host: %w", err)
+	}
+	ml.AdvertisePort = ml.BindPort
+
+	if advertise := query.Get("advertise"); advertise != "" {
+		host, port, err := net.SplitHostPort(advertise)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'advertise' param: %w", err)
+		}
+		ml.AdvertiseAddr = host
+		if ml.AdvertisePort, err = strconv.Atoi(port); err != nil {
+			return nil, fmt.Errorf("invalid 'advertise' param: %w", err)
+		}
+	}
+
+	ml.Name = query.Get("node")
+	if ml.Name == "" {
+		hostname, _ := os.Hostname()
+		ml.Name = hostname + "-" + watermill.NewShortUUID()
+	}
+
+	if seeds := query.Get("seeds"); seeds != "" {
+		config.Seeds = strings.Split(seeds, ",")
+	}
+
+	key := query.Get("key")
+	if keyFile := query.Get("key_file"); keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'key_file' param: %w", err)
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	if key != "" {
+		secret, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		if err := memberlist.ValidateKey(secret); err != nil {
+			return nil, fmt.Errorf("invalid encryption key: %w", err)
+		}
+		ml.SecretKey = secret
+	}
+
+	ml.Label = query.Get("label")
+
+	if ri := query.Get("rejoin_interval"); ri != "" {
+		val, err := time.ParseDuration(ri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'rejoin_interval' param: %w", err)
+		}
+		if val <= 0 {
+			return nil, fmt.Errorf("invalid 'rejoin_interval' param: must be positive")
+		}
+		config.RejoinInterval = val
+	}
+
+	if lt := query.Get("leave_timeout"); lt != "" {
+		val, err := time.ParseDuration(lt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'leave_timeout' param: %w", err)
+		}
+		config.LeaveTimeout = val
+	}
+
+	return config, nil
+}
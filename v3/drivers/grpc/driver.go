@@ -0,0 +1,467 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/origadmin/casbin-watcher/v3"
+	"github.com/origadmin/casbin-watcher/v3/drivers/grpc/relay"
+	"github.com/origadmin/casbin-watcher/v3/internal/tlsconfig"
+)
+
+func init() {
+	watcher.RegisterDriver("grpc", &Driver{})
+}
+
+// subscriptionQueueSize is the number of messages queued for a slow subscription before messages are dropped.
+const subscriptionQueueSize = 256
+
+var errClosed = errors.New("grpc pubsub is closed")
+
+type dialOptionsKey struct{}
+
+// WithDialOptions returns a context carrying additional grpc.DialOptions for the connection
+// to the relay, for example grpc.WithContextDialer to connect through a bufconn listener.
+// They are applied after the options derived from the URL.
+func WithDialOptions(ctx context.Context, opts ...grpc.DialOption) context.Context {
+	return context.WithValue(ctx, dialOptionsKey{}, opts)
+}
+
+// Driver implements the watcher.Driver interface for the gRPC relay.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub that publishes and subscribes through a relay
+// implementing the PolicyUpdates service of the relay package.
+// All topics share a single stream, which is re-opened when it fails.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseGRPCURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse grpc url: %w", err)
+	}
+
+	creds := insecure.NewCredentials()
+	if config.TLS != nil {
+		creds = credentials.NewTLS(config.TLS)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if config.KeepaliveTime > 0 {
+		opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                config.KeepaliveTime,
+			Timeout:             config.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}))
+	}
+	if extra, ok := ctx.Value(dialOptionsKey{}).([]grpc.DialOption); ok {
+		opts = append(opts, extra...)
+	}
+
+	// The relay keeps its subscribers in memory, so all watchers must talk to the same instance;
+	// the passthrough resolver connects to the address as given instead of balancing across resolved addresses.
+	conn, err := grpc.NewClient("passthrough:///"+config.Address, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create grpc client: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(context.Background())
+	ps := &pubSub{
+		config:        config,
+		logger:        logger,
+		conn:          conn,
+		ready:         make(chan struct{}),
+		pending:       make(map[uint64]chan error),
+		subscriptions: make(map[string]map[*subscription]struct{}),
+		cancel:        cancel,
+		closed:        make(chan struct{}),
+	}
+	ps.wg.Add(1)
+	go ps.run(runCtx)
+	return ps, nil
+}
+
+type pubSub struct {
+	config *grpcConfig
+	logger watermill.LoggerAdapter
+	conn   *grpc.ClientConn
+
+	// mu guards the current stream, the readiness channel, the pending publishes and the subscriptions.
+	mu     sync.Mutex
+	stream grpc.ClientStream
+	// ready is closed when a stream is open, and replaced when the stream fails.
+	ready         chan struct{}
+	nextID        uint64
+	pending       map[uint64]chan error
+	subscriptions map[string]map[*subscription]struct{}
+
+	// sendMu serializes the writes to the stream, as grpc.ClientStream.SendMsg is not safe for concurrent use.
+	sendMu sync.Mutex
+
+	cancel    context.CancelFunc
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+
+	// testHookSubscribe is called by Subscribe once the relay is reachable, before the subscription is added.
+	testHookSubscribe func()
+}
+
+// subscription is a Subscribe call, which receives the messages of its topic through queue.
+type subscription struct {
+	queue chan *relay.Message
+}
+
+// run keeps a stream to the relay open until ctx is done.
+func (p *pubSub) run(ctx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		err := p.serve(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		p.logger.Error("grpc relay stream failed, reconnecting", err, watermill.LogFields{"address": p.config.Address})
+
+		select {
+		case <-time.After(p.config.ReconnectWait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// serve opens a stream, restores the subscriptions and dispatches the frames of the relay until the stream fails.
+func (p *pubSub) serve(ctx context.Context) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// WaitForReady makes the call wait for the connection to the relay instead of failing fast.
+	stream, err := relay.NewStream(streamCtx, p.conn, grpc.WaitForReady(true))
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	topics := make([]string, 0, len(p.subscriptions))
+	for topic := range p.subscriptions {
+		topics = append(topics, topic)
+	}
+	p.stream = stream
+	close(p.ready)
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		p.stream = nil
+		p.ready = make(chan struct{})
+		for id, result := range p.pending {
+			result <- errors.New("grpc relay stream failed before the publish was acknowledged")
+			delete(p.pending, id)
+		}
+		p.mu.Unlock()
+	}()
+
+	for _, topic := range topics {
+		if err := p.send(stream, &relay.ClientFrame{Subscribe: &relay.Subscribe{Topic: topic}}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var f relay.ServerFrame
+		if err := stream.RecvMsg(&f); err != nil {
+			return err
+		}
+		switch {
+		case f.Delivery != nil:
+			p.dispatch(f.Delivery)
+		case f.PublishAck != nil:
+			p.acknowledge(f.PublishAck)
+		}
+	}
+}
+
+func (p *pubSub) send(stream grpc.ClientStream, f *relay.ClientFrame) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	return stream.SendMsg(f)
+}
+
+// dispatch queues the delivered message for every subscription of its topic.
+func (p *pubSub) dispatch(d *relay.Delivery) {
+	if d.Message == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for sub := range p.subscriptions[d.Topic] {
+		select {
+		case sub.queue <- d.Message:
+		default:
+			p.logger.Error("grpc subscription fell behind, dropping message", nil, watermill.LogFields{
+				"topic": d.Topic,
+				"uuid":  d.Message.UUID,
+			})
+		}
+	}
+}
+
+func (p *pubSub) acknowledge(ack *relay.PublishAck) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	result, ok := p.pending[ack.ID]
+	if !ok {
+		return
+	}
+	delete(p.pending, ack.ID)
+	if ack.Error != "" {
+		result <- fmt.Errorf("relay rejected message: %s", ack.Error)
+	} else {
+		result <- nil
+	}
+}
+
+// awaitStream returns the open stream, waiting for it to be (re)established until ctx is done.
+func (p *pubSub) awaitStream(ctx context.Context) (grpc.ClientStream, error) {
+	for {
+		p.mu.Lock()
+		stream, ready := p.stream, p.ready
+		p.mu.Unlock()
+		if stream != nil {
+			return stream, nil
+		}
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("grpc relay is not available: %w", ctx.Err())
+		case <-p.closed:
+			return nil, errClosed
+		}
+	}
+}
+
+// Publish sends the messages to the relay and waits until each is acknowledged or the timeout expires.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		if err := p.publish(topic, msg); err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+func (p *pubSub) publish(topic string, msg *message.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	stream, err := p.awaitStream(ctx)
+	if err != nil {
+		return err
+	}
+
+	result := make(chan error, 1)
+	p.mu.Lock()
+	p.nextID++
+	id := p.nextID
+	p.pending[id] = result
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.mu.Unlock()
+	}()
+
+	err = p.send(stream, &relay.ClientFrame{Publish: &relay.Publish{
+		ID:    id,
+		Topic: topic,
+		Message: &relay.Message{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		},
+	}})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("publish was not acknowledged: %w", ctx.Err())
+	case <-p.closed:
+		return errClosed
+	}
+}
+
+// Subscribe subscribes to the topic on the relay. It waits until the relay is reachable or the timeout expires.
+// The subscription is restored whenever the stream is re-opened; messages published while the stream
+// is down are not delivered.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+	if _, err := p.awaitStream(timeoutCtx); err != nil {
+		return nil, err
+	}
+	if p.testHookSubscribe != nil {
+		p.testHookSubscribe()
+	}
+
+	// The topic is added together with reading the stream, so that a stream opened afterwards subscribes to it
+	// in serve, and a stream opened before is sent the subscription here.
+	sub := &subscription{queue: make(chan *relay.Message, subscriptionQueueSize)}
+	p.mu.Lock()
+	subs, ok := p.subscriptions[topic]
+	if !ok {
+		subs = make(map[*subscription]struct{})
+		p.subscriptions[topic] = subs
+	}
+	subs[sub] = struct{}{}
+	stream := p.stream
+	p.mu.Unlock()
+
+	if !ok && stream != nil {
+		// If the stream fails meanwhile, the subscription is sent again when it is re-opened.
+		if err := p.send(stream, &relay.ClientFrame{Subscribe: &relay.Subscribe{Topic: topic}}); err != nil {
+			p.logger.Error("failed to subscribe, waiting for the stream to be re-opened", err,
+				watermill.LogFields{"topic": topic})
+		}
+	}
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer p.unsubscribe(topic, sub)
+
+		for {
+			select {
+			case m := <-sub.queue:
+				msg := message.NewMessage(m.UUID, m.Payload)
+				for k, v := range m.Metadata {
+					msg.Metadata.Set(k, v)
+				}
+				select {
+				case output <- msg:
+				case <-ctx.Done():
+					return
+				case <-p.closed:
+					return
+				}
+				select {
+				case <-msg.Acked():
+				case <-msg.Nacked():
+				case <-ctx.Done():
+					return
+				case <-p.closed:
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// unsubscribe removes sub and tells the relay to stop sending the topic when it was the last subscription.
+func (p *pubSub) unsubscribe(topic string, sub *subscription) {
+	p.mu.Lock()
+	subs := p.subscriptions[topic]
+	delete(subs, sub)
+	last := len(subs) == 0
+	if last {
+		delete(p.subscriptions, topic)
+	}
+	stream := p.stream
+	p.mu.Unlock()
+
+	if last && stream != nil {
+		_ = p.send(stream, &relay.ClientFrame{Unsubscribe: &relay.Unsubscribe{Topic: topic}})
+	}
+}
+
+func (p *pubSub) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.cancel()
+		p.wg.Wait()
+		err = p.conn.Close()
+	})
+	return err
+}
+
+type grpcConfig struct {
+	Address          string
+	TLS              *tls.Config
+	Timeout          time.Duration
+	ReconnectWait    time.Duration
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+}
+
+func parseGRPCURL(u *url.URL) (*grpcConfig, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("grpc relay address is not specified in URL host")
+	}
+
+	query := u.Query()
+	config := &grpcConfig{
+		Address:          u.Host,
+		Timeout:          10 * time.Second,
+		ReconnectWait:    time.Second,
+		KeepaliveTimeout: 20 * time.Second,
+	}
+
+	var err error
+	config.TLS, err = tlsconfig.FromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if t := query.Get("timeout"); t != "" {
+		config.Timeout, err = time.ParseDuration(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timeout' param: %w", err)
+		}
+	}
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		config.ReconnectWait, err = time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+	}
+	if kt := query.Get("keepalive_time"); kt != "" {
+		config.KeepaliveTime, err = time.ParseDuration(kt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'keepalive_time' param: %w", err)
+		}
+	}
+	if kt := query.Get("keepalive_timeout"); kt != "" {
+		config.KeepaliveTimeout, err = time.ParseDuration(kt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'keepalive_timeout' param: %w", err)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,106 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/origadmin/casbin-watcher/v3/drivers/grpc/relay"
+)
+
+func TestSubscribeWhileReconnecting(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	srv := &droppingRelay{Server: relay.NewServer()}
+	server := grpc.NewServer()
+	relay.Register(server, srv)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	defer server.Stop()
+
+	ctx := WithDialOptions(context.Background(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	u, err := url.Parse("grpc://bufnet/casbin?reconnect_wait=10ms&timeout=5s")
+	require.NoError(t, err)
+	ps, err := (&Driver{}).NewPubSub(ctx, u, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer ps.Close()
+	p := ps.(*pubSub)
+
+	// The stream is replaced after Subscribe has found it open, but before the subscription is added.
+	p.testHookSubscribe = func() {
+		p.mu.Lock()
+		old := p.stream
+		p.mu.Unlock()
+		// The relay may not have started to serve the stream yet.
+		require.Eventually(t, srv.drop, 5*time.Second, time.Millisecond)
+		require.Eventually(t, func() bool {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return p.stream != nil && p.stream != old
+		}, 5*time.Second, time.Millisecond)
+	}
+	messages, err := ps.Subscribe(context.Background(), "casbin")
+	require.NoError(t, err)
+
+	// The subscription is sent on the new stream, so the relay forwards the message.
+	require.NoError(t, ps.Publish("casbin", message.NewMessage("update", []byte("1"))))
+	select {
+	case msg := <-messages:
+		require.Equal(t, "update", msg.UUID)
+		msg.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("The subscription was lost when the stream was re-opened")
+	}
+}
+
+// droppingRelay is a relay whose open streams can be ended, as happens when the connection to the relay is lost.
+type droppingRelay struct {
+	*relay.Server
+
+	mu      sync.Mutex
+	cancels []context.CancelFunc
+}
+
+func (r *droppingRelay) Stream(stream grpc.ServerStream) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	r.mu.Lock()
+	r.cancels = append(r.cancels, cancel)
+	r.mu.Unlock()
+	return r.Server.Stream(contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// drop ends all open streams and reports whether there were any.
+func (r *droppingRelay) drop() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+	dropped := len(r.cancels) > 0
+	r.cancels = nil
+	return dropped
+}
+
+// contextStream replaces the context of a grpc.ServerStream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,308 @@
+// Package relay implements the PolicyUpdates gRPC service that relays policy updates
+// between watchers using the grpc driver.
+//
+// The service has a single bidirectional streaming method. A watcher opens one stream,
+// subscribes to topics and publishes messages on it; the relay acknowledges every publish
+// and forwards the message to all streams subscribed to its topic, including the sender's.
+// Frames are encoded as JSON with the codec registered by this package, so no generated
+// protobuf code is needed on either side.
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+// CodecName is the name of the codec used by the PolicyUpdates service.
+// Clients must call the service with grpc.CallContentSubtype(CodecName).
+const CodecName = "casbin-watcher-json"
+
+// ServiceName is the fully qualified name of the PolicyUpdates service.
+const ServiceName = "casbinwatcher.relay.v1.PolicyUpdates"
+
+// StreamMethod is the full method name of the bidirectional stream.
+const StreamMethod = "/" + ServiceName + "/Stream"
+
+// sessionQueueSize is the number of frames queued for a slow stream before it is disconnected.
+const sessionQueueSize = 256
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+// codec encodes the frames of the PolicyUpdates service as JSON.
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (codec) Name() string {
+	return CodecName
+}
+
+// Message is a Watermill message carried by the relay.
+type Message struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+// ClientFrame is sent by a watcher. Exactly one of its fields is set.
+type ClientFrame struct {
+	Subscribe   *Subscribe   `json:"subscribe,omitempty"`
+	Unsubscribe *Unsubscribe `json:"unsubscribe,omitempty"`
+	Publish     *Publish     `json:"publish,omitempty"`
+}
+
+// Subscribe asks the relay to forward the messages of Topic to the stream.
+type Subscribe struct {
+	Topic string `json:"topic"`
+}
+
+// Unsubscribe asks the relay to stop forwarding the messages of Topic to the stream.
+type Unsubscribe struct {
+	Topic string `json:"topic"`
+}
+
+// Publish asks the relay to forward Message to all subscribers of Topic.
+// The relay answers with a PublishAck carrying the same ID.
+type Publish struct {
+	ID      uint64   `json:"id"`
+	Topic   string   `json:"topic"`
+	Message *Message `json:"message"`
+}
+
+// ServerFrame is sent by the relay. Exactly one of its fields is set.
+type ServerFrame struct {
+	Delivery   *Delivery   `json:"delivery,omitempty"`
+	PublishAck *PublishAck `json:"publish_ack,omitempty"`
+}
+
+// Delivery carries a message published to a topic the stream is subscribed to.
+type Delivery struct {
+	Topic   string   `json:"topic"`
+	Message *Message `json:"message"`
+}
+
+// PublishAck confirms the Publish with the same ID. Error is set if the message was rejected.
+type PublishAck struct {
+	ID    uint64 `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+// PolicyUpdatesServer is the server API of the PolicyUpdates service.
+type PolicyUpdatesServer interface {
+	// Stream handles the frames of a single watcher.
+	Stream(stream grpc.ServerStream) error
+}
+
+// ServiceDesc is the grpc.ServiceDesc of the PolicyUpdates service.
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*PolicyUpdatesServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "Stream",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(PolicyUpdatesServer).Stream(stream)
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+// Register registers the PolicyUpdates service implemented by srv on registrar.
+func Register(registrar grpc.ServiceRegistrar, srv PolicyUpdatesServer) {
+	registrar.RegisterService(&ServiceDesc, srv)
+}
+
+// session is the state of a single stream.
+type session struct {
+	send     chan *ServerFrame
+	dropped  chan struct{}
+	dropOnce sync.Once
+	// topics holds the topics the stream is subscribed to, and removed is set when the stream
+	// has ended. Both are guarded by Server.mu.
+	topics  map[string]struct{}
+	removed bool
+}
+
+// enqueue queues f for sending. A session that cannot keep up is dropped.
+func (s *session) enqueue(f *ServerFrame) {
+	select {
+	case s.send <- f:
+	default:
+		s.dropOnce.Do(func() {
+			close(s.dropped)
+		})
+	}
+}
+
+// Server is an in-memory implementation of the PolicyUpdates service.
+// It keeps no history: messages are only forwarded to streams that are subscribed when they are published.
+type Server struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*session]struct{}
+	closed      chan struct{}
+	once        sync.Once
+}
+
+// NewServer creates a new relay Server.
+func NewServer() *Server {
+	return &Server{
+		subscribers: make(map[string]map[*session]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// Close ends all streams with codes.Unavailable, so that watchers reconnect.
+// It should be called before grpc.Server.GracefulStop, which otherwise waits for the streams to end.
+func (s *Server) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// Stream implements PolicyUpdatesServer.
+func (s *Server) Stream(stream grpc.ServerStream) error {
+	sess := &session{
+		send:    make(chan *ServerFrame, sessionQueueSize),
+		dropped: make(chan struct{}),
+		topics:  make(map[string]struct{}),
+	}
+	defer s.removeSession(sess)
+
+	received := make(chan error, 1)
+	go func() {
+		received <- s.receive(stream, sess)
+	}()
+
+	// Frames are sent from this goroutine only, as grpc.ServerStream.SendMsg is not safe for concurrent use.
+	for {
+		select {
+		case f := <-sess.send:
+			if err := stream.SendMsg(f); err != nil {
+				return err
+			}
+		case err := <-received:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-sess.dropped:
+			return status.Error(codes.ResourceExhausted, "stream fell behind")
+		case <-s.closed:
+			return status.Error(codes.Unavailable, "relay is shutting down")
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+	}
+}
+
+// receive handles the frames of the stream until it ends.
+func (s *Server) receive(stream grpc.ServerStream, sess *session) error {
+	for {
+		var f ClientFrame
+		if err := stream.RecvMsg(&f); err != nil {
+			return err
+		}
+		switch {
+		case f.Subscribe != nil:
+			s.subscribe(sess, f.Subscribe.Topic)
+		case f.Unsubscribe != nil:
+			s.unsubscribe(sess, f.Unsubscribe.Topic)
+		case f.Publish != nil:
+			ack := &PublishAck{ID: f.Publish.ID}
+			if err := s.publish(f.Publish); err != nil {
+				ack.Error = err.Error()
+			}
+			sess.enqueue(&ServerFrame{PublishAck: ack})
+		default:
+			return status.Error(codes.InvalidArgument, "empty frame")
+		}
+	}
+}
+
+func (s *Server) publish(p *Publish) error {
+	if p.Topic == "" {
+		return errors.New("topic is not specified")
+	}
+	if p.Message == nil {
+		return errors.New("message is not specified")
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f := &ServerFrame{Delivery: &Delivery{Topic: p.Topic, Message: p.Message}}
+	for sess := range s.subscribers[p.Topic] {
+		sess.enqueue(f)
+	}
+	return nil
+}
+
+func (s *Server) subscribe(sess *session, topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess.removed {
+		return
+	}
+	subscribers, ok := s.subscribers[topic]
+	if !ok {
+		subscribers = make(map[*session]struct{})
+		s.subscribers[topic] = subscribers
+	}
+	subscribers[sess] = struct{}{}
+	sess.topics[topic] = struct{}{}
+}
+
+func (s *Server) unsubscribe(sess *session, topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(sess, topic)
+}
+
+// remove removes sess from the subscribers of topic. s.mu must be held.
+func (s *Server) remove(sess *session, topic string) {
+	delete(sess.topics, topic)
+	subscribers := s.subscribers[topic]
+	delete(subscribers, sess)
+	if len(subscribers) == 0 {
+		delete(s.subscribers, topic)
+	}
+}
+
+func (s *Server) removeSession(sess *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for topic := range sess.topics {
+		s.remove(sess, topic)
+	}
+	sess.removed = true
+}
+
+// NewStream opens the bidirectional stream of the PolicyUpdates service on conn.
+func NewStream(ctx context.Context, conn grpc.ClientConnInterface, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(CodecName)}, opts...)
+	return conn.NewStream(ctx, &ServiceDesc.Streams[0], StreamMethod, opts...)
+}
+
+var _ PolicyUpdatesServer = (*Server)(nil)
@@ -3,11 +3,16 @@ package http
 import (
 	"context"
 	"fmt"
+	stdHttp "net/http"
 	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill-http/v2/pkg/http"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/go-chi/chi"
+	"go.uber.org/multierr"
 
 	"github.com/origadmin/casbin-watcher/v3"
 )
@@ -16,51 +21,197 @@ func init() {
 	watcher.RegisterDriver("http", &Driver{})
 }
 
+type serveMuxKey struct{}
+
+// WithServeMux returns a context carrying a user-supplied http.ServeMux.
+// When passed to watcher.NewWatcher, the driver registers its webhook receiver on mux
+// instead of starting its own HTTP server.
+func WithServeMux(ctx context.Context, mux *stdHttp.ServeMux) context.Context {
+	return context.WithValue(ctx, serveMuxKey{}, mux)
+}
+
 // Driver implements the watcher.Driver interface for HTTP.
 type Driver struct{}
 
 // NewPubSub creates a new PubSub for HTTP.
-// Note: The HTTP driver in this context only supports publishing.
-// The subscriber part would require running a server, which is outside the scope of this driver.
-func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
-	baseURL := u.Query().Get("base_url")
-	if baseURL == "" {
-		return nil, fmt.Errorf("http driver requires a 'base_url' query parameter")
+// Messages are published as HTTP POST requests to the base_url and to every node in peers.
+// Messages are received by a webhook receiver that either listens on listen_addr or is
+// registered on a http.ServeMux supplied through WithServeMux.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseHTTPURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse http url: %w", err)
+	}
+	mux, _ := ctx.Value(serveMuxKey{}).(*stdHttp.ServeMux)
+	if config.BaseURL == "" && len(config.Peers) == 0 && config.ListenAddr == "" && mux == nil {
+		return nil, fmt.Errorf("http driver requires a 'base_url', 'peers' or 'listen_addr' query parameter")
+	}
+	if mux != nil {
+		// The receiver must not take over the routes of the application that owns mux.
+		if config.PathPrefix == "" {
+			return nil, fmt.Errorf("a http.ServeMux supplied with WithServeMux requires a 'path_prefix' query parameter")
+		}
+		if config.ListenAddr != "" {
+			return nil, fmt.Errorf("'listen_addr' query parameter cannot be used with a http.ServeMux " +
+				"supplied with WithServeMux")
+		}
 	}
 
 	publisher, err := http.NewPublisher(
-		http.PublisherConfig{}, // An empty config is sufficient to use the default HTTP client.
+		http.PublisherConfig{
+			MarshalMessageFunc: http.DefaultMarshalMessageFunc,
+		},
 		logger,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http publisher: %w", err)
 	}
 
-	return &pubSub{
-		publisher: publisher,
-		baseURL:   baseURL,
-	}, nil
+	ps := &pubSub{
+		publisher:  publisher,
+		config:     config,
+		listenAddr: config.ListenAddr,
+		logger:     logger,
+	}
+
+	if config.ListenAddr != "" || mux != nil {
+		router := chi.NewRouter()
+		subscriber, err := http.NewSubscriber(
+			config.ListenAddr,
+			http.SubscriberConfig{
+				Router:               router,
+				UnmarshalMessageFunc: http.DefaultUnmarshalMessageFunc,
+			},
+			logger,
+		)
+		if err != nil {
+			_ = publisher.Close()
+			return nil, fmt.Errorf("failed to create http subscriber: %w", err)
+		}
+		if mux != nil {
+			// The receiver is served by the user's server, so the driver must not start its own.
+			if err := handle(mux, config.PathPrefix+"/", router); err != nil {
+				_ = publisher.Close()
+				_ = subscriber.Close()
+				return nil, err
+			}
+		}
+		ps.subscriber = subscriber
+	}
+
+	return ps, nil
+}
+
+// handle registers handler on mux for pattern. It returns an error instead of panicking if the pattern is already
+// registered, for example by another watcher with the same path_prefix.
+func handle(mux *stdHttp.ServeMux, pattern string, handler stdHttp.Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to register http receiver on %q: %v", pattern, r)
+		}
+	}()
+	mux.Handle(pattern, handler)
+	return nil
 }
 
 type pubSub struct {
-	publisher *http.Publisher
-	baseURL   string
+	publisher  *http.Publisher
+	subscriber *http.Subscriber
+	config     *httpConfig
+	listenAddr string
+	logger     watermill.LoggerAdapter
+	startOnce  sync.Once
 }
 
-// Publish sends the message to a URL derived from the base_url and topic.
-// For example, with base_url="http://localhost:8080" and topic="casbin", it will POST to "http://localhost:8080/casbin".
+// Publish sends the messages to every configured target.
+// With base_url="http://localhost:8080" and topic="casbin", it POSTs to "http://localhost:8080/casbin".
+// With a peer "http://node2:8080", path_prefix="/casbin" and topic="policy", it POSTs to "http://node2:8080/casbin/policy".
 func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
-	// The watermill-http publisher's "topic" is the full URL.
-	publishURL := fmt.Sprintf("%s/%s", p.baseURL, topic)
-	return p.publisher.Publish(publishURL, messages...)
+	var allErrors error
+	for _, target := range p.targets(topic) {
+		// The watermill-http publisher's "topic" is the full URL.
+		if err := p.publisher.Publish(target, messages...); err != nil {
+			allErrors = multierr.Append(allErrors, fmt.Errorf("failed to publish to %s: %w", target, err))
+		}
+	}
+	return allErrors
+}
+
+// targets returns the URLs to which messages for topic are posted.
+func (p *pubSub) targets(topic string) []string {
+	targets := make([]string, 0, len(p.config.Peers)+1)
+	if p.config.BaseURL != "" {
+		targets = append(targets, fmt.Sprintf("%s/%s", p.config.BaseURL, topic))
+	}
+	for _, peer := range p.config.Peers {
+		targets = append(targets, fmt.Sprintf("%s%s/%s", peer, p.config.PathPrefix, topic))
+	}
+	return targets
 }
 
-// Subscribe is not implemented for this HTTP driver.
-func (p *pubSub) Subscribe(_ context.Context, _ string) (<-chan *message.Message, error) {
-	return nil, fmt.Errorf("subscribing is not supported in this simple HTTP driver; " +
-		"you need to set up an HTTP server with watermill's http.Router to receive messages")
+// Subscribe registers a webhook handler for the topic and starts the HTTP server if the driver owns it.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	if p.subscriber == nil {
+		return nil, fmt.Errorf("subscribing requires a 'listen_addr' query parameter or a http.ServeMux " +
+			"supplied with WithServeMux")
+	}
+	messages, err := p.subscriber.Subscribe(ctx, p.config.PathPrefix+"/"+topic)
+	if err != nil {
+		return nil, err
+	}
+	if p.listenAddr != "" {
+		// StartHTTPServer must be called after all Subscribe calls have completed.
+		p.startOnce.Do(func() {
+			go func() {
+				if err := p.subscriber.StartHTTPServer(); err != nil && err != stdHttp.ErrServerClosed {
+					p.logger.Error("http subscriber server failed", err, watermill.LogFields{"listen_addr": p.listenAddr})
+				}
+			}()
+		})
+	}
+	return messages, nil
 }
 
 func (p *pubSub) Close() error {
-	return p.publisher.Close()
+	var allErrors error
+	allErrors = multierr.Append(allErrors, p.publisher.Close())
+	if p.subscriber != nil {
+		allErrors = multierr.Append(allErrors, p.subscriber.Close())
+	}
+	return allErrors
+}
+
+type httpConfig struct {
+	BaseURL    string
+	Peers      []string
+	ListenAddr string
+	PathPrefix string
+}
+
+func parseHTTPURL(u *url.URL) (*httpConfig, error) {
+	query := u.Query()
+	config := &httpConfig{
+		BaseURL:    strings.TrimSuffix(query.Get("base_url"), "/"),
+		ListenAddr: query.Get("listen_addr"),
+		PathPrefix: strings.TrimSuffix(query.Get("path_prefix"), "/"),
+	}
+
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		config.PathPrefix = "/" + config.PathPrefix
+	}
+
+	if peers := query.Get("peers"); peers != "" {
+		for _, peer := range strings.Split(peers, ",") {
+			peer = strings.TrimSuffix(strings.TrimSpace(peer), "/")
+			if peer == "" {
+				continue
+			}
+			if _, err := url.ParseRequestURI(peer); err != nil {
+				return nil, fmt.Errorf("invalid peer url %q: %w", peer, err)
+			}
+			config.Peers = append(config.Peers, peer)
+		}
+	}
+
+	return config, nil
 }
@@ -1,16 +1,20 @@
 package io
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
-	watermillio "github.com/ThreeDotsLabs/watermill-io/pkg/io"
 	"github.com/ThreeDotsLabs/watermill/message"
-	"go.uber.org/multierr"
 
 	"github.com/origadmin/casbin-watcher/v3"
 )
@@ -19,68 +23,434 @@ func init() {
 	watcher.RegisterDriver("io", &Driver{})
 }
 
+// stdio is the path that selects stdin for reading and stdout for writing.
+const stdio = "-"
+
+var errClosed = errors.New("io pubsub is closed")
+
 // Driver implements the watcher.Driver interface for IO.
 type Driver struct{}
 
-// NewPubSub creates a new PubSub for IO.
+// NewPubSub creates a new PubSub for IO. Messages are written to the 'out' file and read from the 'in' file,
+// which default to stdout and stdin.
 func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
-	var reader io.ReadCloser = os.Stdin
-	var writer io.WriteCloser = os.Stdout
-	var closer io.Closer
+	config, err := parseIOURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse io url: %w", err)
+	}
 
-	path := u.Query().Get("path")
-	if path != "" {
-		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	p := &pubSub{
+		config: config,
+		logger: logger,
+		closed: make(chan struct{}),
+	}
+	if config.Out != stdio {
+		// The file is opened early, so that a path that cannot be written fails here rather than on publish.
+		p.mu.Lock()
+		err = p.openOut()
+		p.mu.Unlock()
 		if err != nil {
 			return nil, fmt.Errorf("failed to open file for io driver: %w", err)
 		}
-		reader = file
-		writer = file
-		closer = file
 	}
+	return p, nil
+}
 
-	publisher, err := watermillio.NewPublisher(writer, watermillio.PublisherConfig{}, logger)
-	if err != nil {
-		return nil, err
+// envelope is a line of the JSON-lines format.
+type envelope struct {
+	Topic    string            `json:"topic"`
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type pubSub struct {
+	config *ioConfig
+	logger watermill.LoggerAdapter
+
+	// mu guards out and outInfo, which are nil when writing to stdout.
+	mu      sync.Mutex
+	out     *os.File
+	outInfo os.FileInfo
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish appends the messages to the output as JSON lines. If the output file has been rotated or removed,
+// it is opened again under its path first.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.closed:
+		return errClosed
+	default:
 	}
 
-	subscriber, err := watermillio.NewSubscriber(reader, watermillio.SubscriberConfig{
-		UnmarshalFunc: watermillio.PayloadUnmarshalFunc,
-	}, logger)
+	var w io.Writer = os.Stdout
+	if p.config.Out != stdio {
+		if fi, err := os.Stat(p.config.Out); err != nil || !os.SameFile(fi, p.outInfo) {
+			_ = p.out.Close()
+			if err := p.openOut(); err != nil {
+				return fmt.Errorf("failed to reopen file for io driver: %w", err)
+			}
+		}
+		w = p.out
+	}
+
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			Topic:    topic,
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		// Each line is written with a single write, so that lines appended by several processes do not interleave.
+		if _, err := w.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// openOut opens the output file for appending. p.mu must be held.
+func (p *pubSub) openOut() error {
+	f, err := os.OpenFile(p.config.Out, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
 	if err != nil {
-		_ = publisher.Close()
-		return nil, err
+		return err
 	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	p.out, p.outInfo = f, fi
+	return nil
+}
+
+// Subscribe delivers the messages of the topic read from the input. A file is followed as it grows, and opened
+// again under its path when it is rotated; reading starts at its end unless start=beginning. Stdin is read until
+// it ends.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	select {
+	case <-p.closed:
+		return nil, errClosed
+	default:
+	}
+
+	if p.config.In == stdio {
+		return p.subscribeStdin(ctx, topic), nil
+	}
+
+	t := &tail{path: p.config.In}
+	if err := t.open(!p.config.FromBeginning); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to open file for io driver: %w", err)
+	}
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer t.close()
 
-	return &pubSub{
-		publisher:  publisher,
-		subscriber: subscriber,
-		closer:     closer,
-	}, nil
+		logFields := watermill.LogFields{"topic": topic, "path": p.config.In}
+		for {
+			line, err := t.next()
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrNotExist) {
+					p.logger.Error("Failed to read file", err, logFields)
+				}
+				if !p.wait(ctx, p.config.PollInterval) {
+					return
+				}
+				continue
+			}
+			if !p.deliverLine(ctx, topic, line, output, logFields) {
+				return
+			}
+		}
+	}()
+
+	return output, nil
 }
 
-type pubSub struct {
-	publisher  *watermillio.Publisher
-	subscriber *watermillio.Subscriber
-	closer     io.Closer
+// subscribeStdin delivers the messages of the topic read from stdin, until stdin ends.
+func (p *pubSub) subscribeStdin(ctx context.Context, topic string) <-chan *message.Message {
+	// Reading stdin cannot be interrupted, so the reader is not waited for when the Pub/Sub is closed.
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		r := bufio.NewReader(os.Stdin)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 {
+				select {
+				case lines <- line:
+				case <-ctx.Done():
+					return
+				case <-p.closed:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+
+		logFields := watermill.LogFields{"topic": topic, "path": stdio}
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					return
+				}
+				if !p.deliverLine(ctx, topic, line, output, logFields) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+	return output
 }
 
-func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
-	// The IO publisher doesn't use topics, it just writes to the writer.
-	return p.publisher.Publish(topic, messages...)
+// deliverLine unmarshals line and delivers it if it belongs to the topic. A nacked message is delivered again after
+// retry_wait. Blank lines and lines that cannot be unmarshalled are skipped. It returns false if the subscription
+// has ended.
+func (p *pubSub) deliverLine(ctx context.Context, topic string, line []byte, output chan<- *message.Message, logFields watermill.LogFields) bool {
+	if len(bytes.TrimSpace(line)) == 0 {
+		return true
+	}
+	var env envelope
+	if err := json.Unmarshal(line, &env); err != nil {
+		p.logger.Error("Failed to unmarshal line", err, logFields)
+		return true
+	}
+	if env.Topic != topic {
+		return true
+	}
+
+	for {
+		msg := message.NewMessage(env.UUID, env.Payload)
+		for k, v := range env.Metadata {
+			msg.Metadata.Set(k, v)
+		}
+
+		select {
+		case output <- msg:
+		case <-ctx.Done():
+			return false
+		case <-p.closed:
+			return false
+		}
+		select {
+		case <-msg.Acked():
+			return true
+		case <-msg.Nacked():
+		case <-ctx.Done():
+			return false
+		case <-p.closed:
+			return false
+		}
+		if !p.wait(ctx, p.config.RetryWait) {
+			return false
+		}
+	}
 }
 
-func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
-	// The IO subscriber doesn't use topics, it just reads from the reader.
-	return p.subscriber.Subscribe(ctx, topic)
+// wait waits for d. It returns false if the subscription has ended in the meantime.
+func (p *pubSub) wait(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
 }
 
 func (p *pubSub) Close() error {
-	var allErrors error
-	allErrors = multierr.Append(allErrors, p.publisher.Close())
-	allErrors = multierr.Append(allErrors, p.subscriber.Close())
-	if p.closer != nil {
-		allErrors = multierr.Append(allErrors, p.closer.Close())
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.out != nil {
+			err = p.out.Close()
+		}
+	})
+	return err
+}
+
+// tail reads the lines of a file that is appended to, following it when it is rotated or truncated.
+type tail struct {
+	path   string
+	file   *os.File
+	info   os.FileInfo
+	reader *bufio.Reader
+	offset int64
+	// partial holds the beginning of a line whose end has not been written yet.
+	partial []byte
+	// rotated is set when a new file has been found at path. The current file is read to its end before switching.
+	rotated bool
+}
+
+// open opens the file at path, at its end if atEnd is set.
+func (t *tail) open(atEnd bool) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	var offset int64
+	if atEnd {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	t.file, t.info, t.offset = f, fi, offset
+	t.reader = bufio.NewReader(f)
+	t.partial, t.rotated = nil, false
+	return nil
+}
+
+// next returns the next complete line. It returns io.EOF when no complete line is available yet.
+func (t *tail) next() ([]byte, error) {
+	if t.file == nil {
+		// The file did not exist yet, so it is read from the beginning once it does.
+		if err := t.open(false); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := t.reader.ReadBytes('\n')
+	t.offset += int64(len(data))
+	t.partial = append(t.partial, data...)
+	if err == nil {
+		line := t.partial
+		t.partial = nil
+		return line, nil
+	}
+	if !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if t.rotated {
+		// The old file has been read to its end; a line it leaves unfinished is dropped.
+		t.close()
+		if err := t.open(false); err != nil {
+			return nil, err
+		}
+		return t.next()
+	}
+
+	fi, statErr := os.Stat(t.path)
+	switch {
+	case statErr != nil:
+		// The file has been moved away and not been replaced yet.
+	case !os.SameFile(fi, t.info):
+		// Read what has been appended to the old file meanwhile before switching to the new one.
+		t.rotated = true
+		return t.next()
+	case fi.Size() < t.offset:
+		// The file has been truncated in place, so it is read again from the beginning.
+		if _, err := t.file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		t.reader.Reset(t.file)
+		t.offset, t.partial = 0, nil
+	}
+	return nil, io.EOF
+}
+
+func (t *tail) close() {
+	if t.file != nil {
+		_ = t.file.Close()
+		t.file = nil
+	}
+}
+
+type ioConfig struct {
+	In            string
+	Out           string
+	FromBeginning bool
+	PollInterval  time.Duration
+	RetryWait     time.Duration
+}
+
+func parseIOURL(u *url.URL) (*ioConfig, error) {
+	query := u.Query()
+	config := &ioConfig{
+		In:           stdio,
+		Out:          stdio,
+		PollInterval: time.Second,
+		RetryWait:    time.Second,
+	}
+
+	// 'path' is shared by both directions, which lets processes exchange messages through one log file.
+	if path := query.Get("path"); path != "" {
+		config.In, config.Out = path, path
+	}
+	if in := query.Get("in"); in != "" {
+		config.In = in
+	}
+	if out := query.Get("out"); out != "" {
+		config.Out = out
 	}
-	return allErrors
+
+	if start := query.Get("start"); start != "" {
+		switch start {
+		case "end":
+		case "beginning":
+			config.FromBeginning = true
+		default:
+			return nil, fmt.Errorf("invalid 'start' param: %s", start)
+		}
+	}
+
+	if pi := query.Get("poll_interval"); pi != "" {
+		val, err := time.ParseDuration(pi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'poll_interval' param: %w", err)
+		}
+		if val <= 0 {
+			return nil, fmt.Errorf("invalid 'poll_interval' param: must be positive")
+		}
+		config.PollInterval = val
+	}
+
+	if rw := query.Get("retry_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'retry_wait' param: %w", err)
+		}
+		config.RetryWait = val
+	}
+
+	return config, nil
 }
@@ -0,0 +1,444 @@
+package mongodb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("mongodb", &Driver{})
+	watcher.RegisterDriver("mongodb+srv", &Driver{})
+}
+
+// Server error codes that mean a change stream cannot be resumed from its resume token.
+const (
+	codeInvalidResumeToken      = 260
+	codeChangeStreamFatalError  = 280
+	codeChangeStreamHistoryLost = 286
+	codeNamespaceExists         = 48
+)
+
+// Driver implements the watcher.Driver interface for MongoDB change streams.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub for MongoDB. It connects to the server and creates the capped message collection
+// if it does not exist. Change streams require a replica set or a sharded cluster.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseMongoURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mongodb url: %w", err)
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(config.uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+
+	ps := &pubSub{
+		client: client,
+		config: config,
+		logger: logger,
+		closed: make(chan struct{}),
+	}
+	db := client.Database(config.database)
+	ps.messages = db.Collection(config.collection)
+	ps.tokens = db.Collection(config.tokenCollection)
+
+	initCtx, cancel := context.WithTimeout(ctx, config.timeout)
+	defer cancel()
+	if err := ps.createCollection(initCtx); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, err
+	}
+	return ps, nil
+}
+
+// document is a message as it is stored in the message collection.
+type document struct {
+	Topic     string            `bson:"topic"`
+	UUID      string            `bson:"uuid"`
+	Metadata  map[string]string `bson:"metadata,omitempty"`
+	Payload   []byte            `bson:"payload"`
+	CreatedAt time.Time         `bson:"created_at"`
+}
+
+// changeEvent is the part of a change stream event used by the driver.
+type changeEvent struct {
+	FullDocument document `bson:"fullDocument"`
+}
+
+// resumeToken is the last handled position of a watcher in the change stream of a topic.
+type resumeToken struct {
+	ID        string    `bson:"_id"`
+	Token     bson.Raw  `bson:"token"`
+	UpdatedAt time.Time `bson:"updated_at"`
+}
+
+type pubSub struct {
+	client   *mongo.Client
+	messages *mongo.Collection
+	tokens   *mongo.Collection
+	config   *mongoConfig
+	logger   watermill.LoggerAdapter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// createCollection creates the message collection as a capped collection, so that old messages are removed
+// automatically. An existing collection is left unchanged.
+func (p *pubSub) createCollection(ctx context.Context) error {
+	opts := options.CreateCollection().SetCapped(true).SetSizeInBytes(p.config.cappedSize)
+	if p.config.cappedMax > 0 {
+		opts.SetMaxDocuments(p.config.cappedMax)
+	}
+	err := p.messages.Database().CreateCollection(ctx, p.config.collection, opts)
+	var se mongo.ServerError
+	if err != nil && !(errors.As(err, &se) && se.HasErrorCode(codeNamespaceExists)) {
+		return fmt.Errorf("failed to create collection %q: %w", p.config.collection, err)
+	}
+	return nil
+}
+
+// Publish inserts the messages into the message collection.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.timeout)
+		_, err := p.messages.InsertOne(ctx, document{
+			Topic:     topic,
+			UUID:      msg.UUID,
+			Metadata:  msg.Metadata,
+			Payload:   msg.Payload,
+			CreatedAt: time.Now(),
+		})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe watches the message collection for messages of the topic. With a watcher ID, the stream resumes from
+// the last handled message, even after a restart. If that position is no longer available, a reload message is
+// delivered first.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	var token bson.Raw
+	if p.config.watcherID != "" {
+		var err error
+		if token, err = p.loadToken(ctx, topic); err != nil {
+			return nil, fmt.Errorf("failed to load resume token: %w", err)
+		}
+	}
+
+	stream, reload, err := p.watch(ctx, topic, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch topic %q: %w", topic, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	output := make(chan *message.Message)
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-p.closed:
+		}
+	}()
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		p.run(ctx, topic, stream, reload, token, output)
+	}()
+
+	return output, nil
+}
+
+// run delivers the events of the stream to output. When the stream fails or a message is nacked, the stream is
+// opened again after reconnect_wait, from the last acknowledged message.
+func (p *pubSub) run(ctx context.Context, topic string, stream *mongo.ChangeStream, reload bool, token bson.Raw, output chan<- *message.Message) {
+	for {
+		if stream != nil {
+			if reload {
+				if !p.deliver(ctx, watcher.NewReloadMessage(), output) {
+					_ = stream.Close(context.Background())
+					return
+				}
+				token = stream.ResumeToken()
+				p.saveToken(topic, token)
+			}
+			token = p.consume(ctx, topic, stream, token, output)
+			_ = stream.Close(context.Background())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.config.reconnectWait):
+		}
+
+		var err error
+		stream, reload, err = p.watch(ctx, topic, token)
+		if err != nil {
+			p.logger.Error("failed to watch mongodb change stream", err, watermill.LogFields{"topic": topic})
+		}
+	}
+}
+
+// consume delivers the events of the stream to output until it fails, the subscription ends or a message is nacked.
+// It returns the resume token of the last acknowledged message.
+func (p *pubSub) consume(ctx context.Context, topic string, stream *mongo.ChangeStream, token bson.Raw, output chan<- *message.Message) bson.Raw {
+	for stream.Next(ctx) {
+		var event changeEvent
+		if err := stream.Decode(&event); err != nil {
+			p.logger.Error("failed to decode mongodb change event", err, watermill.LogFields{"topic": topic})
+			continue
+		}
+		msg := message.NewMessage(event.FullDocument.UUID, event.FullDocument.Payload)
+		for k, v := range event.FullDocument.Metadata {
+			msg.Metadata.Set(k, v)
+		}
+
+		if !p.deliver(ctx, msg, output) {
+			return token
+		}
+		token = stream.ResumeToken()
+		p.saveToken(topic, token)
+	}
+	if err := stream.Err(); err != nil && ctx.Err() == nil {
+		p.logger.Error("mongodb change stream failed", err, watermill.LogFields{"topic": topic})
+	}
+	return token
+}
+
+// deliver sends msg to output and waits until it is acknowledged. It returns false if the message was nacked or the
+// subscription has ended.
+func (p *pubSub) deliver(ctx context.Context, msg *message.Message, output chan<- *message.Message) bool {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	}
+	select {
+	case <-msg.Acked():
+		return true
+	case <-msg.Nacked():
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// watch opens a change stream on the inserts of messages of the topic, resuming after token if it is set.
+// If the stream cannot be resumed from token, it is opened at the current position and reload is true.
+func (p *pubSub) watch(ctx context.Context, topic string, token bson.Raw) (stream *mongo.ChangeStream, reload bool, err error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{
+			{Key: "operationType", Value: "insert"},
+			{Key: "fullDocument.topic", Value: topic},
+		}}},
+	}
+	opts := options.ChangeStream()
+	if p.config.maxAwaitTime > 0 {
+		opts.SetMaxAwaitTime(p.config.maxAwaitTime)
+	}
+
+	watchCtx, cancel := context.WithTimeout(ctx, p.config.timeout)
+	defer cancel()
+	if token != nil {
+		stream, err = p.messages.Watch(watchCtx, pipeline, opts.SetResumeAfter(token))
+		if err == nil || !isHistoryLost(err) {
+			return stream, false, err
+		}
+		p.logger.Info("mongodb change stream cannot be resumed, requesting a full reload", watermill.LogFields{
+			"topic": topic,
+			"err":   err,
+		})
+		reload = true
+		opts = options.ChangeStream()
+		if p.config.maxAwaitTime > 0 {
+			opts.SetMaxAwaitTime(p.config.maxAwaitTime)
+		}
+	}
+	stream, err = p.messages.Watch(watchCtx, pipeline, opts)
+	return stream, reload, err
+}
+
+// isHistoryLost reports whether err means that a change stream cannot be resumed from its resume token.
+func isHistoryLost(err error) bool {
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.HasErrorCode(codeChangeStreamHistoryLost) ||
+		se.HasErrorCode(codeChangeStreamFatalError) ||
+		se.HasErrorCode(codeInvalidResumeToken)
+}
+
+// tokenID returns the ID of the resume token document of the topic.
+func (p *pubSub) tokenID(topic string) string {
+	return p.config.watcherID + "/" + topic
+}
+
+func (p *pubSub) loadToken(ctx context.Context, topic string) (bson.Raw, error) {
+	loadCtx, cancel := context.WithTimeout(ctx, p.config.timeout)
+	defer cancel()
+	var rt resumeToken
+	err := p.tokens.FindOne(loadCtx, bson.D{{Key: "_id", Value: p.tokenID(topic)}}).Decode(&rt)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rt.Token, nil
+}
+
+// saveToken stores the resume token if a watcher ID is configured.
+func (p *pubSub) saveToken(topic string, token bson.Raw) {
+	if p.config.watcherID == "" || token == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.timeout)
+	defer cancel()
+	_, err := p.tokens.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: p.tokenID(topic)}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "token", Value: token},
+			{Key: "updated_at", Value: time.Now()},
+		}}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	if err != nil {
+		p.logger.Error("failed to save mongodb resume token", err, watermill.LogFields{"topic": topic})
+	}
+}
+
+func (p *pubSub) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.timeout)
+		defer cancel()
+		err = p.client.Disconnect(ctx)
+	})
+	return err
+}
+
+type mongoConfig struct {
+	uri             string
+	database        string
+	collection      string
+	tokenCollection string
+	watcherID       string
+	cappedSize      int64
+	cappedMax       int64
+	maxAwaitTime    time.Duration
+	timeout         time.Duration
+	reconnectWait   time.Duration
+}
+
+// driverParams are the URL parameters of the driver. All other parameters are passed to the MongoDB client.
+var driverParams = []string{
+	"database", "collection", "token_collection", "watcher_id", "capped_size", "capped_max",
+	"max_await_time", "timeout", "reconnect_wait",
+}
+
+func parseMongoURL(u *url.URL) (*mongoConfig, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("mongodb host is not specified in URL host")
+	}
+
+	query := u.Query()
+	config := &mongoConfig{
+		database:        "casbin",
+		collection:      "casbin_watcher_messages",
+		tokenCollection: "casbin_watcher_resume_tokens",
+		watcherID:       query.Get("watcher_id"),
+		cappedSize:      10 << 20,
+		timeout:         10 * time.Second,
+		reconnectWait:   time.Second,
+	}
+
+	if db := query.Get("database"); db != "" {
+		config.database = db
+	}
+	if c := query.Get("collection"); c != "" {
+		config.collection = c
+	}
+	if tc := query.Get("token_collection"); tc != "" {
+		config.tokenCollection = tc
+	}
+
+	if cs := query.Get("capped_size"); cs != "" {
+		val, err := strconv.ParseInt(cs, 10, 64)
+		if err != nil || val <= 0 {
+			return nil, fmt.Errorf("invalid 'capped_size' param: %q", cs)
+		}
+		config.cappedSize = val
+	}
+
+	if cm := query.Get("capped_max"); cm != "" {
+		val, err := strconv.ParseInt(cm, 10, 64)
+		if err != nil || val < 0 {
+			return nil, fmt.Errorf("invalid 'capped_max' param: %q", cm)
+		}
+		config.cappedMax = val
+	}
+
+	if mat := query.Get("max_await_time"); mat != "" {
+		val, err := time.ParseDuration(mat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'max_await_time' param: %w", err)
+		}
+		config.maxAwaitTime = val
+	}
+
+	if t := query.Get("timeout"); t != "" {
+		val, err := time.ParseDuration(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timeout' param: %w", err)
+		}
+		config.timeout = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.reconnectWait = val
+	}
+
+	for _, name := range driverParams {
+		query.Del(name)
+	}
+	// The path holds the topic, so it is not passed to the client.
+	mongoURL := url.URL{
+		Scheme:   u.Scheme,
+		User:     u.User,
+		Host:     u.Host,
+		Path:     "/",
+		RawQuery: query.Encode(),
+	}
+	config.uri = mongoURL.String()
+
+	return config, nil
+}
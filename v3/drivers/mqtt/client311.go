@@ -0,0 +1,124 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// client311 is an MQTT 3.1.1 client built on github.com/eclipse/paho.mqtt.golang.
+type client311 struct {
+	cli    pahomqtt.Client
+	config *mqttConfig
+
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+func newClient311(config *mqttConfig, handler func(topic string, payload []byte), logger watermill.LoggerAdapter) (client, error) {
+	c := &client311{
+		config: config,
+		topics: make(map[string]struct{}),
+	}
+
+	scheme := "tcp"
+	if config.tls != nil {
+		scheme = "ssl"
+	}
+	opts := pahomqtt.NewClientOptions().
+		AddBroker(scheme + "://" + config.broker.Host).
+		SetProtocolVersion(4).
+		SetClientID(config.clientID).
+		SetUsername(config.username).
+		SetPassword(config.password).
+		SetCleanSession(config.cleanSession).
+		SetKeepAlive(config.keepAlive).
+		SetConnectTimeout(config.timeout).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(config.reconnectWait).
+		SetOrderMatters(true).
+		SetDefaultPublishHandler(func(_ pahomqtt.Client, m pahomqtt.Message) {
+			handler(m.Topic(), m.Payload())
+		}).
+		SetConnectionLostHandler(func(_ pahomqtt.Client, err error) {
+			logger.Info("Lost connection to mqtt broker", watermill.LogFields{"err": err})
+		}).
+		SetOnConnectHandler(func(cli pahomqtt.Client) {
+			// The broker may have lost the subscriptions, for example if the session is clean.
+			for _, topic := range c.subscribedTopics() {
+				token := cli.Subscribe(topic, config.qos, nil)
+				go func(topic string) {
+					if token.WaitTimeout(config.timeout) && token.Error() != nil {
+						logger.Error("Failed to subscribe to mqtt topic again", token.Error(), watermill.LogFields{"topic": topic})
+					}
+				}(topic)
+			}
+		})
+	if config.tls != nil {
+		opts.SetTLSConfig(config.tls)
+	}
+
+	c.cli = pahomqtt.NewClient(opts)
+	token := c.cli.Connect()
+	if !token.WaitTimeout(config.timeout) {
+		c.cli.Disconnect(0)
+		return nil, fmt.Errorf("timed out after %s", config.timeout)
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client311) subscribedTopics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (c *client311) publish(ctx context.Context, topic string, payload []byte, retain bool) error {
+	return wait(ctx, c.cli.Publish(topic, c.config.qos, retain, payload))
+}
+
+func (c *client311) subscribe(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	c.topics[topic] = struct{}{}
+	c.mu.Unlock()
+
+	if err := wait(ctx, c.cli.Subscribe(topic, c.config.qos, nil)); err != nil {
+		c.mu.Lock()
+		delete(c.topics, topic)
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *client311) unsubscribe(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	delete(c.topics, topic)
+	c.mu.Unlock()
+	return wait(ctx, c.cli.Unsubscribe(topic))
+}
+
+func (c *client311) close() error {
+	c.cli.Disconnect(uint(c.config.timeout.Milliseconds()))
+	return nil
+}
+
+// wait waits until the token completes or ctx is done.
+func wait(ctx context.Context, token pahomqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
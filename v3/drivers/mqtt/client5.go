@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+// client5 is an MQTT 5 client built on github.com/eclipse/paho.golang.
+type client5 struct {
+	cm     *autopaho.ConnectionManager
+	config *mqttConfig
+
+	mu     sync.Mutex
+	topics map[string]struct{}
+}
+
+func newClient5(ctx context.Context, config *mqttConfig, handler func(topic string, payload []byte), logger watermill.LoggerAdapter) (client, error) {
+	c := &client5{
+		config: config,
+		topics: make(map[string]struct{}),
+	}
+
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{config.broker},
+		TlsCfg:                        config.tls,
+		KeepAlive:                     uint16(config.keepAlive.Seconds()),
+		CleanStartOnInitialConnection: config.cleanSession,
+		SessionExpiryInterval:         uint32(config.sessionExpiry.Seconds()),
+		ReconnectBackoff:              autopaho.NewConstantBackoff(config.reconnectWait),
+		ConnectTimeout:                config.timeout,
+		ConnectUsername:               config.username,
+		ConnectPassword:               []byte(config.password),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, _ *paho.Connack) {
+			// The broker may have lost the subscriptions, for example if the session has expired.
+			topics := c.subscribedTopics()
+			if len(topics) == 0 {
+				return
+			}
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), config.timeout)
+				defer cancel()
+				if _, err := cm.Subscribe(ctx, c.subscribePacket(topics...)); err != nil {
+					logger.Error("Failed to subscribe to mqtt topics again", err, watermill.LogFields{"topics": topics})
+				}
+			}()
+		},
+		OnConnectError: func(err error) {
+			logger.Info("Failed to connect to mqtt broker", watermill.LogFields{"err": err})
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: config.clientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					handler(pr.Packet.Topic, pr.Packet.Payload)
+					return true, nil
+				},
+			},
+		},
+	}
+
+	// The connection manager stops when its context is done, so it must not depend on ctx.
+	cm, err := autopaho.NewConnection(context.Background(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.cm = cm
+
+	connectCtx, cancel := context.WithTimeout(ctx, config.timeout)
+	defer cancel()
+	if err := cm.AwaitConnection(connectCtx); err != nil {
+		_ = c.close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *client5) subscribedTopics() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (c *client5) subscribePacket(topics ...string) *paho.Subscribe {
+	subscribe := &paho.Subscribe{}
+	for _, topic := range topics {
+		subscribe.Subscriptions = append(subscribe.Subscriptions, paho.SubscribeOptions{Topic: topic, QoS: c.config.qos})
+	}
+	return subscribe
+}
+
+// publish waits for the connection to be up before it publishes the message, so that a publish during a reconnect
+// succeeds within the deadline of ctx.
+func (c *client5) publish(ctx context.Context, topic string, payload []byte, retain bool) error {
+	if err := c.cm.AwaitConnection(ctx); err != nil {
+		return err
+	}
+	_, err := c.cm.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     c.config.qos,
+		Retain:  retain,
+		Payload: payload,
+	})
+	return err
+}
+
+func (c *client5) subscribe(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	c.topics[topic] = struct{}{}
+	c.mu.Unlock()
+
+	err := c.cm.AwaitConnection(ctx)
+	if err == nil {
+		_, err = c.cm.Subscribe(ctx, c.subscribePacket(topic))
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.topics, topic)
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *client5) unsubscribe(ctx context.Context, topic string) error {
+	c.mu.Lock()
+	delete(c.topics, topic)
+	c.mu.Unlock()
+	_, err := c.cm.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{topic}})
+	return err
+}
+
+func (c *client5) close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.timeout)
+	defer cancel()
+	if err := c.cm.Disconnect(ctx); err != nil {
+		return fmt.Errorf("failed to disconnect from mqtt broker: %w", err)
+	}
+	return nil
+}
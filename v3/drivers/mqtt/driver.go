@@ -0,0 +1,397 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+
+	"github.com/origadmin/casbin-watcher/v3"
+	"github.com/origadmin/casbin-watcher/v3/internal/tlsconfig"
+)
+
+func init() {
+	watcher.RegisterDriver("mqtt", &Driver{})
+	watcher.RegisterDriver("mqtts", &Driver{})
+}
+
+// Supported MQTT protocol versions.
+const (
+	Protocol311 = "3.1.1"
+	Protocol5   = "5"
+)
+
+// subscriptionQueueSize is the number of messages queued for a slow subscription before messages are dropped.
+const subscriptionQueueSize = 256
+
+// Driver implements the watcher.Driver interface for MQTT.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub for MQTT. It connects to the broker before it returns.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseMQTTURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mqtt url: %w", err)
+	}
+
+	ps := &pubSub{
+		config:        config,
+		logger:        logger,
+		subscriptions: make(map[string][]*subscription),
+		closed:        make(chan struct{}),
+	}
+
+	var c client
+	switch config.protocol {
+	case Protocol5:
+		c, err = newClient5(ctx, config, ps.dispatch, logger)
+	default:
+		c, err = newClient311(config, ps.dispatch, logger)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mqtt broker: %w", err)
+	}
+	ps.client = c
+	return ps, nil
+}
+
+// client is the part of an MQTT client library used by the driver.
+// Implementations subscribe to their topics again after reconnecting.
+type client interface {
+	publish(ctx context.Context, topic string, payload []byte, retain bool) error
+	subscribe(ctx context.Context, topic string) error
+	unsubscribe(ctx context.Context, topic string) error
+	close() error
+}
+
+// envelope is the JSON representation of a message as it is published to the broker.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type pubSub struct {
+	client client
+	config *mqttConfig
+	logger watermill.LoggerAdapter
+
+	mu            sync.Mutex
+	subscriptions map[string][]*subscription
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// subscription delivers the messages of a topic to one output channel.
+// Received messages are queued, so that the client library is never blocked by a slow subscriber.
+type subscription struct {
+	output chan *message.Message
+	queue  chan *message.Message
+}
+
+// Publish sends the messages to the topic. If retaining is enabled, policy-changed notices are retained by the
+// broker, so that watchers that subscribe later receive the latest one.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		retain := p.config.retain && msg.Metadata.Get(watcher.MetadataUpdateType) == watcher.UpdateTypePolicyChanged
+
+		ctx, cancel := context.WithTimeout(context.Background(), p.config.timeout)
+		err = p.client.publish(ctx, topic, data, retain)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to the topic. It returns once the broker has acknowledged the subscription.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	sub := &subscription{
+		output: make(chan *message.Message),
+		queue:  make(chan *message.Message, subscriptionQueueSize),
+	}
+
+	p.mu.Lock()
+	first := len(p.subscriptions[topic]) == 0
+	p.subscriptions[topic] = append(p.subscriptions[topic], sub)
+	p.mu.Unlock()
+
+	if first {
+		subscribeCtx, cancel := context.WithTimeout(ctx, p.config.timeout)
+		err := p.client.subscribe(subscribeCtx, topic)
+		cancel()
+		if err != nil {
+			p.removeSubscription(topic, sub)
+			return nil, fmt.Errorf("failed to subscribe to topic %q: %w", topic, err)
+		}
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(sub.output)
+		p.deliverQueued(ctx, sub)
+		if p.removeSubscription(topic, sub) {
+			unsubscribeCtx, cancel := context.WithTimeout(context.Background(), p.config.timeout)
+			if err := p.client.unsubscribe(unsubscribeCtx, topic); err != nil {
+				p.logger.Debug("Failed to unsubscribe from mqtt topic", watermill.LogFields{"topic": topic, "err": err})
+			}
+			cancel()
+		}
+	}()
+
+	return sub.output, nil
+}
+
+// removeSubscription removes sub from the subscriptions of the topic.
+// It returns true if it was the last one, unless the PubSub is closed.
+func (p *pubSub) removeSubscription(topic string, sub *subscription) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	subs := p.subscriptions[topic]
+	for i, s := range subs {
+		if s == sub {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(p.subscriptions, topic)
+	} else {
+		p.subscriptions[topic] = subs
+	}
+	select {
+	case <-p.closed:
+		return false
+	default:
+		return len(subs) == 0
+	}
+}
+
+// dispatch queues a message received on topic for its subscriptions.
+// It is called by the client library for one message at a time and returns without waiting for the subscribers,
+// so that the library keeps sending acknowledgements and keepalives, and a handler that publishes does not
+// wait for itself. Messages for a subscription that cannot keep up are dropped.
+func (p *pubSub) dispatch(topic string, payload []byte) {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		p.logger.Error("Failed to unmarshal mqtt message", err, watermill.LogFields{"topic": topic})
+		return
+	}
+
+	p.mu.Lock()
+	subs := append([]*subscription(nil), p.subscriptions[topic]...)
+	p.mu.Unlock()
+
+	for _, sub := range subs {
+		msg := message.NewMessage(env.UUID, env.Payload)
+		for k, v := range env.Metadata {
+			msg.Metadata.Set(k, v)
+		}
+		select {
+		case sub.queue <- msg:
+		default:
+			p.logger.Error("mqtt subscription fell behind, dropping message", nil, watermill.LogFields{
+				"topic": topic,
+				"uuid":  msg.UUID,
+			})
+		}
+	}
+}
+
+// deliverQueued sends the queued messages of sub to its output in order, each after the previous one has been
+// acknowledged, until the subscription ends.
+func (p *pubSub) deliverQueued(ctx context.Context, sub *subscription) {
+	for {
+		var msg *message.Message
+		select {
+		case msg = <-sub.queue:
+		case <-ctx.Done():
+			return
+		case <-p.closed:
+			return
+		}
+
+		select {
+		case sub.output <- msg:
+		case <-ctx.Done():
+			return
+		case <-p.closed:
+			return
+		}
+		select {
+		case <-msg.Acked():
+		case <-msg.Nacked():
+		case <-ctx.Done():
+			return
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+func (p *pubSub) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+		err = p.client.close()
+	})
+	return err
+}
+
+type mqttConfig struct {
+	broker        *url.URL
+	tls           *tls.Config
+	username      string
+	password      string
+	clientID      string
+	protocol      string
+	qos           byte
+	retain        bool
+	cleanSession  bool
+	sessionExpiry time.Duration
+	keepAlive     time.Duration
+	timeout       time.Duration
+	reconnectWait time.Duration
+}
+
+func parseMQTTURL(u *url.URL) (*mqttConfig, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("mqtt broker is not specified in URL host")
+	}
+
+	query := u.Query()
+	config := &mqttConfig{
+		protocol:      Protocol311,
+		qos:           1,
+		cleanSession:  true,
+		keepAlive:     30 * time.Second,
+		timeout:       10 * time.Second,
+		reconnectWait: time.Second,
+		clientID:      query.Get("client_id"),
+	}
+
+	tlsConfig, err := tlsconfig.FromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil && u.Scheme == "mqtts" {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	config.tls = tlsConfig
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if config.tls != nil {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	config.broker = &url.URL{Scheme: "mqtt", Host: host}
+	if config.tls != nil {
+		config.broker.Scheme = "mqtts"
+	}
+
+	if u.User != nil {
+		config.username = u.User.Username()
+		config.password, _ = u.User.Password()
+	}
+
+	if protocol := query.Get("protocol"); protocol != "" {
+		switch protocol {
+		case Protocol311, Protocol5:
+			config.protocol = protocol
+		default:
+			return nil, fmt.Errorf("invalid 'protocol' param: %q", protocol)
+		}
+	}
+
+	if q := query.Get("qos"); q != "" {
+		val, err := strconv.ParseUint(q, 10, 8)
+		if err != nil || val > 2 {
+			return nil, fmt.Errorf("invalid 'qos' param: %q", q)
+		}
+		config.qos = byte(val)
+	}
+
+	if r := query.Get("retain"); r != "" {
+		val, err := strconv.ParseBool(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'retain' param: %w", err)
+		}
+		config.retain = val
+	}
+
+	if cs := query.Get("clean_session"); cs != "" {
+		val, err := strconv.ParseBool(cs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'clean_session' param: %w", err)
+		}
+		config.cleanSession = val
+	}
+	if config.clientID == "" {
+		if !config.cleanSession {
+			return nil, fmt.Errorf("'client_id' param is required for persistent sessions")
+		}
+		config.clientID = "casbin-watcher-" + watermill.NewShortUUID()
+	}
+
+	if !config.cleanSession {
+		// Without an expiry interval, an MQTT 5 session ends when the connection is closed.
+		config.sessionExpiry = time.Hour
+	}
+	if se := query.Get("session_expiry"); se != "" {
+		val, err := time.ParseDuration(se)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'session_expiry' param: %w", err)
+		}
+		config.sessionExpiry = val
+	}
+
+	if ka := query.Get("keep_alive"); ka != "" {
+		val, err := time.ParseDuration(ka)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'keep_alive' param: %w", err)
+		}
+		config.keepAlive = val
+	}
+
+	if t := query.Get("timeout"); t != "" {
+		val, err := time.ParseDuration(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timeout' param: %w", err)
+		}
+		config.timeout = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.reconnectWait = val
+	}
+
+	return config, nil
+}
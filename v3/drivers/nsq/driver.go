@@ -0,0 +1,325 @@
+package nsq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/nsqio/go-nsq"
+	"go.uber.org/multierr"
+
+	watcher "github.com/origadmin/casbin-watcher/v3"
+	"github.com/origadmin/casbin-watcher/v3/internal/tlsconfig"
+)
+
+func init() {
+	watcher.RegisterDriver("nsq", &Driver{})
+}
+
+// errNacked is returned to go-nsq for nacked messages, so that they are requeued.
+var errNacked = errors.New("message was nacked")
+
+// Driver for NSQ.
+type Driver struct{}
+
+// NewPubSub creates a new Pub/Sub instance for NSQ. The first reachable nsqd is used for publishing.
+func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseNSQURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse nsq url: %w", err)
+	}
+
+	ps := &nsqPubSub{
+		config: config,
+		logger: logger,
+		closed: make(chan struct{}),
+	}
+	for _, addr := range config.NSQDAddresses {
+		producer, err := nsq.NewProducer(addr, config.NSQConfig)
+		if err != nil {
+			_ = ps.Close()
+			return nil, err
+		}
+		producer.SetLogger(nsqLogger{logger}, nsq.LogLevelWarning)
+		ps.producers = append(ps.producers, producer)
+	}
+	if err := ps.ping(); err != nil {
+		_ = ps.Close()
+		return nil, fmt.Errorf("failed to connect to nsqd: %w", err)
+	}
+	return ps, nil
+}
+
+// envelope is the JSON representation of a message as it is published to NSQ.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type nsqPubSub struct {
+	producers []*nsq.Producer
+	config    *nsqConfig
+	logger    watermill.LoggerAdapter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// ping returns nil if at least one nsqd is reachable.
+func (p *nsqPubSub) ping() error {
+	var err error
+	for _, producer := range p.producers {
+		pingErr := producer.Ping()
+		if pingErr == nil {
+			return nil
+		}
+		err = multierr.Append(err, pingErr)
+	}
+	return err
+}
+
+// Publish sends the messages to the topic, trying the nsqd instances in order until one accepts them.
+func (p *nsqPubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		var publishErr error
+		for _, producer := range p.producers {
+			err := producer.Publish(topic, data)
+			if err == nil {
+				publishErr = nil
+				break
+			}
+			publishErr = multierr.Append(publishErr, err)
+		}
+		if publishErr != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, publishErr)
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to the topic on the watcher's channel. By default, the channel is ephemeral and unique to the
+// subscription, so that every watcher receives every message.
+func (p *nsqPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	channel := p.config.Channel
+	if channel == "" {
+		channel = "casbin-watcher-" + watermill.NewShortUUID() + "#ephemeral"
+	}
+
+	consumer, err := nsq.NewConsumer(topic, channel, p.config.NSQConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer for topic %q: %w", topic, err)
+	}
+	consumer.SetLogger(nsqLogger{p.logger}, nsq.LogLevelWarning)
+
+	// outputMu is held by the handler while it delivers a message, so that output is not closed during a delivery.
+	var outputMu sync.Mutex
+	done := make(chan struct{})
+	output := make(chan *message.Message)
+	consumer.AddHandler(nsq.HandlerFunc(func(m *nsq.Message) error {
+		outputMu.Lock()
+		defer outputMu.Unlock()
+
+		var env envelope
+		if err := json.Unmarshal(m.Body, &env); err != nil {
+			// The message can never be handled, so it is finished instead of requeued.
+			p.logger.Error("failed to unmarshal nsq message", err, watermill.LogFields{"topic": topic})
+			return nil
+		}
+		msg := message.NewMessage(env.UUID, env.Payload)
+		for k, v := range env.Metadata {
+			msg.Metadata.Set(k, v)
+		}
+
+		select {
+		case <-done:
+			m.RequeueWithoutBackoff(-1)
+			return nil
+		default:
+		}
+		select {
+		case output <- msg:
+		case <-done:
+			m.RequeueWithoutBackoff(-1)
+			return nil
+		}
+		select {
+		case <-msg.Acked():
+			return nil
+		case <-msg.Nacked():
+			return errNacked
+		case <-done:
+			m.RequeueWithoutBackoff(-1)
+			return nil
+		}
+	}))
+
+	if len(p.config.LookupdAddresses) > 0 {
+		err = consumer.ConnectToNSQLookupds(p.config.LookupdAddresses)
+	} else {
+		err = consumer.ConnectToNSQDs(p.config.NSQDAddresses)
+	}
+	if err != nil {
+		consumer.Stop()
+		return nil, fmt.Errorf("failed to subscribe to topic %q: %w", topic, err)
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		select {
+		case <-ctx.Done():
+		case <-p.closed:
+		}
+		close(done)
+		consumer.Stop()
+		<-consumer.StopChan
+		outputMu.Lock()
+		close(output)
+		outputMu.Unlock()
+	}()
+
+	return output, nil
+}
+
+func (p *nsqPubSub) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+		for _, producer := range p.producers {
+			producer.Stop()
+		}
+	})
+	return nil
+}
+
+// nsqLogger forwards the log output of the NSQ client to the watermill logger. The client starts each line with its
+// level, which is mapped to the watermill level; warnings are logged as errors.
+type nsqLogger struct {
+	logger watermill.LoggerAdapter
+}
+
+func (l nsqLogger) Output(_ int, s string) error {
+	level, line, _ := strings.Cut(s, " ")
+	line = strings.TrimSpace(line)
+	switch level {
+	case nsq.LogLevelError.String(), nsq.LogLevelWarning.String():
+		l.logger.Error(line, nil, nil)
+	case nsq.LogLevelInfo.String():
+		l.logger.Info(line, nil)
+	case nsq.LogLevelDebug.String():
+		l.logger.Debug(line, nil)
+	default:
+		l.logger.Info(s, nil)
+	}
+	return nil
+}
+
+type nsqConfig struct {
+	NSQDAddresses    []string
+	LookupdAddresses []string
+	Channel          string
+	NSQConfig        *nsq.Config
+}
+
+func parseNSQURL(u *url.URL) (*nsqConfig, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("nsqd addresses are not specified in URL host")
+	}
+
+	config := &nsqConfig{
+		NSQDAddresses: strings.Split(u.Host, ","),
+		NSQConfig:     nsq.NewConfig(),
+	}
+
+	query := u.Query()
+
+	for _, lookupd := range query["lookupd"] {
+		config.LookupdAddresses = append(config.LookupdAddresses, strings.Split(lookupd, ",")...)
+	}
+
+	if ch := query.Get("channel"); ch != "" {
+		if !nsq.IsValidChannelName(ch) {
+			return nil, fmt.Errorf("invalid 'channel' param: %s", ch)
+		}
+		config.Channel = ch
+	}
+
+	if mif := query.Get("max_in_flight"); mif != "" {
+		val, err := strconv.Atoi(mif)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'max_in_flight' param: %w", err)
+		}
+		if val < 0 {
+			return nil, fmt.Errorf("invalid 'max_in_flight' param: must not be negative")
+		}
+		config.NSQConfig.MaxInFlight = val
+	}
+
+	if ma := query.Get("max_attempts"); ma != "" {
+		val, err := strconv.ParseUint(ma, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'max_attempts' param: %w", err)
+		}
+		config.NSQConfig.MaxAttempts = uint16(val)
+	}
+
+	if rd := query.Get("requeue_delay"); rd != "" {
+		val, err := time.ParseDuration(rd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'requeue_delay' param: %w", err)
+		}
+		config.NSQConfig.DefaultRequeueDelay = val
+	}
+
+	if lpi := query.Get("lookupd_poll_interval"); lpi != "" {
+		val, err := time.ParseDuration(lpi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'lookupd_poll_interval' param: %w", err)
+		}
+		config.NSQConfig.LookupdPollInterval = val
+	}
+
+	if dt := query.Get("dial_timeout"); dt != "" {
+		val, err := time.ParseDuration(dt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'dial_timeout' param: %w", err)
+		}
+		config.NSQConfig.DialTimeout = val
+	}
+
+	config.NSQConfig.AuthSecret = query.Get("auth_secret")
+
+	tlsConfig, err := tlsconfig.FromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		config.NSQConfig.TlsV1 = true
+		config.NSQConfig.TlsConfig = tlsConfig
+	}
+
+	if err := config.NSQConfig.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
@@ -0,0 +1,149 @@
+package nsq
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNSQURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		check   func(t *testing.T, config *nsqConfig)
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			url:  "nsq://localhost:4150/casbin",
+			check: func(t *testing.T, config *nsqConfig) {
+				require.Equal(t, []string{"localhost:4150"}, config.NSQDAddresses)
+				require.Empty(t, config.LookupdAddresses)
+				require.Empty(t, config.Channel)
+				require.Equal(t, 1, config.NSQConfig.MaxInFlight)
+				require.False(t, config.NSQConfig.TlsV1)
+			},
+		},
+		{
+			name: "nsqd addresses",
+			url:  "nsq://nsqd1:4150,nsqd2:4150/casbin",
+			check: func(t *testing.T, config *nsqConfig) {
+				require.Equal(t, []string{"nsqd1:4150", "nsqd2:4150"}, config.NSQDAddresses)
+			},
+		},
+		{
+			name: "lookupd addresses",
+			url:  "nsq://localhost:4150/casbin?lookupd=lookupd1:4161,lookupd2:4161&lookupd=lookupd3:4161",
+			check: func(t *testing.T, config *nsqConfig) {
+				require.Equal(t, []string{"lookupd1:4161", "lookupd2:4161", "lookupd3:4161"}, config.LookupdAddresses)
+			},
+		},
+		{
+			name: "channel",
+			url:  "nsq://localhost:4150/casbin?channel=app1-node1",
+			check: func(t *testing.T, config *nsqConfig) {
+				require.Equal(t, "app1-node1", config.Channel)
+			},
+		},
+		{
+			name: "ephemeral channel",
+			url:  "nsq://localhost:4150/casbin?channel=app1%23ephemeral",
+			check: func(t *testing.T, config *nsqConfig) {
+				require.Equal(t, "app1#ephemeral", config.Channel)
+			},
+		},
+		{
+			name:    "invalid channel",
+			url:     "nsq://localhost:4150/casbin?channel=app1%2Fnode1",
+			wantErr: "invalid 'channel' param",
+		},
+		{
+			name: "max_in_flight",
+			url:  "nsq://localhost:4150/casbin?max_in_flight=10",
+			check: func(t *testing.T, config *nsqConfig) {
+				require.Equal(t, 10, config.NSQConfig.MaxInFlight)
+			},
+		},
+		{
+			name:    "invalid max_in_flight",
+			url:     "nsq://localhost:4150/casbin?max_in_flight=many",
+			wantErr: "invalid 'max_in_flight' param",
+		},
+		{
+			name:    "negative max_in_flight",
+			url:     "nsq://localhost:4150/casbin?max_in_flight=-1",
+			wantErr: "invalid 'max_in_flight' param: must not be negative",
+		},
+		{
+			name: "other params",
+			url: "nsq://localhost:4150/casbin?max_attempts=3&requeue_delay=5s&lookupd_poll_interval=30s" +
+				"&dial_timeout=2s&auth_secret=secret&tls=true",
+			check: func(t *testing.T, config *nsqConfig) {
+				require.Equal(t, uint16(3), config.NSQConfig.MaxAttempts)
+				require.Equal(t, 5*time.Second, config.NSQConfig.DefaultRequeueDelay)
+				require.Equal(t, 30*time.Second, config.NSQConfig.LookupdPollInterval)
+				require.Equal(t, 2*time.Second, config.NSQConfig.DialTimeout)
+				require.Equal(t, "secret", config.NSQConfig.AuthSecret)
+				require.True(t, config.NSQConfig.TlsV1)
+			},
+		},
+		{
+			name:    "missing nsqd addresses",
+			url:     "nsq:///casbin",
+			wantErr: "nsqd addresses are not specified",
+		},
+		{
+			name:    "invalid max_attempts",
+			url:     "nsq://localhost:4150/casbin?max_attempts=70000",
+			wantErr: "invalid 'max_attempts' param",
+		},
+		{
+			name:    "invalid requeue_delay",
+			url:     "nsq://localhost:4150/casbin?requeue_delay=soon",
+			wantErr: "invalid 'requeue_delay' param",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			config, err := parseNSQURL(u)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			tt.check(t, config)
+		})
+	}
+}
+
+func TestNSQLogger(t *testing.T) {
+	tests := []struct {
+		line      string
+		wantLevel watermill.LogLevel
+		wantMsg   string
+	}{
+		{line: "ERR    1 (localhost:4150) IO error - EOF", wantLevel: watermill.ErrorLogLevel, wantMsg: "1 (localhost:4150) IO error - EOF"},
+		{line: "WRN    1 [casbin/app1] backing off for 1s", wantLevel: watermill.ErrorLogLevel, wantMsg: "1 [casbin/app1] backing off for 1s"},
+		{line: "INF    1 (localhost:4150) connecting to nsqd", wantLevel: watermill.InfoLogLevel, wantMsg: "1 (localhost:4150) connecting to nsqd"},
+		{line: "DBG    1 (localhost:4150) heartbeat received", wantLevel: watermill.DebugLogLevel, wantMsg: "1 (localhost:4150) heartbeat received"},
+		{line: "unexpected output", wantLevel: watermill.InfoLogLevel, wantMsg: "unexpected output"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			logger := watermill.NewCaptureLogger()
+			require.NoError(t, nsqLogger{logger}.Output(2, tt.line))
+			captured := logger.Captured()[tt.wantLevel]
+			require.Len(t, captured, 1)
+			require.Equal(t, tt.wantMsg, captured[0].Msg)
+		})
+	}
+
+	// The levels are those printed by the client.
+	require.Equal(t, "WRN", nsq.LogLevelWarning.String())
+}
@@ -0,0 +1,410 @@
+package pgnotify
+
+import (
+	"context"
+	"crypto/sha256"
+	stdSQL "database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/lib/pq"
+	"go.uber.org/multierr"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("pgnotify", &Driver{})
+}
+
+const (
+	// maxNotifyPayload is the largest payload accepted by pg_notify in the default server configuration.
+	maxNotifyPayload = 7999
+	// maxIdentifierLength is the maximum length of a PostgreSQL identifier, which limits channel names.
+	maxIdentifierLength = 63
+	// listenerPingInterval is how often the listener connection is checked, so that a broken connection
+	// is detected and re-established even when no notifications arrive.
+	listenerPingInterval = 90 * time.Second
+)
+
+// tableNamePattern matches a table name, optionally qualified with a schema.
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// driverParams are the query parameters consumed by the driver. All other parameters are passed to the database connection.
+var driverParams = []string{"min_reconnect_interval", "max_reconnect_interval", "payload_table", "payload_ttl"}
+
+// Driver implements the watcher.Driver interface for PostgreSQL LISTEN/NOTIFY.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub for PostgreSQL LISTEN/NOTIFY.
+// Messages are published with pg_notify on a channel derived from the topic. Messages that
+// exceed the notification payload limit are stored in the payload table, and only their
+// row ID is sent in the notification.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parsePGNotifyURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pgnotify url: %w", err)
+	}
+
+	db, err := stdSQL.Open("postgres", config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open postgres database: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to connect to postgres database: %w", err)
+	}
+
+	return &pubSub{
+		config: config,
+		db:     db,
+		logger: logger,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// notification is the JSON payload of a notification.
+// If the message was too large, only Topic and Ref are set, and the full notification is stored in the payload table.
+type notification struct {
+	Topic    string            `json:"topic"`
+	UUID     string            `json:"uuid,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload,omitempty"`
+	Ref      int64             `json:"ref,omitempty"`
+}
+
+type pubSub struct {
+	config *pgNotifyConfig
+	db     *stdSQL.DB
+	logger watermill.LoggerAdapter
+
+	// tableMu guards tableCreated, which is set once the payload table is known to exist.
+	tableMu      sync.Mutex
+	tableCreated bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish sends a notification for each message on the channel of the topic.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	channel := channelName(topic)
+	for _, msg := range messages {
+		data, err := json.Marshal(notification{
+			Topic:    topic,
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		if len(data) > maxNotifyPayload {
+			err = p.publishReference(channel, topic, data)
+		} else {
+			_, err = p.db.Exec("SELECT pg_notify($1, $2)", channel, string(data))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// publishReference stores data in the payload table and notifies the row ID.
+// The row and the notification are committed together, so subscribers never see a reference to a missing row.
+func (p *pubSub) publishReference(channel, topic string, data []byte) error {
+	if err := p.createPayloadTable(); err != nil {
+		return err
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if p.config.PayloadTTL > 0 {
+		// Remove the payloads that all subscribers have had time to read.
+		_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE created_at < $1", p.config.PayloadTable),
+			time.Now().Add(-p.config.PayloadTTL))
+		if err != nil {
+			return fmt.Errorf("failed to delete expired payloads: %w", err)
+		}
+	}
+
+	var id int64
+	err = tx.QueryRow(fmt.Sprintf("INSERT INTO %s (channel, body) VALUES ($1, $2) RETURNING id", p.config.PayloadTable),
+		channel, data).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("failed to store payload: %w", err)
+	}
+
+	ref, err := json.Marshal(notification{Topic: topic, Ref: id})
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("SELECT pg_notify($1, $2)", channel, string(ref)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *pubSub) createPayloadTable() error {
+	p.tableMu.Lock()
+	defer p.tableMu.Unlock()
+
+	if p.tableCreated {
+		return nil
+	}
+	_, err := p.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id BIGSERIAL PRIMARY KEY,
+	channel TEXT NOT NULL,
+	body BYTEA NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`, p.config.PayloadTable))
+	if err != nil {
+		return fmt.Errorf("failed to create payload table: %w", err)
+	}
+	p.tableCreated = true
+	return nil
+}
+
+// Subscribe listens on the channel of the topic with a dedicated connection.
+// The connection is re-established automatically; notifications sent while it is down are lost.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	channel := channelName(topic)
+	listener := pq.NewListener(p.config.DSN, p.config.MinReconnectInterval, p.config.MaxReconnectInterval,
+		func(event pq.ListenerEventType, err error) {
+			switch event {
+			case pq.ListenerEventDisconnected:
+				p.logger.Error("postgres listener disconnected", err, watermill.LogFields{"channel": channel})
+			case pq.ListenerEventConnectionAttemptFailed:
+				p.logger.Error("postgres listener failed to reconnect", err, watermill.LogFields{"channel": channel})
+			case pq.ListenerEventReconnected:
+				p.logger.Info("postgres listener reconnected, notifications may have been lost",
+					watermill.LogFields{"channel": channel})
+			}
+		})
+
+	// Listen blocks until the connection is established, which may take forever if the database is down.
+	listened := make(chan error, 1)
+	go func() {
+		listened <- listener.Listen(channel)
+	}()
+	select {
+	case err := <-listened:
+		if err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("failed to listen on channel %q: %w", channel, err)
+		}
+	case <-ctx.Done():
+		_ = listener.Close()
+		return nil, ctx.Err()
+	}
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer func() {
+			_ = listener.Close()
+		}()
+
+		ping := time.NewTicker(listenerPingInterval)
+		defer ping.Stop()
+
+		for {
+			select {
+			case n, ok := <-listener.Notify:
+				if !ok {
+					return
+				}
+				if n == nil {
+					// The connection was re-established.
+					continue
+				}
+				msg, err := p.decode(ctx, topic, n.Extra)
+				if err != nil {
+					p.logger.Error("failed to decode notification", err, watermill.LogFields{"channel": channel})
+					continue
+				}
+				if msg == nil {
+					continue
+				}
+				if !p.deliver(ctx, msg, output) {
+					return
+				}
+			case <-ping.C:
+				go func() {
+					_ = listener.Ping()
+				}()
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// decode converts a notification payload into a message. It returns nil if the notification
+// belongs to another topic whose name maps to the same channel.
+func (p *pubSub) decode(ctx context.Context, topic, payload string) (*message.Message, error) {
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return nil, err
+	}
+	if n.Topic != topic {
+		return nil, nil
+	}
+	if n.Ref != 0 {
+		var body []byte
+		err := p.db.QueryRowContext(ctx, fmt.Sprintf("SELECT body FROM %s WHERE id = $1", p.config.PayloadTable),
+			n.Ref).Scan(&body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load payload %d: %w", n.Ref, err)
+		}
+		n = notification{}
+		if err := json.Unmarshal(body, &n); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := message.NewMessage(n.UUID, n.Payload)
+	for k, v := range n.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+	return msg, nil
+}
+
+// deliver sends msg to output and waits until it is acknowledged. It returns false if the subscription has ended.
+func (p *pubSub) deliver(ctx context.Context, msg *message.Message, output chan<- *message.Message) bool {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	return true
+}
+
+func (p *pubSub) Close() error {
+	var allErrors error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+		allErrors = multierr.Append(allErrors, p.db.Close())
+	})
+	return allErrors
+}
+
+// channelName converts topic into a valid channel name: lower case letters, digits and underscores,
+// not starting with a digit and at most 63 bytes long. Names that have to be shortened end with a
+// hash of the topic. Topics that map to the same channel are told apart by the topic in the notification.
+func channelName(topic string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(topic) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	name := b.String()
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	if len(name) > maxIdentifierLength {
+		sum := sha256.Sum256([]byte(topic))
+		suffix := "_" + hex.EncodeToString(sum[:])[:16]
+		name = name[:maxIdentifierLength-len(suffix)] + suffix
+	}
+	return name
+}
+
+type pgNotifyConfig struct {
+	DSN                  string
+	MinReconnectInterval time.Duration
+	MaxReconnectInterval time.Duration
+	PayloadTable         string
+	PayloadTTL           time.Duration
+}
+
+func parsePGNotifyURL(u *url.URL) (*pgNotifyConfig, error) {
+	query := u.Query()
+	config := &pgNotifyConfig{
+		MinReconnectInterval: time.Second,
+		MaxReconnectInterval: time.Minute,
+		PayloadTable:         "casbin_watcher_payloads",
+		PayloadTTL:           time.Hour,
+	}
+
+	var err error
+	if mri := query.Get("min_reconnect_interval"); mri != "" {
+		config.MinReconnectInterval, err = time.ParseDuration(mri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'min_reconnect_interval' param: %w", err)
+		}
+	}
+	if mri := query.Get("max_reconnect_interval"); mri != "" {
+		config.MaxReconnectInterval, err = time.ParseDuration(mri)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'max_reconnect_interval' param: %w", err)
+		}
+	}
+	if config.MaxReconnectInterval < config.MinReconnectInterval {
+		return nil, fmt.Errorf("'max_reconnect_interval' must not be less than 'min_reconnect_interval'")
+	}
+	if pt := query.Get("payload_table"); pt != "" {
+		if !tableNamePattern.MatchString(pt) {
+			return nil, fmt.Errorf("invalid 'payload_table' param: %q is not a valid table name", pt)
+		}
+		config.PayloadTable = pt
+	}
+	if ttl := query.Get("payload_ttl"); ttl != "" {
+		config.PayloadTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'payload_ttl' param: %w", err)
+		}
+	}
+
+	// The URL path is the topic, so the database is selected with the 'dbname' parameter,
+	// which is passed to the connection along with all other parameters not used by the driver.
+	for _, param := range driverParams {
+		query.Del(param)
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     u.User,
+		Host:     u.Host,
+		RawQuery: query.Encode(),
+	}
+	config.DSN = dsn.String()
+
+	return config, nil
+}
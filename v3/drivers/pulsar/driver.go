@@ -0,0 +1,384 @@
+package pulsar
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apache/pulsar-client-go/pulsar/log"
+
+	watcher "github.com/origadmin/casbin-watcher/v3"
+	"github.com/origadmin/casbin-watcher/v3/internal/tlsconfig"
+)
+
+func init() {
+	watcher.RegisterDriver("pulsar", &Driver{})
+	watcher.RegisterDriver("pulsar+ssl", &Driver{})
+}
+
+// uuidProperty is the message property that carries the UUID of a watermill message.
+const uuidProperty = "_watermill_message_uuid"
+
+// Subscription modes of the driver.
+const (
+	ModeConsumer = "consumer"
+	ModeReader   = "reader"
+)
+
+// Driver for Apache Pulsar.
+type Driver struct{}
+
+// NewPubSub creates a new Pub/Sub instance for Apache Pulsar.
+func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parsePulsarURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pulsar url: %w", err)
+	}
+
+	client, err := pulsar.NewClient(config.ClientOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pulsar client: %w", err)
+	}
+
+	return &pulsarPubSub{
+		client:    client,
+		config:    config,
+		logger:    logger,
+		producers: make(map[string]pulsar.Producer),
+		closed:    make(chan struct{}),
+	}, nil
+}
+
+type pulsarPubSub struct {
+	client pulsar.Client
+	config *pulsarConfig
+	logger watermill.LoggerAdapter
+
+	mu        sync.Mutex
+	producers map[string]pulsar.Producer
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// producer returns the producer of the topic, creating it on first use.
+func (p *pulsarPubSub) producer(topic string) (pulsar.Producer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		return nil, fmt.Errorf("pulsar pubsub is closed")
+	default:
+	}
+	if producer, ok := p.producers[topic]; ok {
+		return producer, nil
+	}
+	producer, err := p.client.CreateProducer(pulsar.ProducerOptions{
+		Topic:       topic,
+		SendTimeout: p.config.SendTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.producers[topic] = producer
+	return producer, nil
+}
+
+// Publish sends the messages to the topic. The metadata is stored in the message properties.
+func (p *pulsarPubSub) Publish(topic string, messages ...*message.Message) error {
+	producer, err := p.producer(topic)
+	if err != nil {
+		return fmt.Errorf("failed to create producer for topic %q: %w", topic, err)
+	}
+
+	for _, msg := range messages {
+		properties := make(map[string]string, len(msg.Metadata)+1)
+		for k, v := range msg.Metadata {
+			properties[k] = v
+		}
+		properties[uuidProperty] = msg.UUID
+
+		if _, err := producer.Send(context.Background(), &pulsar.ProducerMessage{
+			Payload:    msg.Payload,
+			Properties: properties,
+		}); err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to the topic with a consumer, or with a reader in reader mode.
+func (p *pulsarPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	var (
+		receive func(context.Context) (pulsar.Message, error)
+		ack     func(pulsar.Message)
+		nack    func(pulsar.Message)
+		closeFn func()
+	)
+
+	switch p.config.Mode {
+	case ModeReader:
+		startID := pulsar.LatestMessageID()
+		if p.config.InitialPosition == pulsar.SubscriptionPositionEarliest {
+			startID = pulsar.EarliestMessageID()
+		}
+		reader, err := p.client.CreateReader(pulsar.ReaderOptions{
+			Topic:          topic,
+			StartMessageID: startID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create reader for topic %q: %w", topic, err)
+		}
+		receive = reader.Next
+		ack = func(pulsar.Message) {}
+		nack = func(pulsar.Message) {}
+		closeFn = reader.Close
+	default:
+		subscriptionName := p.config.SubscriptionName
+		subscriptionMode := pulsar.Durable
+		if subscriptionName == "" {
+			// A generated subscription belongs to this watcher only, so it is removed when the watcher disconnects.
+			subscriptionName = "casbin-watcher-" + watermill.NewShortUUID()
+			subscriptionMode = pulsar.NonDurable
+		}
+		consumer, err := p.client.Subscribe(pulsar.ConsumerOptions{
+			Topic:                       topic,
+			SubscriptionName:            subscriptionName,
+			Type:                        p.config.SubscriptionType,
+			SubscriptionInitialPosition: p.config.InitialPosition,
+			SubscriptionMode:            subscriptionMode,
+			NackRedeliveryDelay:         p.config.NackRedeliveryDelay,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to subscribe to topic %q: %w", topic, err)
+		}
+		receive = consumer.Receive
+		ack = func(m pulsar.Message) {
+			if err := consumer.Ack(m); err != nil {
+				p.logger.Error("failed to ack pulsar message", err, watermill.LogFields{"topic": topic})
+			}
+		}
+		nack = consumer.Nack
+		closeFn = consumer.Close
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	output := make(chan *message.Message)
+	p.wg.Add(2)
+	go func() {
+		defer p.wg.Done()
+		defer cancel()
+		select {
+		case <-ctx.Done():
+		case <-p.closed:
+		}
+	}()
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer closeFn()
+
+		for {
+			m, err := receive(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				p.logger.Error("failed to receive pulsar message", err, watermill.LogFields{"topic": topic})
+				select {
+				case <-time.After(p.config.ReconnectWait):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			msg := message.NewMessage(m.Properties()[uuidProperty], m.Payload())
+			for k, v := range m.Properties() {
+				if k != uuidProperty {
+					msg.Metadata.Set(k, v)
+				}
+			}
+
+			select {
+			case output <- msg:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case <-msg.Acked():
+				ack(m)
+			case <-msg.Nacked():
+				nack(m)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+func (p *pulsarPubSub) Close() error {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		close(p.closed)
+		producers := p.producers
+		p.producers = nil
+		p.mu.Unlock()
+
+		p.wg.Wait()
+		for _, producer := range producers {
+			producer.Close()
+		}
+		p.client.Close()
+	})
+	return nil
+}
+
+type pulsarConfig struct {
+	ClientOptions       pulsar.ClientOptions
+	Mode                string
+	SubscriptionName    string
+	SubscriptionType    pulsar.SubscriptionType
+	InitialPosition     pulsar.SubscriptionInitialPosition
+	NackRedeliveryDelay time.Duration
+	SendTimeout         time.Duration
+	ReconnectWait       time.Duration
+}
+
+func parsePulsarURL(u *url.URL) (*pulsarConfig, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("pulsar brokers are not specified in URL host")
+	}
+
+	config := &pulsarConfig{
+		ClientOptions: pulsar.ClientOptions{
+			ConnectionTimeout: 10 * time.Second,
+			Logger:            log.DefaultNopLogger(),
+		},
+		Mode:             ModeConsumer,
+		SubscriptionType: pulsar.Exclusive,
+		InitialPosition:  pulsar.SubscriptionPositionLatest,
+		ReconnectWait:    time.Second,
+	}
+
+	query := u.Query()
+
+	if m := query.Get("mode"); m != "" {
+		switch m {
+		case ModeConsumer, ModeReader:
+			config.Mode = m
+		default:
+			return nil, fmt.Errorf("invalid 'mode' param: %s, must be 'consumer' or 'reader'", m)
+		}
+	}
+
+	config.SubscriptionName = query.Get("subscription")
+
+	if st := query.Get("subscription_type"); st != "" {
+		switch strings.ToLower(st) {
+		case "exclusive":
+			config.SubscriptionType = pulsar.Exclusive
+		case "shared":
+			config.SubscriptionType = pulsar.Shared
+		case "failover":
+			config.SubscriptionType = pulsar.Failover
+		case "key_shared":
+			config.SubscriptionType = pulsar.KeyShared
+		default:
+			return nil, fmt.Errorf("invalid 'subscription_type' param: %s, must be 'exclusive', 'shared', 'failover' or 'key_shared'", st)
+		}
+	}
+	if config.SubscriptionType != pulsar.Exclusive && config.SubscriptionName == "" {
+		// A generated name would give every watcher its own subscription, which makes sharing it pointless.
+		return nil, fmt.Errorf("'subscription' param is required for subscription type %q", query.Get("subscription_type"))
+	}
+
+	if ip := query.Get("initial_position"); ip != "" {
+		switch strings.ToLower(ip) {
+		case "latest":
+			config.InitialPosition = pulsar.SubscriptionPositionLatest
+		case "earliest":
+			config.InitialPosition = pulsar.SubscriptionPositionEarliest
+		default:
+			return nil, fmt.Errorf("invalid 'initial_position' param: %s, must be 'latest' or 'earliest'", ip)
+		}
+	}
+
+	if ct := query.Get("connection_timeout"); ct != "" {
+		val, err := time.ParseDuration(ct)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'connection_timeout' param: %w", err)
+		}
+		config.ClientOptions.ConnectionTimeout = val
+	}
+
+	if ot := query.Get("operation_timeout"); ot != "" {
+		val, err := time.ParseDuration(ot)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'operation_timeout' param: %w", err)
+		}
+		config.ClientOptions.OperationTimeout = val
+	}
+
+	if st := query.Get("send_timeout"); st != "" {
+		val, err := time.ParseDuration(st)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'send_timeout' param: %w", err)
+		}
+		config.SendTimeout = val
+	}
+
+	if nrd := query.Get("nack_redelivery_delay"); nrd != "" {
+		val, err := time.ParseDuration(nrd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'nack_redelivery_delay' param: %w", err)
+		}
+		config.NackRedeliveryDelay = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.ReconnectWait = val
+	}
+
+	// TLS
+	tlsConfig, err := tlsconfig.FromQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	scheme := u.Scheme
+	if tlsConfig != nil {
+		scheme = "pulsar+ssl"
+		config.ClientOptions.TLSConfig = tlsConfig
+	}
+	config.ClientOptions.URL = scheme + "://" + u.Host
+
+	// Authentication
+	token, tokenFile := query.Get("token"), query.Get("token_file")
+	certFile, keyFile := query.Get("cert_file"), query.Get("key_file")
+	switch {
+	case token != "" && tokenFile != "":
+		return nil, fmt.Errorf("only one of 'token' and 'token_file' params can be set")
+	case token != "":
+		config.ClientOptions.Authentication = pulsar.NewAuthenticationToken(token)
+	case tokenFile != "":
+		config.ClientOptions.Authentication = pulsar.NewAuthenticationTokenFromFile(tokenFile)
+	case certFile != "" && keyFile != "":
+		config.ClientOptions.Authentication = pulsar.NewAuthenticationTLS(certFile, keyFile)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,174 @@
+package pulsar
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+	"github.com/apache/pulsar-client-go/pulsar/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePulsarURL(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("file-token\n"), 0o600))
+
+	tests := []struct {
+		name    string
+		url     string
+		check   func(t *testing.T, config *pulsarConfig)
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			url:  "pulsar://localhost:6650/casbin-updates",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, "pulsar://localhost:6650", config.ClientOptions.URL)
+				require.Nil(t, config.ClientOptions.TLSConfig)
+				require.Nil(t, config.ClientOptions.Authentication)
+				require.Equal(t, ModeConsumer, config.Mode)
+				require.Empty(t, config.SubscriptionName)
+				require.Equal(t, pulsar.Exclusive, config.SubscriptionType)
+				require.Equal(t, pulsar.SubscriptionPositionLatest, config.InitialPosition)
+				require.Equal(t, 10*time.Second, config.ClientOptions.ConnectionTimeout)
+				require.Equal(t, time.Second, config.ReconnectWait)
+			},
+		},
+		{
+			name: "all params",
+			url: "pulsar://broker1:6650,broker2:6650/casbin-updates?mode=reader&initial_position=EARLIEST" +
+				"&connection_timeout=5s&operation_timeout=15s&send_timeout=3s&nack_redelivery_delay=2s&reconnect_wait=250ms",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, "pulsar://broker1:6650,broker2:6650", config.ClientOptions.URL)
+				require.Equal(t, ModeReader, config.Mode)
+				require.Equal(t, pulsar.SubscriptionPositionEarliest, config.InitialPosition)
+				require.Equal(t, 5*time.Second, config.ClientOptions.ConnectionTimeout)
+				require.Equal(t, 15*time.Second, config.ClientOptions.OperationTimeout)
+				require.Equal(t, 3*time.Second, config.SendTimeout)
+				require.Equal(t, 2*time.Second, config.NackRedeliveryDelay)
+				require.Equal(t, 250*time.Millisecond, config.ReconnectWait)
+			},
+		},
+		{
+			name:    "missing brokers",
+			url:     "pulsar:///casbin-updates",
+			wantErr: "pulsar brokers are not specified",
+		},
+		{
+			name:    "invalid mode",
+			url:     "pulsar://localhost:6650/casbin-updates?mode=listener",
+			wantErr: "invalid 'mode' param",
+		},
+		{
+			name: "named shared subscription",
+			url:  "pulsar://localhost:6650/casbin-updates?subscription=app1&subscription_type=Shared",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, "app1", config.SubscriptionName)
+				require.Equal(t, pulsar.Shared, config.SubscriptionType)
+			},
+		},
+		{
+			name: "named failover subscription",
+			url:  "pulsar://localhost:6650/casbin-updates?subscription=app1&subscription_type=failover",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, pulsar.Failover, config.SubscriptionType)
+			},
+		},
+		{
+			name: "named key_shared subscription",
+			url:  "pulsar://localhost:6650/casbin-updates?subscription=app1&subscription_type=key_shared",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, pulsar.KeyShared, config.SubscriptionType)
+			},
+		},
+		{
+			name: "named exclusive subscription",
+			url:  "pulsar://localhost:6650/casbin-updates?subscription=app1",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, "app1", config.SubscriptionName)
+				require.Equal(t, pulsar.Exclusive, config.SubscriptionType)
+			},
+		},
+		{
+			name:    "shared subscription without a name",
+			url:     "pulsar://localhost:6650/casbin-updates?subscription_type=shared",
+			wantErr: "'subscription' param is required",
+		},
+		{
+			name:    "invalid subscription_type",
+			url:     "pulsar://localhost:6650/casbin-updates?subscription=app1&subscription_type=broadcast",
+			wantErr: "invalid 'subscription_type' param",
+		},
+		{
+			name:    "invalid initial_position",
+			url:     "pulsar://localhost:6650/casbin-updates?initial_position=middle",
+			wantErr: "invalid 'initial_position' param",
+		},
+		{
+			name:    "invalid reconnect_wait",
+			url:     "pulsar://localhost:6650/casbin-updates?reconnect_wait=soon",
+			wantErr: "invalid 'reconnect_wait' param",
+		},
+		{
+			name: "token",
+			url:  "pulsar://localhost:6650/casbin-updates?token=url-token",
+			check: func(t *testing.T, config *pulsarConfig) {
+				requireToken(t, config, "url-token")
+			},
+		},
+		{
+			name: "token_file",
+			url:  "pulsar://localhost:6650/casbin-updates?token_file=" + url.QueryEscape(tokenFile),
+			check: func(t *testing.T, config *pulsarConfig) {
+				requireToken(t, config, "file-token")
+			},
+		},
+		{
+			name:    "token and token_file",
+			url:     "pulsar://localhost:6650/casbin-updates?token=url-token&token_file=" + url.QueryEscape(tokenFile),
+			wantErr: "only one of 'token' and 'token_file' params can be set",
+		},
+		{
+			name: "pulsar+ssl scheme",
+			url:  "pulsar+ssl://localhost:6651/casbin-updates",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, "pulsar+ssl://localhost:6651", config.ClientOptions.URL)
+			},
+		},
+		{
+			name: "tls param switches to pulsar+ssl",
+			url:  "pulsar://localhost:6651/casbin-updates?tls=true&server_name=pulsar.internal",
+			check: func(t *testing.T, config *pulsarConfig) {
+				require.Equal(t, "pulsar+ssl://localhost:6651", config.ClientOptions.URL)
+				require.NotNil(t, config.ClientOptions.TLSConfig)
+				require.Equal(t, "pulsar.internal", config.ClientOptions.TLSConfig.ServerName)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			config, err := parsePulsarURL(u)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			tt.check(t, config)
+		})
+	}
+}
+
+// requireToken checks that the client authenticates with token.
+func requireToken(t *testing.T, config *pulsarConfig, token string) {
+	provider, ok := config.ClientOptions.Authentication.(auth.Provider)
+	require.True(t, ok)
+	require.Equal(t, "token", provider.Name())
+	data, err := provider.GetData()
+	require.NoError(t, err)
+	require.Equal(t, token, string(data))
+}
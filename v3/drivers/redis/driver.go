@@ -0,0 +1,225 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("redis", &Driver{})
+	watcher.RegisterDriver("rediss", &Driver{})
+}
+
+// Connection modes of the driver.
+const (
+	ModeSingle   = "single"
+	ModeSentinel = "sentinel"
+	ModeCluster  = "cluster"
+)
+
+// Driver implements the watcher.Driver interface for Redis Pub/Sub.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub for Redis Pub/Sub.
+// Messages are broadcast with PUBLISH to all watchers subscribed to the channel at that time;
+// nothing is stored, so watchers that are disconnected miss the message.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseRedisURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse redis url: %w", err)
+	}
+	client := newClient(config)
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	return &pubSub{
+		client: client,
+		logger: logger,
+		closed: make(chan struct{}),
+	}, nil
+}
+
+// envelope is the JSON representation of a message as it is published on a channel.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type pubSub struct {
+	client redis.UniversalClient
+	logger watermill.LoggerAdapter
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish sends the messages to the channel named after the topic.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		if err := p.client.Publish(context.Background(), topic, data).Err(); err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// Subscribe subscribes to the channel named after the topic. It returns once Redis has confirmed the subscription.
+// The client reconnects and subscribes again when the connection is lost.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	sub := p.client.Subscribe(ctx, topic)
+	if _, err := sub.Receive(ctx); err != nil {
+		_ = sub.Close()
+		return nil, fmt.Errorf("failed to subscribe to channel %q: %w", topic, err)
+	}
+	channel := sub.Channel()
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer func() {
+			_ = sub.Close()
+		}()
+
+		for {
+			select {
+			case m, ok := <-channel:
+				if !ok {
+					return
+				}
+				var env envelope
+				if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+					p.logger.Error("failed to unmarshal redis message", err, watermill.LogFields{"channel": m.Channel})
+					continue
+				}
+				msg := message.NewMessage(env.UUID, env.Payload)
+				for k, v := range env.Metadata {
+					msg.Metadata.Set(k, v)
+				}
+				if !p.deliver(ctx, msg, output) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// deliver sends msg to output and waits until it is acknowledged. It returns false if the subscription has ended.
+func (p *pubSub) deliver(ctx context.Context, msg *message.Message, output chan<- *message.Message) bool {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	return true
+}
+
+func (p *pubSub) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.wg.Wait()
+		err = p.client.Close()
+	})
+	return err
+}
+
+type redisConfig struct {
+	Mode string
+	// Exactly one of the options is set, depending on Mode.
+	Options         *redis.Options
+	FailoverOptions *redis.FailoverOptions
+	ClusterOptions  *redis.ClusterOptions
+}
+
+// parseRedisURL selects the mode of u and parses the connection options for it.
+// The connection options are parsed by go-redis, so all of its URL parameters are supported.
+// The URL path holds the topic; the database is selected with the 'db' parameter.
+func parseRedisURL(u *url.URL) (*redisConfig, error) {
+	query := u.Query()
+	mode := query.Get("mode")
+	query.Del("mode")
+	if mode == "" {
+		mode = ModeSingle
+		if query.Has("master_name") {
+			mode = ModeSentinel
+		}
+	}
+
+	redisURL := url.URL{
+		Scheme:   u.Scheme,
+		User:     u.User,
+		Host:     u.Host,
+		RawQuery: query.Encode(),
+	}
+
+	config := &redisConfig{Mode: mode}
+	var err error
+	switch mode {
+	case ModeSingle:
+		config.Options, err = redis.ParseURL(redisURL.String())
+	case ModeSentinel:
+		config.FailoverOptions, err = redis.ParseFailoverURL(redisURL.String())
+		if err == nil && config.FailoverOptions.MasterName == "" {
+			err = fmt.Errorf("sentinel mode requires a 'master_name' param")
+		}
+	case ModeCluster:
+		config.ClusterOptions, err = redis.ParseClusterURL(redisURL.String())
+	default:
+		err = fmt.Errorf("invalid 'mode' param: %q", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// newClient creates the client for the mode of config.
+func newClient(config *redisConfig) redis.UniversalClient {
+	switch config.Mode {
+	case ModeSentinel:
+		return redis.NewFailoverClient(config.FailoverOptions)
+	case ModeCluster:
+		return redis.NewClusterClient(config.ClusterOptions)
+	default:
+		return redis.NewClient(config.Options)
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill-redisstream/pkg/redisstream"
@@ -15,6 +18,10 @@ import (
 	"github.com/origadmin/casbin-watcher/v3"
 )
 
+// consumerGroupPrefix is the prefix of the consumer group names generated by the driver.
+// Only groups with this prefix are removed by the janitor.
+const consumerGroupPrefix = "casbin-watcher-"
+
 func init() {
 	watcher.RegisterDriver("redisstream", &Driver{})
 }
@@ -24,75 +31,221 @@ type Driver struct{}
 
 // NewPubSub creates a new PubSub for Redis Streams.
 func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
-	opts, consumerGroup, err := parseRedisURL(u)
+	config, err := parseRedisURL(u)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse redis url: %w", err)
 	}
 
-	rdb := redis.NewClient(opts)
+	rdb := redis.NewClient(config.options)
 	if err := rdb.Ping(ctx).Err(); err != nil {
 		_ = rdb.Close() // Ensure client is closed on ping failure.
 		return nil, fmt.Errorf("failed to connect to redis: %w", err)
 	}
 
+	// The publisher and the subscriber close their clients when they are closed, so each one gets its own client,
+	// and rdb stays usable to delete the consumer group after the subscriber has stopped reading.
+	publisherClient := redis.NewClient(config.options)
 	publisher, err := redisstream.NewPublisher(
 		redisstream.PublisherConfig{
-			Client:     rdb,
-			Marshaller: redisstream.DefaultMarshallerUnmarshaller{},
+			Client:        publisherClient,
+			Marshaller:    redisstream.DefaultMarshallerUnmarshaller{},
+			DefaultMaxlen: config.maxLen,
 		},
 		logger,
 	)
 	if err != nil {
+		_ = publisherClient.Close()
 		_ = rdb.Close()
 		return nil, fmt.Errorf("failed to create redis publisher: %w", err)
 	}
 
+	subscriberClient := redis.NewClient(config.options)
 	subscriber, err := redisstream.NewSubscriber(
 		redisstream.SubscriberConfig{
-			Client:        rdb,
+			Client:        subscriberClient,
 			Unmarshaller:  redisstream.DefaultMarshallerUnmarshaller{},
-			ConsumerGroup: consumerGroup,
+			ConsumerGroup: config.consumerGroup,
+			// Reads must be repeated regularly, so that the idle time of the consumer shows that the watcher is alive
+			// and the janitors of other watchers do not remove its group.
+			DisableIndefiniteInitialBlock: true,
 		},
 		logger,
 	)
 	if err != nil {
+		_ = subscriberClient.Close()
 		_ = publisher.Close()
 		_ = rdb.Close()
 		return nil, fmt.Errorf("failed to create redis subscriber: %w", err)
 	}
 
-	return &pubSub{
+	ps := &pubSub{
 		publisher:  publisher,
 		subscriber: subscriber,
 		rdb:        rdb,
-	}, nil
+		config:     config,
+		logger:     logger,
+		topics:     make(map[string]struct{}),
+		closed:     make(chan struct{}),
+	}
+	if config.groupIdleTimeout > 0 {
+		ps.wg.Add(1)
+		go ps.runJanitor()
+	}
+	return ps, nil
 }
 
 type pubSub struct {
 	publisher  *redisstream.Publisher
 	subscriber *redisstream.Subscriber
 	rdb        *redis.Client
+	config     *redisConfig
+	logger     watermill.LoggerAdapter
+
+	mu     sync.Mutex
+	topics map[string]struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
 }
 
 func (r *pubSub) Publish(topic string, messages ...*message.Message) error {
-	return r.publisher.Publish(topic, messages...)
+	if err := r.publisher.Publish(topic, messages...); err != nil {
+		return err
+	}
+	if r.config.minIDAge > 0 {
+		minID := fmt.Sprintf("%d-0", time.Now().Add(-r.config.minIDAge).UnixMilli())
+		// The messages have been published at this point, so a failed trim is not an error of the publish.
+		// The stream is trimmed again by the next one.
+		if err := r.rdb.XTrimMinIDApprox(context.Background(), topic, minID, 0).Err(); err != nil {
+			r.logger.Error("Failed to trim stream", err, watermill.LogFields{"topic": topic})
+		}
+	}
+	return nil
 }
 
 func (r *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
-	return r.subscriber.Subscribe(ctx, topic)
+	output, err := r.subscriber.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.topics[topic] = struct{}{}
+	r.mu.Unlock()
+	return output, nil
 }
 
 func (r *pubSub) Close() error {
 	var allErrors error
-	allErrors = multierr.Append(allErrors, r.publisher.Close())
-	allErrors = multierr.Append(allErrors, r.subscriber.Close())
-	allErrors = multierr.Append(allErrors, r.rdb.Close())
+	r.closeOnce.Do(func() {
+		allErrors = multierr.Append(allErrors, r.publisher.Close())
+		allErrors = multierr.Append(allErrors, r.subscriber.Close())
+		close(r.closed)
+		r.wg.Wait()
+		if r.config.deleteGroup {
+			for _, topic := range r.subscribedTopics() {
+				err := r.rdb.XGroupDestroy(context.Background(), topic, r.config.consumerGroup).Err()
+				if err != nil {
+					allErrors = multierr.Append(allErrors,
+						fmt.Errorf("failed to delete consumer group %s of stream %s: %w", r.config.consumerGroup, topic, err))
+				}
+			}
+		}
+		allErrors = multierr.Append(allErrors, r.rdb.Close())
+	})
 	return allErrors
 }
 
-func parseRedisURL(u *url.URL) (*redis.Options, string, error) {
+func (r *pubSub) subscribedTopics() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	topics := make([]string, 0, len(r.topics))
+	for topic := range r.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// runJanitor regularly removes the idle consumer groups of the subscribed streams until the PubSub is closed.
+func (r *pubSub) runJanitor() {
+	defer r.wg.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.closed
+		cancel()
+	}()
+
+	interval := r.config.groupIdleTimeout / 2
+	if interval == 0 {
+		interval = r.config.groupIdleTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, topic := range r.subscribedTopics() {
+				if err := r.removeIdleGroups(ctx, topic); err != nil && ctx.Err() == nil {
+					r.logger.Error("Failed to remove idle consumer groups", err, watermill.LogFields{"topic": topic})
+				}
+			}
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// removeIdleGroups removes the consumer groups of the stream that were generated by other watchers and whose
+// consumers have all been idle for longer than the configured timeout. Groups without consumers are kept, as they
+// may have been created by a watcher that has not read from the stream yet.
+func (r *pubSub) removeIdleGroups(ctx context.Context, stream string) error {
+	groups, err := r.rdb.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		if group.Name == r.config.consumerGroup || !strings.HasPrefix(group.Name, consumerGroupPrefix) {
+			continue
+		}
+		consumers, err := r.rdb.XInfoConsumers(ctx, stream, group.Name).Result()
+		if err != nil {
+			return err
+		}
+		if len(consumers) == 0 {
+			continue
+		}
+		idle := true
+		for _, consumer := range consumers {
+			if consumer.Idle < r.config.groupIdleTimeout {
+				idle = false
+				break
+			}
+		}
+		if !idle {
+			continue
+		}
+		if err := r.rdb.XGroupDestroy(ctx, stream, group.Name).Err(); err != nil {
+			return err
+		}
+		r.logger.Info("Removed idle consumer group", watermill.LogFields{"topic": stream, "consumer_group": group.Name})
+	}
+	return nil
+}
+
+type redisConfig struct {
+	options          *redis.Options
+	consumerGroup    string
+	deleteGroup      bool
+	maxLen           int64
+	minIDAge         time.Duration
+	groupIdleTimeout time.Duration
+}
+
+func parseRedisURL(u *url.URL) (*redisConfig, error) {
 	if u.Host == "" {
-		return nil, "", fmt.Errorf("redis host is not specified in URL")
+		return nil, fmt.Errorf("redis host is not specified in URL")
 	}
 
 	opts := &redis.Options{
@@ -110,7 +263,7 @@ func parseRedisURL(u *url.URL) (*redis.Options, string, error) {
 		dbStr := u.Path[1:]
 		db, err := strconv.Atoi(dbStr)
 		if err != nil {
-			return nil, "", fmt.Errorf("invalid redis db in URL path: %s", dbStr)
+			return nil, fmt.Errorf("invalid redis db in URL path: %s", dbStr)
 		}
 		opts.DB = db
 	}
@@ -119,17 +272,50 @@ func parseRedisURL(u *url.URL) (*redis.Options, string, error) {
 	if poolSizeStr := query.Get("pool_size"); poolSizeStr != "" {
 		poolSize, err := strconv.Atoi(poolSizeStr)
 		if err != nil {
-			return nil, "", fmt.Errorf("invalid pool_size query parameter: %w", err)
+			return nil, fmt.Errorf("invalid pool_size query parameter: %w", err)
 		}
 		opts.PoolSize = poolSize
 	}
 
-	consumerGroup := query.Get("consumer_group")
-	if consumerGroup == "" {
+	config := &redisConfig{
+		options:       opts,
+		consumerGroup: query.Get("consumer_group"),
+	}
+	if config.consumerGroup == "" {
 		// Generate a unique consumer group name if not provided.
 		// This ensures that each watcher instance acts as an independent consumer.
-		consumerGroup = "casbin-watcher-" + watermill.NewUUID()
+		// The group belongs to this watcher alone, so it is deleted when the watcher is closed.
+		config.consumerGroup = consumerGroupPrefix + watermill.NewUUID()
+		config.deleteGroup = true
+	}
+
+	if maxLenStr := query.Get("maxlen"); maxLenStr != "" {
+		maxLen, err := strconv.ParseInt(maxLenStr, 10, 64)
+		if err != nil || maxLen < 0 {
+			return nil, fmt.Errorf("invalid maxlen query parameter: %s", maxLenStr)
+		}
+		config.maxLen = maxLen
+	}
+	if minIDStr := query.Get("minid"); minIDStr != "" {
+		minIDAge, err := time.ParseDuration(minIDStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid minid query parameter: %w", err)
+		}
+		if minIDAge < 0 {
+			return nil, fmt.Errorf("invalid minid query parameter: %s", minIDStr)
+		}
+		config.minIDAge = minIDAge
+	}
+	if timeoutStr := query.Get("group_idle_timeout"); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group_idle_timeout query parameter: %w", err)
+		}
+		if timeout < 0 {
+			return nil, fmt.Errorf("invalid group_idle_timeout query parameter: %s", timeoutStr)
+		}
+		config.groupIdleTimeout = timeout
 	}
 
-	return opts, consumerGroup, nil
+	return config, nil
 }
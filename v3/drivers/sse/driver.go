@@ -0,0 +1,488 @@
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.uber.org/multierr"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("sse", &Driver{})
+}
+
+type hubKey struct{}
+
+type httpClientKey struct{}
+
+// WithHub returns a context carrying a Hub that the application serves on its own HTTP server.
+// When passed to watcher.NewWatcher, the driver publishes to and subscribes from hub directly.
+func WithHub(ctx context.Context, hub *Hub) context.Context {
+	return context.WithValue(ctx, hubKey{}, hub)
+}
+
+// WithHTTPClient returns a context carrying the http.Client used to connect to a remote Hub,
+// for example to configure TLS client certificates. The client must not set a Timeout,
+// as it would also end the event stream.
+func WithHTTPClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, httpClientKey{}, client)
+}
+
+// Driver implements the watcher.Driver interface for Server-Sent Events.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub for Server-Sent Events.
+// If listen_addr is set or a Hub is supplied through WithHub, this node hosts the hub.
+// Otherwise, the node connects to the hub at the URL host: it publishes with POST requests
+// and subscribes to the event stream, reconnecting and resuming with Last-Event-ID.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseSSEURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sse url: %w", err)
+	}
+
+	ps := &pubSub{
+		config: config,
+		logger: logger,
+		closed: make(chan struct{}),
+	}
+
+	if hub, ok := ctx.Value(hubKey{}).(*Hub); ok && hub != nil {
+		ps.hub = hub
+		return ps, nil
+	}
+
+	if config.ListenAddr != "" {
+		// The address is bound before NewPubSub returns, so that an address in use is reported to the caller.
+		lis, err := net.Listen("tcp", config.ListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", config.ListenAddr, err)
+		}
+		hub := NewHub(HubConfig{
+			BufferSize:        config.BufferSize,
+			KeepAliveInterval: config.KeepAliveInterval,
+		})
+		mux := http.NewServeMux()
+		mux.Handle(config.PathPrefix+"/", http.StripPrefix(config.PathPrefix, hub))
+		ps.hub = hub
+		ps.ownsHub = true
+		ps.server = &http.Server{Handler: mux}
+		go func() {
+			if err := ps.server.Serve(lis); err != nil && err != http.ErrServerClosed {
+				logger.Error("sse hub server failed", err, watermill.LogFields{"listen_addr": config.ListenAddr})
+			}
+		}()
+		return ps, nil
+	}
+
+	if config.HubURL == "" {
+		return nil, fmt.Errorf("sse driver requires a hub address in the URL host or a 'listen_addr' query parameter")
+	}
+	ps.client = http.DefaultClient
+	if client, ok := ctx.Value(httpClientKey{}).(*http.Client); ok && client != nil {
+		ps.client = client
+	}
+	return ps, nil
+}
+
+// envelope is the JSON representation of a message as it is sent through the hub.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type pubSub struct {
+	config *sseConfig
+	logger watermill.LoggerAdapter
+
+	// hub is set when this node hosts the hub; client is used to connect to a remote hub otherwise.
+	hub *Hub
+	// ownsHub is set when the driver serves the hub on listen_addr with server.
+	ownsHub bool
+	server  *http.Server
+	client  *http.Client
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish sends the messages to the hub.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		if p.hub != nil {
+			err = p.hub.broadcast(topic, data)
+		} else {
+			err = p.post(topic, data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+func (p *pubSub) post(topic string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.PublishTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.topicURL(topic), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sse hub responded with status %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *pubSub) topicURL(topic string) string {
+	return p.config.HubURL + "/" + url.PathEscape(topic)
+}
+
+// Subscribe connects to the event stream of the topic. The first connection is made before
+// Subscribe returns; if the stream breaks afterwards, the driver reconnects after reconnect_wait
+// and resumes from the last received event.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := p.connect(ctx, topic, "")
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-p.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		lastEventID := ""
+		for {
+			err := p.consume(ctx, stream, output, &lastEventID)
+			stream.close()
+			if ctx.Err() != nil || errors.Is(err, errHubClosed) {
+				return
+			}
+			p.logger.Info("sse stream interrupted, reconnecting", watermill.LogFields{
+				"topic":         topic,
+				"last_event_id": lastEventID,
+				"error":         err,
+			})
+
+			for {
+				select {
+				case <-time.After(p.config.ReconnectWait):
+				case <-ctx.Done():
+					return
+				}
+				stream, err = p.connect(ctx, topic, lastEventID)
+				if err == nil {
+					break
+				}
+				if errors.Is(err, errHubClosed) {
+					return
+				}
+				p.logger.Error("failed to reconnect to sse hub", err, watermill.LogFields{"topic": topic})
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// consume forwards the events of stream to output until the stream fails or ctx is done.
+func (p *pubSub) consume(ctx context.Context, stream eventStream, output chan<- *message.Message, lastEventID *string) error {
+	for {
+		id, data, err := stream.next(ctx)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			// The event only moves the position from which the stream is resumed.
+			setLastEventID(lastEventID, id)
+			continue
+		}
+
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			p.logger.Error("failed to unmarshal sse event", err, watermill.LogFields{"event_id": id})
+			setLastEventID(lastEventID, id)
+			continue
+		}
+		msg := message.NewMessage(env.UUID, env.Payload)
+		for k, v := range env.Metadata {
+			msg.Metadata.Set(k, v)
+		}
+
+		select {
+		case output <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-msg.Acked():
+		case <-msg.Nacked():
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		setLastEventID(lastEventID, id)
+	}
+}
+
+// setLastEventID records id as the last event ID. As in the EventSource API, events without
+// an ID keep the previous one.
+func setLastEventID(lastEventID *string, id string) {
+	if id != "" {
+		*lastEventID = id
+	}
+}
+
+// eventStream is a stream of events of a single topic.
+// An event with nil data only carries the ID from which the stream can be resumed.
+type eventStream interface {
+	next(ctx context.Context) (id string, data []byte, err error)
+	close()
+}
+
+// connect opens an event stream of the topic that starts after lastEventID.
+func (p *pubSub) connect(ctx context.Context, topic string, lastEventID string) (eventStream, error) {
+	if p.hub != nil {
+		select {
+		case <-p.hub.closed:
+			return nil, errHubClosed
+		default:
+		}
+		ch, backlog, position := p.hub.subscribe(topic, lastEventID)
+		s := &localStream{hub: p.hub, topic: topic, ch: ch, backlog: backlog}
+		if len(backlog) == 0 {
+			s.position = position
+		}
+		return s, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.topicURL(topic), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to sse hub: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("sse hub responded with status %s", resp.Status)
+	}
+	return &remoteStream{body: resp.Body, reader: bufio.NewReader(resp.Body)}, nil
+}
+
+// localStream reads the events of a Hub hosted by this node.
+type localStream struct {
+	hub      *Hub
+	topic    string
+	ch       chan event
+	backlog  []event
+	position string
+}
+
+func (s *localStream) next(ctx context.Context) (string, []byte, error) {
+	if s.position != "" {
+		position := s.position
+		s.position = ""
+		return position, nil, nil
+	}
+	if len(s.backlog) > 0 {
+		ev := s.backlog[0]
+		s.backlog = s.backlog[1:]
+		return s.hub.eventID(ev), ev.data, nil
+	}
+	select {
+	case ev, ok := <-s.ch:
+		if !ok {
+			return "", nil, errors.New("subscriber fell behind and was disconnected")
+		}
+		return s.hub.eventID(ev), ev.data, nil
+	case <-s.hub.closed:
+		return "", nil, errHubClosed
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	}
+}
+
+func (s *localStream) close() {
+	s.hub.unsubscribe(s.topic, s.ch)
+}
+
+// remoteStream parses a text/event-stream response of a remote Hub.
+type remoteStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+func (s *remoteStream) next(_ context.Context) (string, []byte, error) {
+	var id string
+	var data []byte
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// An empty line dispatches the event. Comments are skipped.
+			if id != "" || data != nil {
+				return id, data, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			id = value
+		case "data":
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+		}
+	}
+}
+
+func (s *remoteStream) close() {
+	_ = s.body.Close()
+}
+
+func (p *pubSub) Close() error {
+	var allErrors error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		if p.ownsHub {
+			ctx, cancel := context.WithTimeout(context.Background(), p.config.PublishTimeout)
+			defer cancel()
+			// Close the hub first so that the open event streams end and Shutdown does not wait for them.
+			allErrors = multierr.Append(allErrors, p.hub.Close())
+			allErrors = multierr.Append(allErrors, p.server.Shutdown(ctx))
+		}
+		p.wg.Wait()
+	})
+	return allErrors
+}
+
+type sseConfig struct {
+	HubURL            string
+	ListenAddr        string
+	PathPrefix        string
+	ReconnectWait     time.Duration
+	PublishTimeout    time.Duration
+	BufferSize        int
+	KeepAliveInterval time.Duration
+}
+
+func parseSSEURL(u *url.URL) (*sseConfig, error) {
+	query := u.Query()
+	config := &sseConfig{
+		ListenAddr:     query.Get("listen_addr"),
+		PathPrefix:     strings.TrimSuffix(query.Get("path_prefix"), "/"),
+		ReconnectWait:  time.Second,
+		PublishTimeout: 10 * time.Second,
+	}
+
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		config.PathPrefix = "/" + config.PathPrefix
+	}
+
+	var err error
+	useTLS := false
+	if t := query.Get("tls"); t != "" {
+		useTLS, err = strconv.ParseBool(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'tls' param: %w", err)
+		}
+	}
+	if u.Host != "" {
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		config.HubURL = fmt.Sprintf("%s://%s%s", scheme, u.Host, config.PathPrefix)
+	}
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		config.ReconnectWait, err = time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+	}
+	if pt := query.Get("publish_timeout"); pt != "" {
+		config.PublishTimeout, err = time.ParseDuration(pt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'publish_timeout' param: %w", err)
+		}
+	}
+	if bs := query.Get("buffer_size"); bs != "" {
+		config.BufferSize, err = strconv.Atoi(bs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'buffer_size' param: %w", err)
+		}
+	}
+	if ka := query.Get("keep_alive"); ka != "" {
+		config.KeepAliveInterval, err = time.ParseDuration(ka)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'keep_alive' param: %w", err)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,303 @@
+package sse
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errHubClosed = errors.New("sse hub is closed")
+
+// Default settings of the Hub.
+const (
+	DefaultBufferSize        = 256
+	DefaultKeepAliveInterval = 15 * time.Second
+	DefaultMaxMessageSize    = 1 << 20
+	// subscriberQueueSize is the number of events queued for a slow subscriber before it is disconnected.
+	subscriberQueueSize = 64
+)
+
+// HubConfig holds the configuration of a Hub.
+type HubConfig struct {
+	// BufferSize is the number of recent events kept per topic to resume subscribers by Last-Event-ID.
+	BufferSize int
+	// KeepAliveInterval is how often a comment is sent on idle streams to keep intermediaries from closing them.
+	KeepAliveInterval time.Duration
+	// MaxMessageSize is the maximum size of the body of a publish request.
+	MaxMessageSize int64
+}
+
+// event is a single published message together with the sequence number assigned by the hub.
+type event struct {
+	seq  uint64
+	data []byte
+}
+
+// topic holds the recent events and the connected subscribers of a single topic.
+type topic struct {
+	events      []event
+	subscribers map[chan event]struct{}
+}
+
+// Hub relays messages between watchers over Server-Sent Events.
+// Watchers publish with POST /<topic> and subscribe with GET /<topic>.
+// The Hub implements http.Handler and can be mounted on any HTTP server;
+// use http.StripPrefix to serve it below a path prefix.
+type Hub struct {
+	config HubConfig
+
+	// epoch distinguishes the event IDs of this Hub from those of a previous instance,
+	// so that subscribers resuming after a restart of the Hub do not skip events.
+	epoch int64
+
+	mu      sync.Mutex
+	lastSeq uint64
+	topics  map[string]*topic
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewHub creates a new Hub.
+func NewHub(config HubConfig) *Hub {
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultBufferSize
+	}
+	if config.KeepAliveInterval <= 0 {
+		config.KeepAliveInterval = DefaultKeepAliveInterval
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return &Hub{
+		config: config,
+		epoch:  time.Now().UnixNano(),
+		topics: make(map[string]*topic),
+		closed: make(chan struct{}),
+	}
+}
+
+// ServeHTTP handles publish (POST) and subscribe (GET) requests.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.URL.Path, "/")
+	if name == "" {
+		http.Error(w, "topic is not specified", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		h.handlePublish(w, r, name)
+	case http.MethodGet:
+		h.handleSubscribe(w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Close disconnects all subscribers. Subsequent requests are rejected.
+func (h *Hub) Close() error {
+	h.once.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
+
+func (h *Hub) handlePublish(w http.ResponseWriter, r *http.Request, name string) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.config.MaxMessageSize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The data is sent as a single "data:" line, so JSON spread over several lines is compacted first.
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, data); err != nil {
+		http.Error(w, "invalid message envelope", http.StatusBadRequest)
+		return
+	}
+	if err := h.broadcast(name, compacted.Bytes()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// broadcast stores the data as a new event of the topic and sends it to all subscribers.
+// Subscribers that cannot keep up are disconnected; they resume from their last event ID on reconnect.
+func (h *Hub) broadcast(name string, data []byte) error {
+	select {
+	case <-h.closed:
+		return errHubClosed
+	default:
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastSeq++
+	ev := event{seq: h.lastSeq, data: data}
+	t := h.topic(name)
+	t.events = append(t.events, ev)
+	if len(t.events) > h.config.BufferSize {
+		t.events = t.events[len(t.events)-h.config.BufferSize:]
+	}
+	for ch := range t.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			delete(t.subscribers, ch)
+			close(ch)
+		}
+	}
+	return nil
+}
+
+// topic returns the state of the named topic, creating it if needed. h.mu must be held.
+func (h *Hub) topic(name string) *topic {
+	t, ok := h.topics[name]
+	if !ok {
+		t = &topic{subscribers: make(map[chan event]struct{})}
+		h.topics[name] = t
+	}
+	return t
+}
+
+// subscribe registers a new subscriber. If lastEventID is not empty, the buffered events
+// published after it are returned as well; an ID issued by another instance of the Hub
+// resumes from the oldest buffered event. The returned position is the ID of the latest
+// event of the Hub, from which the subscriber can resume if it has not received any event yet.
+func (h *Hub) subscribe(name string, lastEventID string) (ch chan event, backlog []event, position string) {
+	var after uint64
+	if lastEventID != "" {
+		if epoch, seq, ok := parseEventID(lastEventID); ok && epoch == h.epoch {
+			after = seq
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(name)
+	ch = make(chan event, subscriberQueueSize)
+	t.subscribers[ch] = struct{}{}
+
+	if lastEventID != "" {
+		for _, ev := range t.events {
+			if ev.seq > after {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	return ch, backlog, h.eventID(event{seq: h.lastSeq})
+}
+
+func (h *Hub) unsubscribe(name string, ch chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t := h.topic(name)
+	if _, ok := t.subscribers[ch]; ok {
+		delete(t.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (h *Hub) handleSubscribe(w http.ResponseWriter, r *http.Request, name string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-h.closed:
+		http.Error(w, errHubClosed.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	ch, backlog, position := h.subscribe(name, r.Header.Get("Last-Event-ID"))
+	defer h.unsubscribe(name, ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, ev := range backlog {
+		if err := h.writeEvent(w, ev); err != nil {
+			return
+		}
+	}
+	if len(backlog) == 0 {
+		// An event without data only sets the last event ID of the client.
+		if _, err := fmt.Fprintf(w, "id: %s\n\n", position); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(h.config.KeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				// The subscriber was too slow and has been disconnected.
+				return
+			}
+			if err := h.writeEvent(w, ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.closed:
+			return
+		}
+	}
+}
+
+// writeEvent writes ev in the text/event-stream format. The data is a single line of JSON.
+func (h *Hub) writeEvent(w io.Writer, ev event) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", h.eventID(ev), ev.data)
+	return err
+}
+
+// eventID returns the ID of ev in the form "<epoch>-<sequence>".
+func (h *Hub) eventID(ev event) string {
+	return strconv.FormatInt(h.epoch, 10) + "-" + strconv.FormatUint(ev.seq, 10)
+}
+
+func parseEventID(id string) (epoch int64, seq uint64, ok bool) {
+	e, s, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	epoch, err := strconv.ParseInt(e, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return epoch, seq, true
+}
@@ -0,0 +1,469 @@
+package unix
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"go.uber.org/multierr"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("unix", &Driver{})
+}
+
+// Driver implements the watcher.Driver interface for Unix domain sockets.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub for Unix domain sockets.
+// If listen is set, this process hosts the hub on the socket at path. Otherwise, the process
+// connects to the hub at path and joins the room of each topic it subscribes to, reconnecting
+// when the connection is lost.
+func (d *Driver) NewPubSub(_ context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseUnixURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse unix url: %w", err)
+	}
+
+	ps := &pubSub{
+		config:     config,
+		logger:     logger,
+		publishers: make(map[string]net.Conn),
+		closed:     make(chan struct{}),
+	}
+
+	if config.Listen {
+		ps.hub, err = listen(config, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on unix socket: %w", err)
+		}
+	}
+	return ps, nil
+}
+
+// envelope is the JSON representation of a message as it is sent through the hub.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type pubSub struct {
+	config *unixConfig
+	logger watermill.LoggerAdapter
+
+	// hub is set when this process hosts the hub.
+	hub *hub
+
+	// publishers holds the connections used to publish to each topic of a remote hub.
+	publishersMu sync.Mutex
+	publishers   map[string]net.Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish sends the messages to the room of the topic.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		if p.hub != nil {
+			err = p.hub.broadcast(topic, data)
+		} else {
+			err = p.send(topic, append(data, '\n'))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// send writes data to the publisher connection of the topic. If the connection has been lost,
+// a new one is established and the write is retried once.
+func (p *pubSub) send(topic string, data []byte) error {
+	p.publishersMu.Lock()
+	defer p.publishersMu.Unlock()
+
+	select {
+	case <-p.closed:
+		return errors.New("unix socket pubsub is closed")
+	default:
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, ok := p.publishers[topic]
+		if !ok {
+			conn, err = p.dialPublisher(topic)
+			if err != nil {
+				return err
+			}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(p.config.WriteTimeout))
+		if _, err = conn.Write(data); err == nil {
+			return nil
+		}
+		delete(p.publishers, topic)
+		_ = conn.Close()
+	}
+	return err
+}
+
+// dialPublisher connects to the hub as a publisher of the topic. p.publishersMu must be held.
+func (p *pubSub) dialPublisher(topic string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.WriteTimeout)
+	defer cancel()
+
+	conn, err := p.dial(ctx, topic, true)
+	if err != nil {
+		return nil, err
+	}
+	p.publishers[topic] = conn
+
+	// The hub sends nothing to publishers, so reading only returns when the connection is closed.
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		var buf [1]byte
+		for {
+			if _, err := conn.Read(buf[:]); err != nil {
+				break
+			}
+		}
+		p.publishersMu.Lock()
+		if p.publishers[topic] == conn {
+			delete(p.publishers, topic)
+		}
+		p.publishersMu.Unlock()
+		_ = conn.Close()
+	}()
+	return conn, nil
+}
+
+// dial checks the socket file and connects to the room of the topic on the hub.
+func (p *pubSub) dial(ctx context.Context, topic string, publisher bool) (net.Conn, error) {
+	if err := checkSocket(p.config.Path, p.config.Owner); err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "unix", p.config.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to unix socket hub: %w", err)
+	}
+	data, err := json.Marshal(hello{Topic: topic, Publisher: publisher})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(p.config.WriteTimeout))
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to join unix socket hub: %w", err)
+	}
+	return conn, nil
+}
+
+// checkSocket verifies that path is a socket owned by this user, by root or by owner, so that
+// a watcher does not connect to a socket planted by another user in a shared directory.
+func checkSocket(path string, owner int) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("%s is not a socket", path)
+	}
+	uid, ok := fileOwner(fi)
+	if !ok {
+		return nil
+	}
+	if uid != os.Getuid() && uid != 0 && uid != owner {
+		return fmt.Errorf("%s is owned by uid %d, which is not trusted", path, uid)
+	}
+	return nil
+}
+
+// Subscribe joins the room of the topic. The first connection is made before Subscribe returns;
+// if it is lost afterwards, the driver reconnects after reconnect_wait. Messages published while
+// the watcher is disconnected are not delivered.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	if p.hub != nil {
+		return p.subscribeLocal(ctx, topic)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	conn, err := p.dial(ctx, topic, false)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-p.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			err := p.consume(ctx, conn, output)
+			if ctx.Err() != nil {
+				return
+			}
+			p.logger.Info("unix socket connection lost, reconnecting", watermill.LogFields{
+				"topic": topic,
+				"error": err,
+			})
+
+			for {
+				select {
+				case <-time.After(p.config.ReconnectWait):
+				case <-ctx.Done():
+					return
+				}
+				conn, err = p.dial(ctx, topic, false)
+				if err == nil {
+					break
+				}
+				p.logger.Error("failed to reconnect to unix socket hub", err, watermill.LogFields{"topic": topic})
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// consume forwards the messages of conn to output until the connection fails or ctx is done.
+// It closes conn when it returns.
+func (p *pubSub) consume(ctx context.Context, conn net.Conn, output chan<- *message.Message) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		_ = conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+	for scanner.Scan() {
+		if err := p.deliver(ctx, scanner.Bytes(), output); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("connection closed by hub")
+}
+
+// subscribeLocal joins the room of the topic on the hub hosted by this process.
+func (p *pubSub) subscribeLocal(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	select {
+	case <-p.hub.closed:
+		return nil, errHubClosed
+	default:
+	}
+	m := p.hub.join(topic)
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer func() {
+			p.hub.leave(topic, m)
+		}()
+
+		for {
+			select {
+			case data, ok := <-m.send:
+				if !ok {
+					p.logger.Info("subscriber fell behind, rejoining", watermill.LogFields{"topic": topic})
+					m = p.hub.join(topic)
+					continue
+				}
+				if err := p.deliver(ctx, data, output); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			case <-p.hub.closed:
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// deliver decodes data and sends it to output, waiting until it is acknowledged.
+// Messages that cannot be decoded are logged and skipped.
+func (p *pubSub) deliver(ctx context.Context, data []byte, output chan<- *message.Message) error {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		p.logger.Error("failed to unmarshal unix socket message", err, nil)
+		return nil
+	}
+	msg := message.NewMessage(env.UUID, env.Payload)
+	for k, v := range env.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closed:
+		return errors.New("unix socket pubsub is closed")
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closed:
+		return errors.New("unix socket pubsub is closed")
+	}
+	return nil
+}
+
+func (p *pubSub) Close() error {
+	var allErrors error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+
+		p.publishersMu.Lock()
+		for topic, conn := range p.publishers {
+			allErrors = multierr.Append(allErrors, conn.Close())
+			delete(p.publishers, topic)
+		}
+		p.publishersMu.Unlock()
+
+		if p.hub != nil {
+			allErrors = multierr.Append(allErrors, p.hub.Close())
+		}
+		p.wg.Wait()
+	})
+	return allErrors
+}
+
+type unixConfig struct {
+	Path   string
+	Listen bool
+	// Mode and Group are applied to the socket file created by the hub. Group is -1 if not set.
+	Mode  os.FileMode
+	Group int
+	// Owner is a uid, besides this user and root, that may own the socket a client connects to. It is -1 if not set.
+	Owner         int
+	ReconnectWait time.Duration
+	WriteTimeout  time.Duration
+}
+
+func parseUnixURL(u *url.URL) (*unixConfig, error) {
+	query := u.Query()
+	config := &unixConfig{
+		Path:          query.Get("path"),
+		Mode:          0o600,
+		Group:         -1,
+		Owner:         -1,
+		ReconnectWait: time.Second,
+		WriteTimeout:  10 * time.Second,
+	}
+	if config.Path == "" {
+		return nil, fmt.Errorf("unix driver requires a socket file in the 'path' query parameter")
+	}
+
+	var err error
+	if l := query.Get("listen"); l != "" {
+		config.Listen, err = strconv.ParseBool(l)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'listen' param: %w", err)
+		}
+	}
+	if m := query.Get("mode"); m != "" {
+		val, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'mode' param: %w", err)
+		}
+		if val&^0o777 != 0 {
+			return nil, fmt.Errorf("invalid 'mode' param: only permission bits may be set")
+		}
+		config.Mode = os.FileMode(val)
+	}
+	if g := query.Get("group"); g != "" {
+		gid, err := strconv.Atoi(g)
+		if err != nil {
+			group, lookupErr := user.LookupGroup(g)
+			if lookupErr != nil {
+				return nil, fmt.Errorf("invalid 'group' param: %w", lookupErr)
+			}
+			if gid, err = strconv.Atoi(group.Gid); err != nil {
+				return nil, fmt.Errorf("invalid 'group' param: %w", err)
+			}
+		}
+		config.Group = gid
+	}
+	if o := query.Get("owner"); o != "" {
+		uid, err := strconv.Atoi(o)
+		if err != nil {
+			owner, lookupErr := user.Lookup(o)
+			if lookupErr != nil {
+				return nil, fmt.Errorf("invalid 'owner' param: %w", lookupErr)
+			}
+			if uid, err = strconv.Atoi(owner.Uid); err != nil {
+				return nil, fmt.Errorf("invalid 'owner' param: %w", err)
+			}
+		}
+		config.Owner = uid
+	}
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		config.ReconnectWait, err = time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+	}
+	if wt := query.Get("write_timeout"); wt != "" {
+		config.WriteTimeout, err = time.ParseDuration(wt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'write_timeout' param: %w", err)
+		}
+	}
+
+	return config, nil
+}
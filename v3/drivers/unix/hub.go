@@ -0,0 +1,276 @@
+package unix
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+)
+
+var errHubClosed = errors.New("unix socket hub is closed")
+
+const (
+	// maxMessageSize is the maximum size of a line sent over a connection.
+	maxMessageSize = 1 << 20
+	// memberQueueSize is the number of messages queued for a slow member before it is disconnected.
+	memberQueueSize = 256
+)
+
+// hello is the first line a client sends on a connection. It selects the topic, and whether the connection
+// only publishes or joins the room of the topic.
+type hello struct {
+	Topic     string `json:"topic"`
+	Publisher bool   `json:"publisher,omitempty"`
+}
+
+// member is a watcher that receives the messages of a room.
+type member struct {
+	send chan []byte
+}
+
+// hub relays messages between the watchers connected to its socket. Every message sent on a connection is relayed
+// to all members of the room of the connection's topic, including the sender.
+type hub struct {
+	listener     net.Listener
+	path         string
+	info         os.FileInfo
+	writeTimeout time.Duration
+	logger       watermill.LoggerAdapter
+
+	mu     sync.Mutex
+	rooms  map[string]map[*member]struct{}
+	conns  map[net.Conn]struct{}
+	closed chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// listen creates the socket of the hub at config.Path with the configured mode and group. The socket is created
+// under a temporary name and renamed once its permissions are set, so that it is never reachable with others.
+// A socket left behind by a hub that is gone is replaced; a socket that a hub still listens on is not.
+func listen(config *unixConfig, logger watermill.LoggerAdapter) (*hub, error) {
+	if fi, err := os.Lstat(config.Path); err == nil {
+		if fi.Mode().Type() != os.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", config.Path)
+		}
+		if conn, err := net.DialTimeout("unix", config.Path, config.WriteTimeout); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("another hub is listening on %s", config.Path)
+		}
+	}
+
+	tmpPath := filepath.Join(filepath.Dir(config.Path), "."+filepath.Base(config.Path)+"."+watermill.NewShortUUID())
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket file is renamed, so the listener must not remove it under its old name when it is closed.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	fail := func(err error) (*hub, error) {
+		_ = listener.Close()
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+	if err := os.Chmod(tmpPath, config.Mode); err != nil {
+		return fail(err)
+	}
+	if config.Group >= 0 {
+		if err := os.Lchown(tmpPath, -1, config.Group); err != nil {
+			return fail(err)
+		}
+	}
+	if err := os.Rename(tmpPath, config.Path); err != nil {
+		return fail(err)
+	}
+	info, err := os.Lstat(config.Path)
+	if err != nil {
+		return fail(err)
+	}
+
+	h := &hub{
+		listener:     listener,
+		path:         config.Path,
+		info:         info,
+		writeTimeout: config.WriteTimeout,
+		logger:       logger,
+		rooms:        make(map[string]map[*member]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+		closed:       make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go h.serve()
+	return h, nil
+}
+
+// serve accepts connections until the hub is closed.
+func (h *hub) serve() {
+	defer h.wg.Done()
+	for {
+		conn, err := h.listener.Accept()
+		if err != nil {
+			select {
+			case <-h.closed:
+				return
+			default:
+			}
+			h.logger.Error("unix socket hub failed to accept a connection", err, watermill.LogFields{"path": h.path})
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		h.mu.Lock()
+		h.conns[conn] = struct{}{}
+		h.mu.Unlock()
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			h.handle(conn)
+			h.mu.Lock()
+			delete(h.conns, conn)
+			h.mu.Unlock()
+		}()
+	}
+}
+
+// handle reads the hello of conn, joins the room of its topic unless it is a publisher, and relays the messages
+// of conn to the room until the connection fails.
+func (h *hub) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxMessageSize)
+	if !scanner.Scan() {
+		return
+	}
+	var hi hello
+	if err := json.Unmarshal(scanner.Bytes(), &hi); err != nil || hi.Topic == "" {
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if !hi.Publisher {
+		m := h.join(hi.Topic)
+		defer h.leave(hi.Topic, m)
+		go h.writePump(conn, m, done)
+	}
+
+	for scanner.Scan() {
+		data := scanner.Bytes()
+		if !json.Valid(data) {
+			continue
+		}
+		if err := h.broadcast(hi.Topic, data); err != nil {
+			return
+		}
+	}
+}
+
+// writePump sends the queued messages of m to conn. It closes conn when it returns, which also ends handle.
+func (h *hub) writePump(conn net.Conn, m *member, done <-chan struct{}) {
+	defer conn.Close()
+	for {
+		select {
+		case data, ok := <-m.send:
+			if !ok {
+				// The member was too slow and has been removed from the room.
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+			if _, err := conn.Write(data); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// join adds a new member to the room of topic.
+func (h *hub) join(topic string) *member {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, ok := h.rooms[topic]
+	if !ok {
+		room = make(map[*member]struct{})
+		h.rooms[topic] = room
+	}
+	m := &member{send: make(chan []byte, memberQueueSize)}
+	room[m] = struct{}{}
+	return m
+}
+
+// leave removes m from the room of topic and closes its queue, unless it has been removed already.
+func (h *hub) leave(topic string, m *member) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(topic, m)
+}
+
+// remove removes m from the room of topic. h.mu must be held.
+func (h *hub) remove(topic string, m *member) {
+	room := h.rooms[topic]
+	if _, ok := room[m]; !ok {
+		return
+	}
+	delete(room, m)
+	close(m.send)
+	if len(room) == 0 {
+		delete(h.rooms, topic)
+	}
+}
+
+// broadcast sends a copy of data, terminated by a newline, to all members of the room of topic.
+// Members that cannot keep up are disconnected.
+func (h *hub) broadcast(topic string, data []byte) error {
+	select {
+	case <-h.closed:
+		return errHubClosed
+	default:
+	}
+	line := make([]byte, len(data)+1)
+	copy(line, data)
+	line[len(data)] = '\n'
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for m := range h.rooms[topic] {
+		select {
+		case m.send <- line:
+		default:
+			h.remove(topic, m)
+		}
+	}
+	return nil
+}
+
+// Close stops accepting connections, disconnects all clients and removes the socket file, unless it has been
+// replaced by another hub.
+func (h *hub) Close() error {
+	var err error
+	h.once.Do(func() {
+		close(h.closed)
+		err = h.listener.Close()
+		if fi, statErr := os.Lstat(h.path); statErr == nil && os.SameFile(fi, h.info) {
+			_ = os.Remove(h.path)
+		}
+
+		h.mu.Lock()
+		for conn := range h.conns {
+			_ = conn.Close()
+		}
+		h.mu.Unlock()
+		h.wg.Wait()
+	})
+	return err
+}
@@ -0,0 +1,508 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gorilla/websocket"
+	"go.uber.org/multierr"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("ws", &Driver{})
+	watcher.RegisterDriver("wss", &Driver{})
+}
+
+type hubKey struct{}
+
+type dialerKey struct{}
+
+// WithHub returns a context carrying a Hub that the application serves on its own HTTP server.
+// When passed to watcher.NewWatcher, the driver publishes to and subscribes from hub directly.
+func WithHub(ctx context.Context, hub *Hub) context.Context {
+	return context.WithValue(ctx, hubKey{}, hub)
+}
+
+// WithDialer returns a context carrying the websocket.Dialer used to connect to a remote Hub,
+// for example to configure TLS client certificates or a proxy.
+func WithDialer(ctx context.Context, dialer *websocket.Dialer) context.Context {
+	return context.WithValue(ctx, dialerKey{}, dialer)
+}
+
+// Driver implements the watcher.Driver interface for WebSockets.
+type Driver struct{}
+
+// NewPubSub creates a new PubSub for WebSockets.
+// If listen_addr is set or a Hub is supplied through WithHub, this node hosts the hub.
+// Otherwise, the node connects to the hub at the URL host and joins the room of each
+// topic it subscribes to, reconnecting when the connection is lost.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseWSURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ws url: %w", err)
+	}
+
+	ps := &pubSub{
+		config:     config,
+		logger:     logger,
+		publishers: make(map[string]*websocket.Conn),
+		closed:     make(chan struct{}),
+	}
+
+	if hub, ok := ctx.Value(hubKey{}).(*Hub); ok && hub != nil {
+		ps.hub = hub
+		return ps, nil
+	}
+
+	if config.ListenAddr != "" {
+		// The address is bound before NewPubSub returns, so that an address in use is reported to the caller.
+		lis, err := net.Listen("tcp", config.ListenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %w", config.ListenAddr, err)
+		}
+		hub := NewHub(HubConfig{
+			PingInterval: config.PingInterval,
+			WriteTimeout: config.WriteTimeout,
+		})
+		mux := http.NewServeMux()
+		mux.Handle(config.PathPrefix+"/", http.StripPrefix(config.PathPrefix, hub))
+		ps.hub = hub
+		ps.ownsHub = true
+		ps.server = &http.Server{Handler: mux}
+		go func() {
+			if err := ps.server.Serve(lis); err != nil && err != http.ErrServerClosed {
+				logger.Error("websocket hub server failed", err, watermill.LogFields{"listen_addr": config.ListenAddr})
+			}
+		}()
+		return ps, nil
+	}
+
+	if config.HubURL == "" {
+		return nil, fmt.Errorf("ws driver requires a hub address in the URL host or a 'listen_addr' query parameter")
+	}
+	ps.dialer = websocket.DefaultDialer
+	if dialer, ok := ctx.Value(dialerKey{}).(*websocket.Dialer); ok && dialer != nil {
+		ps.dialer = dialer
+	}
+	return ps, nil
+}
+
+// envelope is the JSON representation of a message as it is sent through the hub.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+type pubSub struct {
+	config *wsConfig
+	logger watermill.LoggerAdapter
+
+	// hub is set when this node hosts the hub; dialer is used to connect to a remote hub otherwise.
+	hub *Hub
+	// ownsHub is set when the driver serves the hub on listen_addr with server.
+	ownsHub bool
+	server  *http.Server
+	dialer  *websocket.Dialer
+
+	// publishers holds the connections used to publish to each topic of a remote hub.
+	publishersMu sync.Mutex
+	publishers   map[string]*websocket.Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Publish sends the messages to the room of the topic.
+func (p *pubSub) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+		if p.hub != nil {
+			err = p.hub.broadcast(topic, data)
+		} else {
+			err = p.send(topic, data)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to publish message %s: %w", msg.UUID, err)
+		}
+	}
+	return nil
+}
+
+// send writes data to the publisher connection of the topic. If the connection has been lost,
+// a new one is established and the write is retried once.
+func (p *pubSub) send(topic string, data []byte) error {
+	p.publishersMu.Lock()
+	defer p.publishersMu.Unlock()
+
+	select {
+	case <-p.closed:
+		return errors.New("websocket pubsub is closed")
+	default:
+	}
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, ok := p.publishers[topic]
+		if !ok {
+			conn, err = p.dialPublisher(topic)
+			if err != nil {
+				return err
+			}
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(p.config.WriteTimeout))
+		if err = conn.WriteMessage(websocket.TextMessage, data); err == nil {
+			return nil
+		}
+		delete(p.publishers, topic)
+		_ = conn.Close()
+	}
+	return err
+}
+
+// dialPublisher connects to the hub as a publisher of the topic. p.publishersMu must be held.
+func (p *pubSub) dialPublisher(topic string) (*websocket.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.WriteTimeout)
+	defer cancel()
+
+	conn, err := p.dial(ctx, topic, true)
+	if err != nil {
+		return nil, err
+	}
+	p.publishers[topic] = conn
+
+	// The hub sends no messages to publishers, but the connection must be read to answer pings
+	// and to notice when it is closed.
+	stopKeepAlive := p.keepAlive(conn)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer stopKeepAlive()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				break
+			}
+		}
+		p.publishersMu.Lock()
+		if p.publishers[topic] == conn {
+			delete(p.publishers, topic)
+		}
+		p.publishersMu.Unlock()
+		_ = conn.Close()
+	}()
+	return conn, nil
+}
+
+// dial connects to the room of the topic on the remote hub.
+func (p *pubSub) dial(ctx context.Context, topic string, publisher bool) (*websocket.Conn, error) {
+	target := p.config.HubURL + "/" + url.PathEscape(topic)
+	if publisher {
+		target += "?role=publisher"
+	}
+	conn, resp, err := p.dialer.DialContext(ctx, target, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("failed to connect to websocket hub: %w (status %s)", err, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to websocket hub: %w", err)
+	}
+
+	// The watcher pings the hub every ping_interval (see keepAlive); without a pong or a ping of the hub for two
+	// intervals the connection is considered lost. This does not depend on the ping interval of the hub.
+	pongWait := 2 * p.config.PingInterval
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	conn.SetPingHandler(func(appData string) error {
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+		err := conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(p.config.WriteTimeout))
+		if errors.Is(err, websocket.ErrCloseSent) {
+			return nil
+		}
+		return err
+	})
+	return conn, nil
+}
+
+// keepAlive pings the hub on conn every ping_interval until the returned function is called.
+func (p *pubSub) keepAlive(conn *websocket.Conn) (stop func()) {
+	done := make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(p.config.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(p.config.WriteTimeout)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Subscribe joins the room of the topic. The first connection is made before Subscribe returns;
+// if it is lost afterwards, the driver reconnects after reconnect_wait. Messages published while
+// the watcher is disconnected are not delivered.
+func (p *pubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	if p.hub != nil {
+		return p.subscribeLocal(ctx, topic)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	conn, err := p.dial(ctx, topic, false)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer cancel()
+
+		go func() {
+			select {
+			case <-p.closed:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		for {
+			err := p.consume(ctx, conn, output)
+			if ctx.Err() != nil {
+				return
+			}
+			p.logger.Info("websocket connection lost, reconnecting", watermill.LogFields{
+				"topic": topic,
+				"error": err,
+			})
+
+			for {
+				select {
+				case <-time.After(p.config.ReconnectWait):
+				case <-ctx.Done():
+					return
+				}
+				conn, err = p.dial(ctx, topic, false)
+				if err == nil {
+					break
+				}
+				p.logger.Error("failed to reconnect to websocket hub", err, watermill.LogFields{"topic": topic})
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// consume forwards the messages of conn to output until the connection fails or ctx is done.
+// It closes conn when it returns.
+func (p *pubSub) consume(ctx context.Context, conn *websocket.Conn, output chan<- *message.Message) error {
+	defer p.keepAlive(conn)()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(p.config.WriteTimeout))
+			_ = conn.Close()
+		case <-stop:
+			_ = conn.Close()
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if err := p.deliver(ctx, data, output); err != nil {
+			return err
+		}
+	}
+}
+
+// subscribeLocal joins the room of the topic on the hub hosted by this node.
+func (p *pubSub) subscribeLocal(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	select {
+	case <-p.hub.closed:
+		return nil, errHubClosed
+	default:
+	}
+	m := p.hub.join(topic)
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+		defer func() {
+			p.hub.leave(topic, m)
+		}()
+
+		for {
+			select {
+			case data, ok := <-m.send:
+				if !ok {
+					p.logger.Info("subscriber fell behind, rejoining", watermill.LogFields{"topic": topic})
+					m = p.hub.join(topic)
+					continue
+				}
+				if err := p.deliver(ctx, data, output); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			case <-p.hub.closed:
+				return
+			}
+		}
+	}()
+
+	return output, nil
+}
+
+// deliver decodes data and sends it to output, waiting until it is acknowledged.
+// Messages that cannot be decoded are logged and skipped.
+func (p *pubSub) deliver(ctx context.Context, data []byte, output chan<- *message.Message) error {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		p.logger.Error("failed to unmarshal websocket message", err, nil)
+		return nil
+	}
+	msg := message.NewMessage(env.UUID, env.Payload)
+	for k, v := range env.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closed:
+		return errors.New("websocket pubsub is closed")
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.closed:
+		return errors.New("websocket pubsub is closed")
+	}
+	return nil
+}
+
+func (p *pubSub) Close() error {
+	var allErrors error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+
+		p.publishersMu.Lock()
+		for topic, conn := range p.publishers {
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(p.config.WriteTimeout))
+			allErrors = multierr.Append(allErrors, conn.Close())
+			delete(p.publishers, topic)
+		}
+		p.publishersMu.Unlock()
+
+		if p.ownsHub {
+			ctx, cancel := context.WithTimeout(context.Background(), p.config.WriteTimeout)
+			defer cancel()
+			// Close the hub first so that the open connections end and Shutdown does not wait for them.
+			allErrors = multierr.Append(allErrors, p.hub.Close())
+			allErrors = multierr.Append(allErrors, p.server.Shutdown(ctx))
+		}
+		p.wg.Wait()
+	})
+	return allErrors
+}
+
+type wsConfig struct {
+	HubURL        string
+	ListenAddr    string
+	PathPrefix    string
+	ReconnectWait time.Duration
+	PingInterval  time.Duration
+	WriteTimeout  time.Duration
+}
+
+func parseWSURL(u *url.URL) (*wsConfig, error) {
+	query := u.Query()
+	config := &wsConfig{
+		ListenAddr:    query.Get("listen_addr"),
+		PathPrefix:    strings.TrimSuffix(query.Get("path_prefix"), "/"),
+		ReconnectWait: time.Second,
+		PingInterval:  DefaultPingInterval,
+		WriteTimeout:  DefaultWriteTimeout,
+	}
+
+	if config.PathPrefix != "" && !strings.HasPrefix(config.PathPrefix, "/") {
+		config.PathPrefix = "/" + config.PathPrefix
+	}
+	if u.Host != "" {
+		config.HubURL = fmt.Sprintf("%s://%s%s", u.Scheme, u.Host, config.PathPrefix)
+	}
+
+	var err error
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		config.ReconnectWait, err = time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+	}
+	if pi := query.Get("ping_interval"); pi != "" {
+		config.PingInterval, err = time.ParseDuration(pi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'ping_interval' param: %w", err)
+		}
+		if config.PingInterval <= 0 {
+			return nil, fmt.Errorf("invalid 'ping_interval' param: must be positive")
+		}
+	}
+	if wt := query.Get("write_timeout"); wt != "" {
+		config.WriteTimeout, err = time.ParseDuration(wt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'write_timeout' param: %w", err)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,242 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errHubClosed = errors.New("websocket hub is closed")
+
+// Default settings of the Hub.
+const (
+	DefaultPingInterval   = 30 * time.Second
+	DefaultWriteTimeout   = 10 * time.Second
+	DefaultMaxMessageSize = 1 << 20
+	// memberQueueSize is the number of messages queued for a slow member before it is disconnected.
+	memberQueueSize = 256
+)
+
+// HubConfig holds the configuration of a Hub.
+type HubConfig struct {
+	// PingInterval is how often the Hub pings its members. A member that does not answer
+	// within two intervals is disconnected.
+	PingInterval time.Duration
+	// WriteTimeout is the maximum time a write to a member may take.
+	WriteTimeout time.Duration
+	// MaxMessageSize is the maximum size of a message published by a member.
+	MaxMessageSize int64
+	// CheckOrigin decides whether a connection from a browser is accepted.
+	// If nil, only same-origin requests are accepted; clients that send no Origin header are always accepted.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// member is a watcher that receives the messages of a room.
+type member struct {
+	send chan []byte
+}
+
+// Hub relays messages between watchers connected over WebSockets.
+// A watcher connects to /<topic> to join the room of the topic: every message it sends is
+// relayed to all members of the room, including itself. Connections made with the query
+// parameter role=publisher only send messages and do not join the room.
+// The Hub implements http.Handler and can be mounted on any HTTP server;
+// use http.StripPrefix to serve it below a path prefix.
+type Hub struct {
+	config   HubConfig
+	upgrader websocket.Upgrader
+
+	mu     sync.Mutex
+	rooms  map[string]map[*member]struct{}
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewHub creates a new Hub.
+func NewHub(config HubConfig) *Hub {
+	if config.PingInterval <= 0 {
+		config.PingInterval = DefaultPingInterval
+	}
+	if config.WriteTimeout <= 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return &Hub{
+		config:   config,
+		upgrader: websocket.Upgrader{CheckOrigin: config.CheckOrigin},
+		rooms:    make(map[string]map[*member]struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and joins the room of the topic in the path.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	topic := strings.Trim(r.URL.Path, "/")
+	if topic == "" {
+		http.Error(w, "topic is not specified", http.StatusNotFound)
+		return
+	}
+	select {
+	case <-h.closed:
+		http.Error(w, errHubClosed.Error(), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already replied with an error.
+		return
+	}
+	conn.SetReadLimit(h.config.MaxMessageSize)
+
+	var m *member
+	if r.URL.Query().Get("role") != "publisher" {
+		m = h.join(topic)
+	}
+	done := make(chan struct{})
+	go h.writePump(conn, m, done)
+	h.readPump(conn, topic)
+	close(done)
+	if m != nil {
+		h.leave(topic, m)
+	}
+}
+
+// Close disconnects all members. Subsequent connections are rejected.
+func (h *Hub) Close() error {
+	h.once.Do(func() {
+		close(h.closed)
+	})
+	return nil
+}
+
+// join adds a new member to the room of topic.
+func (h *Hub) join(topic string) *member {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, ok := h.rooms[topic]
+	if !ok {
+		room = make(map[*member]struct{})
+		h.rooms[topic] = room
+	}
+	m := &member{send: make(chan []byte, memberQueueSize)}
+	room[m] = struct{}{}
+	return m
+}
+
+// leave removes m from the room of topic and closes its queue, unless it has been removed already.
+func (h *Hub) leave(topic string, m *member) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(topic, m)
+}
+
+// remove removes m from the room of topic. h.mu must be held.
+func (h *Hub) remove(topic string, m *member) {
+	room := h.rooms[topic]
+	if _, ok := room[m]; !ok {
+		return
+	}
+	delete(room, m)
+	close(m.send)
+	if len(room) == 0 {
+		delete(h.rooms, topic)
+	}
+}
+
+// broadcast sends data to all members of the room of topic.
+// Members that cannot keep up are disconnected.
+func (h *Hub) broadcast(topic string, data []byte) error {
+	select {
+	case <-h.closed:
+		return errHubClosed
+	default:
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for m := range h.rooms[topic] {
+		select {
+		case m.send <- data:
+		default:
+			h.remove(topic, m)
+		}
+	}
+	return nil
+}
+
+// readPump relays the messages of conn to the room of topic until the connection fails.
+func (h *Hub) readPump(conn *websocket.Conn, topic string) {
+	pongWait := 2 * h.config.PingInterval
+	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(pongWait))
+		if messageType != websocket.TextMessage || !json.Valid(data) {
+			continue
+		}
+		if err := h.broadcast(topic, data); err != nil {
+			return
+		}
+	}
+}
+
+// writePump sends the queued messages of m and the pings to conn. m is nil for publishers.
+// It closes conn when it returns, which also ends readPump.
+func (h *Hub) writePump(conn *websocket.Conn, m *member, done <-chan struct{}) {
+	ticker := time.NewTicker(h.config.PingInterval)
+	defer func() {
+		ticker.Stop()
+		_ = conn.Close()
+	}()
+
+	var send chan []byte
+	if m != nil {
+		send = m.send
+	}
+	for {
+		select {
+		case data, ok := <-send:
+			_ = conn.SetWriteDeadline(time.Now().Add(h.config.WriteTimeout))
+			if !ok {
+				// The member was too slow and has been removed from the room.
+				_ = conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "member fell behind"))
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = conn.SetWriteDeadline(time.Now().Add(h.config.WriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-h.closed:
+			_ = conn.SetWriteDeadline(time.Now().Add(h.config.WriteTimeout))
+			_ = conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "hub is closed"))
+			return
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package zk
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/go-zookeeper/zk"
+	"go.uber.org/multierr"
+
+	watcher "github.com/origadmin/casbin-watcher/v3"
+)
+
+func init() {
+	watcher.RegisterDriver("zk", &Driver{})
+}
+
+const (
+	// ACLOpen lets every client read, write and delete the znodes of the driver.
+	ACLOpen = "open"
+	// ACLCreator restricts the znodes of the driver to the authenticated user who created them.
+	ACLCreator = "creator"
+)
+
+// nodePrefix is the prefix of the names of the message znodes. The name is followed by the publish time, a dash and
+// the sequence number that ZooKeeper appends.
+const nodePrefix = "msg-"
+
+// Driver for ZooKeeper.
+type Driver struct{}
+
+// NewPubSub creates a new Pub/Sub instance for ZooKeeper. It waits until a session has been established.
+func (d *Driver) NewPubSub(ctx context.Context, u *url.URL, logger watermill.LoggerAdapter) (watcher.PubSub, error) {
+	config, err := parseZKURL(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse zk url: %w", err)
+	}
+
+	ps := &zkPubSub{
+		config:         config,
+		logger:         logger,
+		sessionChanged: make(chan struct{}),
+		closed:         make(chan struct{}),
+	}
+	ps.acl = zk.WorldACL(zk.PermAll)
+	if config.ACL == ACLCreator {
+		ps.acl = zk.AuthACL(zk.PermAll)
+	}
+
+	// The callback is called before the watches of an expired session are invalidated,
+	// so the subscriptions learn of the expiry when their watch ends.
+	conn, events, err := zk.Connect(config.Servers, config.SessionTimeout,
+		zk.WithLogger(zkLogger{logger}), zk.WithEventCallback(ps.handleEvent))
+	if err != nil {
+		return nil, err
+	}
+	ps.conn = conn
+	if config.User != "" {
+		if err := conn.AddAuth("digest", []byte(config.User+":"+config.Password)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to authenticate to zookeeper: %w", err)
+		}
+	}
+
+	timeout := time.NewTimer(config.Timeout)
+	defer timeout.Stop()
+	for connected := false; !connected; {
+		select {
+		case ev := <-events:
+			connected = ev.State == zk.StateHasSession
+		case <-timeout.C:
+			conn.Close()
+			return nil, fmt.Errorf("failed to connect to zookeeper: %w", context.DeadlineExceeded)
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		}
+	}
+	return ps, nil
+}
+
+// envelope is the JSON representation of a message as it is stored in a znode.
+type envelope struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+// conn is the part of a ZooKeeper connection used by the driver.
+type conn interface {
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	Delete(path string, version int32) error
+	Close()
+}
+
+type zkPubSub struct {
+	conn   conn
+	config *zkConfig
+	acl    []zk.ACL
+	logger watermill.LoggerAdapter
+
+	// sessions counts the sessions that have expired. sessionChanged is closed and replaced when one expires.
+	sessionMu      sync.Mutex
+	sessions       int
+	sessionChanged chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// handleEvent follows the session events of the connection.
+func (p *zkPubSub) handleEvent(ev zk.Event) {
+	if ev.Type != zk.EventSession {
+		return
+	}
+	switch ev.State {
+	case zk.StateExpired:
+		// The client establishes a new session by itself, but the watches of the old one are gone.
+		p.logger.Error("ZooKeeper session expired.", nil, watermill.LogFields{"server": ev.Server})
+		p.sessionMu.Lock()
+		p.sessions++
+		close(p.sessionChanged)
+		p.sessionChanged = make(chan struct{})
+		p.sessionMu.Unlock()
+	case zk.StateDisconnected:
+		p.logger.Info("Disconnected from ZooKeeper.", watermill.LogFields{"server": ev.Server})
+	case zk.StateHasSession:
+		p.logger.Info("Connected to ZooKeeper.", watermill.LogFields{"server": ev.Server})
+	}
+}
+
+// session returns the number of sessions that have expired, and a channel that is closed when the next one expires.
+func (p *zkPubSub) session() (int, <-chan struct{}) {
+	p.sessionMu.Lock()
+	defer p.sessionMu.Unlock()
+	return p.sessions, p.sessionChanged
+}
+
+// Publish creates a sequential znode for each message under the topic's path.
+func (p *zkPubSub) Publish(topic string, messages ...*message.Message) error {
+	topicPath := p.topicPath(topic)
+	if err := p.ensurePath(topicPath); err != nil {
+		return fmt.Errorf("failed to create path %s: %w", topicPath, err)
+	}
+
+	var allErrors error
+	for _, msg := range messages {
+		data, err := json.Marshal(envelope{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal message: %w", err)
+		}
+
+		// The publish time is part of the name, so that expired znodes can be found without reading them.
+		name := fmt.Sprintf("%s/%s%d-", topicPath, nodePrefix, time.Now().UnixNano())
+		if _, err := p.conn.Create(name, data, zk.FlagSequence, p.acl); err != nil {
+			p.logger.Error("Failed to publish message to zookeeper", err, watermill.LogFields{"topic": topic})
+			allErrors = multierr.Append(allErrors, fmt.Errorf("failed to publish message %s: %w", msg.UUID, err))
+		}
+	}
+
+	if p.config.TTL > 0 {
+		if err := p.deleteExpired(topicPath); err != nil {
+			// The znodes are deleted again on the next publish, so this is not an error of the publish.
+			p.logger.Error("Failed to delete expired zookeeper nodes", err, watermill.LogFields{"topic": topic})
+		}
+	}
+	return allErrors
+}
+
+// deleteExpired deletes the message znodes under topicPath that were published more than the TTL ago.
+func (p *zkPubSub) deleteExpired(topicPath string) error {
+	children, _, err := p.conn.Children(topicPath)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-p.config.TTL).UnixNano()
+	var allErrors error
+	for _, child := range children {
+		published, _, ok := parseNodeName(child)
+		if !ok || published >= deadline {
+			continue
+		}
+		err := p.conn.Delete(topicPath+"/"+child, -1)
+		if err != nil && !errors.Is(err, zk.ErrNoNode) {
+			allErrors = multierr.Append(allErrors, err)
+		}
+	}
+	return allErrors
+}
+
+// ensurePath creates the persistent znodes of topicPath that do not exist yet.
+func (p *zkPubSub) ensurePath(topicPath string) error {
+	exists, _, err := p.conn.Exists(topicPath)
+	if err != nil || exists {
+		return err
+	}
+	current := ""
+	for _, part := range strings.Split(strings.TrimPrefix(topicPath, "/"), "/") {
+		current += "/" + part
+		_, err := p.conn.Create(current, nil, 0, p.acl)
+		if err != nil && !errors.Is(err, zk.ErrNodeExists) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe watches the children of the topic's path. Only messages published after the subscription are delivered.
+// If the session expires, updates may have been missed while no watch was set, so a reload message is delivered
+// (see watcher.NewReloadMessage) and watching resumes with the messages published after that.
+func (p *zkPubSub) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	topicPath := p.topicPath(topic)
+	if err := p.ensurePath(topicPath); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to topic %q: %w", topic, err)
+	}
+	children, _, err := p.conn.Children(topicPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to topic %q: %w", topic, err)
+	}
+	seq := lastSequence(children)
+	session, _ := p.session()
+
+	output := make(chan *message.Message)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(output)
+
+		logFields := watermill.LogFields{"topic": topic}
+		for {
+			var ok bool
+			seq, session, ok = p.watch(ctx, topicPath, seq, session, output)
+			if !ok {
+				p.logger.Info("ZooKeeper subscriber stopped.", logFields)
+				return
+			}
+			select {
+			case <-time.After(p.config.ReconnectWait):
+			case <-ctx.Done():
+				return
+			case <-p.closed:
+				return
+			}
+			p.logger.Info("Resuming zookeeper watch.", watermill.LogFields{"topic": topic, "sequence": seq})
+		}
+	}()
+
+	return output, nil
+}
+
+// watch delivers the messages under topicPath with a sequence number above seq, until an operation fails or a
+// message is nacked. session is the number of expired sessions that the subscription knows of.
+// It returns the sequence number and the session to resume from, and false if the subscription has ended.
+func (p *zkPubSub) watch(ctx context.Context, topicPath string, seq int64, session int, output chan<- *message.Message) (int64, int, bool) {
+	for {
+		current, sessionChanged := p.session()
+		if current != session {
+			children, _, err := p.conn.Children(topicPath)
+			if err != nil {
+				p.logger.Error("Failed to list zookeeper nodes.", err, watermill.LogFields{"path": topicPath})
+				return seq, session, true
+			}
+			p.logger.Error("ZooKeeper session expired, requesting a full reload.", nil,
+				watermill.LogFields{"path": topicPath})
+			if !p.deliver(ctx, watcher.NewReloadMessage(), output) {
+				return seq, session, false
+			}
+			seq, session = lastSequence(children), current
+			continue
+		}
+
+		children, _, events, err := p.conn.ChildrenW(topicPath)
+		if errors.Is(err, zk.ErrNoNode) {
+			// The topic's path has been deleted, so it is created again and watched once it exists.
+			if err = p.ensurePath(topicPath); err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			if errors.Is(err, zk.ErrClosing) {
+				return seq, session, false
+			}
+			p.logger.Error("Failed to watch zookeeper nodes.", err, watermill.LogFields{"path": topicPath})
+			return seq, session, true
+		}
+
+		nodes := make(map[int64]string, len(children))
+		sequences := make([]int64, 0, len(children))
+		for _, child := range children {
+			if _, n, ok := parseNodeName(child); ok && n > seq {
+				nodes[n] = child
+				sequences = append(sequences, n)
+			}
+		}
+		sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+		for _, n := range sequences {
+			data, _, err := p.conn.Get(topicPath + "/" + nodes[n])
+			if errors.Is(err, zk.ErrNoNode) {
+				// The znode has expired since the children were listed.
+				seq = n
+				continue
+			}
+			if err != nil {
+				p.logger.Error("Failed to read zookeeper node.", err, watermill.LogFields{"path": topicPath})
+				return seq, session, true
+			}
+			acked, ok := p.deliverData(ctx, topicPath, data, output)
+			if !ok {
+				return seq, session, false
+			}
+			if !acked {
+				// The next watch starts below the nacked znode, so that it is delivered again.
+				return seq, session, true
+			}
+			seq = n
+		}
+
+		select {
+		case <-events:
+			// An expired session is detected at the start of the loop.
+		case <-sessionChanged:
+		case <-ctx.Done():
+			return seq, session, false
+		case <-p.closed:
+			return seq, session, false
+		}
+	}
+}
+
+// deliverData unmarshals data and delivers it. It returns whether the message was acked,
+// and false if the subscription has ended. Data that cannot be unmarshalled is skipped.
+func (p *zkPubSub) deliverData(ctx context.Context, topicPath string, data []byte, output chan<- *message.Message) (bool, bool) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		p.logger.Error("failed to unmarshal zookeeper message", err, watermill.LogFields{"path": topicPath})
+		return true, true
+	}
+	msg := message.NewMessage(env.UUID, env.Payload)
+	for k, v := range env.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false, false
+	case <-p.closed:
+		return false, false
+	}
+	select {
+	case <-msg.Acked():
+		return true, true
+	case <-msg.Nacked():
+		return false, true
+	case <-ctx.Done():
+		return false, false
+	case <-p.closed:
+		return false, false
+	}
+}
+
+// deliver sends msg to output and waits until it is acknowledged. It returns false if the subscription has ended.
+func (p *zkPubSub) deliver(ctx context.Context, msg *message.Message, output chan<- *message.Message) bool {
+	select {
+	case output <- msg:
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	select {
+	case <-msg.Acked():
+	case <-msg.Nacked():
+	case <-ctx.Done():
+		return false
+	case <-p.closed:
+		return false
+	}
+	return true
+}
+
+func (p *zkPubSub) topicPath(topic string) string {
+	return path.Join(p.config.Root, topic)
+}
+
+func (p *zkPubSub) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		// Closing the connection ends the pending operations of the subscriptions.
+		p.conn.Close()
+		p.wg.Wait()
+	})
+	return nil
+}
+
+// parseNodeName returns the publish time and the sequence number of a message znode.
+func parseNodeName(name string) (int64, int64, bool) {
+	published, sequence, ok := strings.Cut(strings.TrimPrefix(name, nodePrefix), "-")
+	if !ok || !strings.HasPrefix(name, nodePrefix) {
+		return 0, 0, false
+	}
+	t, err := strconv.ParseInt(published, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	n, err := strconv.ParseInt(sequence, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return t, n, true
+}
+
+// lastSequence returns the highest sequence number of the message znodes in children, or -1 if there are none.
+func lastSequence(children []string) int64 {
+	seq := int64(-1)
+	for _, child := range children {
+		if _, n, ok := parseNodeName(child); ok && n > seq {
+			seq = n
+		}
+	}
+	return seq
+}
+
+// zkLogger forwards the log output of the ZooKeeper client to the watermill logger.
+type zkLogger struct {
+	logger watermill.LoggerAdapter
+}
+
+func (l zkLogger) Printf(format string, args ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, args...), nil)
+}
+
+type zkConfig struct {
+	Servers        []string
+	Root           string
+	ACL            string
+	User           string
+	Password       string
+	TTL            time.Duration
+	SessionTimeout time.Duration
+	Timeout        time.Duration
+	ReconnectWait  time.Duration
+}
+
+func parseZKURL(u *url.URL) (*zkConfig, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("zookeeper servers are not specified in URL host")
+	}
+
+	query := u.Query()
+	config := &zkConfig{
+		Servers:        strings.Split(u.Host, ","),
+		Root:           "/casbin-watcher",
+		ACL:            ACLOpen,
+		TTL:            time.Hour,
+		SessionTimeout: 10 * time.Second,
+		Timeout:        10 * time.Second,
+		ReconnectWait:  time.Second,
+	}
+
+	if root := query.Get("root"); root != "" {
+		if !strings.HasPrefix(root, "/") {
+			return nil, fmt.Errorf("invalid 'root' param: must start with '/'")
+		}
+		config.Root = root
+	}
+
+	if acl := query.Get("acl"); acl != "" {
+		switch acl {
+		case ACLOpen, ACLCreator:
+			config.ACL = acl
+		default:
+			return nil, fmt.Errorf("invalid 'acl' param: %s", acl)
+		}
+	}
+
+	if user := u.User.Username(); user != "" {
+		config.User = user
+		config.Password, _ = u.User.Password()
+	}
+	if config.ACL == ACLCreator && config.User == "" {
+		return nil, fmt.Errorf("'acl=creator' requires a user in the URL")
+	}
+
+	if ttl := query.Get("ttl"); ttl != "" {
+		val, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'ttl' param: %w", err)
+		}
+		if val < 0 {
+			return nil, fmt.Errorf("invalid 'ttl' param: must not be negative")
+		}
+		config.TTL = val
+	}
+
+	if st := query.Get("session_timeout"); st != "" {
+		val, err := time.ParseDuration(st)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'session_timeout' param: %w", err)
+		}
+		config.SessionTimeout = val
+	}
+
+	if timeout := query.Get("timeout"); timeout != "" {
+		val, err := time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'timeout' param: %w", err)
+		}
+		config.Timeout = val
+	}
+
+	if rw := query.Get("reconnect_wait"); rw != "" {
+		val, err := time.ParseDuration(rw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'reconnect_wait' param: %w", err)
+		}
+		config.ReconnectWait = val
+	}
+
+	return config, nil
+}
@@ -0,0 +1,251 @@
+package zk
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/go-zookeeper/zk"
+	"github.com/stretchr/testify/require"
+
+	watcher "github.com/origadmin/casbin-watcher/v3"
+)
+
+func TestParseNodeName(t *testing.T) {
+	tests := []struct {
+		name          string
+		wantPublished int64
+		wantSequence  int64
+		wantOK        bool
+	}{
+		{name: "msg-1700000000000000000-0000000007", wantPublished: 1700000000000000000, wantSequence: 7, wantOK: true},
+		{name: "msg-0-0000000000", wantPublished: 0, wantSequence: 0, wantOK: true},
+		{name: "msg-1700000000000000000-", wantOK: false},
+		{name: "msg-1700000000000000000", wantOK: false},
+		{name: "msg-now-0000000007", wantOK: false},
+		{name: "msg-1700000000000000000-seven", wantOK: false},
+		{name: "lock-1700000000000000000-0000000007", wantOK: false},
+		{name: "", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			published, sequence, ok := parseNodeName(tt.name)
+			require.Equal(t, tt.wantOK, ok)
+			if ok {
+				require.Equal(t, tt.wantPublished, published)
+				require.Equal(t, tt.wantSequence, sequence)
+			}
+		})
+	}
+}
+
+func TestLastSequence(t *testing.T) {
+	tests := []struct {
+		name     string
+		children []string
+		want     int64
+	}{
+		{name: "no children", want: -1},
+		{name: "no message nodes", children: []string{"lock", "msg-x-1"}, want: -1},
+		{
+			name:     "highest sequence",
+			children: []string{"msg-300-0000000002", "msg-100-0000000010", "lock", "msg-200-0000000003"},
+			want:     10,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, lastSequence(tt.children))
+		})
+	}
+}
+
+func TestSessionExpiryReload(t *testing.T) {
+	c := newFakeConn()
+	p := &zkPubSub{
+		conn:           c,
+		config:         &zkConfig{Root: "/casbin-watcher", TTL: time.Hour, ReconnectWait: 10 * time.Millisecond},
+		acl:            zk.WorldACL(zk.PermAll),
+		logger:         watermill.NopLogger{},
+		sessionChanged: make(chan struct{}),
+		closed:         make(chan struct{}),
+	}
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, err := p.Subscribe(ctx, "casbin")
+	require.NoError(t, err)
+
+	receive := func(t *testing.T) *message.Message {
+		select {
+		case msg := <-messages:
+			msg.Ack()
+			return msg
+		case <-time.After(5 * time.Second):
+			t.Fatal("No message was delivered in time")
+			return nil
+		}
+	}
+
+	require.NoError(t, p.Publish("casbin", message.NewMessage("first", []byte("1"))))
+	require.Equal(t, "first", receive(t).UUID)
+
+	// The watches of an expired session are lost, so a message published meanwhile is not noticed.
+	c.dropWatches()
+	require.NoError(t, p.Publish("casbin", message.NewMessage("missed", []byte("2"))))
+	p.handleEvent(zk.Event{Type: zk.EventSession, State: zk.StateExpired})
+
+	// A reload is requested instead, which covers the missed message.
+	reload := receive(t)
+	require.Equal(t, "true", reload.Metadata.Get(watcher.MetadataReload))
+
+	// Watching resumes after the messages that the reload covers.
+	require.NoError(t, p.Publish("casbin", message.NewMessage("third", []byte("3"))))
+	require.Equal(t, "third", receive(t).UUID)
+}
+
+// fakeConn is an in-memory ZooKeeper with the znode operations used by the driver.
+type fakeConn struct {
+	mu       sync.Mutex
+	nodes    map[string][]byte
+	sequence map[string]int
+	watches  map[string][]chan zk.Event
+	closed   bool
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		nodes:    map[string][]byte{"/": nil},
+		sequence: make(map[string]int),
+		watches:  make(map[string][]chan zk.Event),
+	}
+}
+
+// dropWatches removes all watches without triggering them, as happens when a session expires.
+func (c *fakeConn) dropWatches() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.watches = make(map[string][]chan zk.Event)
+}
+
+func (c *fakeConn) children(p string) ([]string, error) {
+	if c.closed {
+		return nil, zk.ErrClosing
+	}
+	if _, ok := c.nodes[p]; !ok {
+		return nil, zk.ErrNoNode
+	}
+	var children []string
+	for node := range c.nodes {
+		if node != "/" && path.Dir(node) == p {
+			children = append(children, path.Base(node))
+		}
+	}
+	sort.Strings(children)
+	return children, nil
+}
+
+func (c *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	children, err := c.children(p)
+	return children, &zk.Stat{}, err
+}
+
+func (c *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	children, err := c.children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	ch := make(chan zk.Event, 1)
+	c.watches[p] = append(c.watches[p], ch)
+	return children, &zk.Stat{}, ch, nil
+}
+
+func (c *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, nil, zk.ErrClosing
+	}
+	data, ok := c.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return data, &zk.Stat{}, nil
+}
+
+func (c *fakeConn) Create(p string, data []byte, flags int32, _ []zk.ACL) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return "", zk.ErrClosing
+	}
+	parent := path.Dir(p)
+	if _, ok := c.nodes[parent]; !ok {
+		return "", zk.ErrNoNode
+	}
+	if flags&zk.FlagSequence != 0 {
+		p += fmt.Sprintf("%010d", c.sequence[parent])
+		c.sequence[parent]++
+	}
+	if _, ok := c.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+	c.nodes[p] = data
+	c.trigger(parent)
+	return p, nil
+}
+
+func (c *fakeConn) Exists(p string) (bool, *zk.Stat, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false, nil, zk.ErrClosing
+	}
+	_, ok := c.nodes[p]
+	return ok, &zk.Stat{}, nil
+}
+
+func (c *fakeConn) Delete(p string, _ int32) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return zk.ErrClosing
+	}
+	if _, ok := c.nodes[p]; !ok {
+		return zk.ErrNoNode
+	}
+	for node := range c.nodes {
+		if strings.HasPrefix(node, p+"/") {
+			return zk.ErrNotEmpty
+		}
+	}
+	delete(c.nodes, p)
+	c.trigger(path.Dir(p))
+	return nil
+}
+
+func (c *fakeConn) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+}
+
+// trigger fires the child watches of p. c.mu must be held.
+func (c *fakeConn) trigger(p string) {
+	for _, ch := range c.watches[p] {
+		ch <- zk.Event{Type: zk.EventNodeChildrenChanged, Path: p}
+	}
+	delete(c.watches, p)
+}
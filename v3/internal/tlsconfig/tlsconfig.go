@@ -0,0 +1,78 @@
+// Package tlsconfig builds TLS client configurations from the query parameters of a driver URL.
+//
+// The following parameters are recognised:
+//
+//	tls                   enable TLS with the system roots (bool)
+//	ca_file               PEM file with the CA certificates used to verify the server
+//	cert_file, key_file   PEM files with the client certificate and key for mutual TLS
+//	server_name           the name used to verify the server certificate
+//	insecure_skip_verify  do not verify the server certificate (bool, for testing only)
+//
+// Setting any of the file or verification parameters enables TLS as well.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// FromQuery returns the TLS configuration described by query, or nil if TLS is not enabled.
+func FromQuery(query url.Values) (*tls.Config, error) {
+	enabled := false
+	if t := query.Get("tls"); t != "" {
+		var err error
+		enabled, err = strconv.ParseBool(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'tls' param: %w", err)
+		}
+	}
+
+	caFile := query.Get("ca_file")
+	certFile := query.Get("cert_file")
+	keyFile := query.Get("key_file")
+	serverName := query.Get("server_name")
+	insecureSkipVerify := false
+	if isv := query.Get("insecure_skip_verify"); isv != "" {
+		var err error
+		insecureSkipVerify, err = strconv.ParseBool(isv)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'insecure_skip_verify' param: %w", err)
+		}
+	}
+
+	if !enabled && caFile == "" && certFile == "" && keyFile == "" && serverName == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'ca_file' param: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid 'ca_file' param: no certificates found in %s", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("'cert_file' and 'key_file' params must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,26 @@
+package watcher
+
+import (
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// MetadataReload marks a message that was created by a driver instead of being published by a watcher.
+// It tells the watcher that updates may have been missed and that the whole policy must be reloaded.
+const MetadataReload = "reload"
+
+// NewReloadMessage creates a message that a driver delivers when it can no longer guarantee that no updates
+// were missed, for example because the history it resumes from has been compacted.
+// The receiving watcher handles it like a policy-changed update: the update callback is called,
+// and an update message callback set with Ex.SetUpdateMessageCallback receives an UpdateMessage of type
+// UpdateTypePolicyChanged, so that the enforcer reloads the policy from its adapter.
+func NewReloadMessage() *message.Message {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(UpdateTypePolicyChanged))
+	msg.Metadata.Set(MetadataReload, "true")
+	return msg
+}
+
+// isReloadMessage reports whether msg was created by NewReloadMessage.
+func isReloadMessage(msg *message.Message) bool {
+	return msg.Metadata.Get(MetadataReload) != ""
+}
@@ -0,0 +1,81 @@
+package watcher
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/casbin/casbin/v3/model"
+)
+
+// ErrInvalidUpdateMessage is returned when an UpdateMessage does not match the enforcer's model.
+var ErrInvalidUpdateMessage = errors.New("invalid update message")
+
+// ValidateUpdateMessage checks that u is well-formed and consistent with the policy definitions of m.
+// It verifies the update type, the section, the policy type and the number of fields of every rule.
+// The returned error wraps ErrInvalidUpdateMessage.
+func ValidateUpdateMessage(m model.Model, u UpdateMessage) error {
+	switch u.Type {
+	case UpdateTypePolicyChanged, UpdateTypeSavePolicy:
+		// These updates carry no policy data.
+		return nil
+	case UpdateTypeAddPolicy, UpdateTypeRemovePolicy,
+		UpdateTypeRemoveFilteredPolicy,
+		UpdateTypeAddPolicies, UpdateTypeRemovePolicies:
+	default:
+		return invalidUpdateMessage("unknown type %q", u.Type)
+	}
+
+	if u.Sec != "p" && u.Sec != "g" {
+		return invalidUpdateMessage("section must be \"p\" or \"g\", got %q", u.Sec)
+	}
+	ast, ok := m[u.Sec][u.Ptype]
+	if !ok || ast == nil {
+		return invalidUpdateMessage("policy type %q is not defined in section %q", u.Ptype, u.Sec)
+	}
+	size := len(ast.Tokens) + len(ast.ParamsTokens)
+
+	switch u.Type {
+	case UpdateTypeAddPolicy, UpdateTypeRemovePolicy:
+		if len(u.Params) != size {
+			return invalidUpdateMessage("%s.%s rule has %d fields, expected %d", u.Sec, u.Ptype, len(u.Params), size)
+		}
+	case UpdateTypeAddPolicies, UpdateTypeRemovePolicies:
+		if len(u.Rules) == 0 {
+			return invalidUpdateMessage("%s update has no rules", u.Type)
+		}
+		for i, rule := range u.Rules {
+			if len(rule) != size {
+				return invalidUpdateMessage("%s.%s rule %d has %d fields, expected %d", u.Sec, u.Ptype, i, len(rule), size)
+			}
+		}
+	case UpdateTypeRemoveFilteredPolicy:
+		fieldIndex, fieldValues := 0, u.Params
+		if u.HasFieldIndex {
+			fieldIndex = u.FieldIndex
+		} else {
+			// Legacy layout: the field index is the first element of Params.
+			if len(u.Params) == 0 {
+				return invalidUpdateMessage("remove-filtered update has no field index")
+			}
+			var err error
+			fieldIndex, err = strconv.Atoi(u.Params[0])
+			if err != nil {
+				return invalidUpdateMessage("field index %q is not a number", u.Params[0])
+			}
+			fieldValues = u.Params[1:]
+		}
+		if fieldIndex < 0 || fieldIndex >= size {
+			return invalidUpdateMessage("field index %d is out of range [0, %d)", fieldIndex, size)
+		}
+		if fieldIndex+len(fieldValues) > size {
+			return invalidUpdateMessage("%d field values starting at index %d exceed %d fields", len(fieldValues), fieldIndex, size)
+		}
+	}
+
+	return nil
+}
+
+func invalidUpdateMessage(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidUpdateMessage, fmt.Sprintf(format, args...))
+}
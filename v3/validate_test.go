@@ -0,0 +1,147 @@
+package watcher_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/v3/model"
+	"github.com/stretchr/testify/require"
+
+	"github.com/origadmin/casbin-watcher/v3"
+)
+
+func TestValidateUpdateMessage(t *testing.T) {
+	m, err := model.NewModelFromFile("./test_data/model.conf")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		msg   watcher.UpdateMessage
+		valid bool
+	}{
+		{
+			name:  "Policy changed",
+			msg:   watcher.UpdateMessage{Type: watcher.UpdateTypePolicyChanged},
+			valid: true,
+		},
+		{
+			name:  "Add policy",
+			msg:   watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicy, Sec: "p", Ptype: "p", Params: []string{"alice", "data1", "read"}},
+			valid: true,
+		},
+		{
+			name:  "Add policies",
+			msg:   watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicies, Sec: "p", Ptype: "p", Rules: [][]string{{"alice", "data1", "read"}}},
+			valid: true,
+		},
+		{
+			name:  "Remove filtered policy",
+			msg:   watcher.UpdateMessage{Type: watcher.UpdateTypeRemoveFilteredPolicy, Sec: "p", Ptype: "p", Params: []string{"data1", "read"}, FieldIndex: 1, HasFieldIndex: true},
+			valid: true,
+		},
+		{
+			name:  "Remove filtered policy (legacy layout)",
+			msg:   watcher.UpdateMessage{Type: watcher.UpdateTypeRemoveFilteredPolicy, Sec: "p", Ptype: "p", Params: []string{"1", "data1", "read"}},
+			valid: true,
+		},
+		{
+			name: "Unknown type",
+			msg:  watcher.UpdateMessage{Type: "drop-table", Sec: "p", Ptype: "p"},
+		},
+		{
+			name: "Unknown section",
+			msg:  watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicy, Sec: "x", Ptype: "p", Params: []string{"alice", "data1", "read"}},
+		},
+		{
+			name: "Undefined policy type",
+			msg:  watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicy, Sec: "g", Ptype: "g", Params: []string{"alice", "admin"}},
+		},
+		{
+			name: "Params length mismatch",
+			msg:  watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicy, Sec: "p", Ptype: "p", Params: []string{"alice", "data1"}},
+		},
+		{
+			name: "Rule length mismatch",
+			msg:  watcher.UpdateMessage{Type: watcher.UpdateTypeRemovePolicies, Sec: "p", Ptype: "p", Rules: [][]string{{"alice", "data1", "read"}, {"bob"}}},
+		},
+		{
+			name: "Non-numeric field index",
+			msg:  watcher.UpdateMessage{Type: watcher.UpdateTypeRemoveFilteredPolicy, Sec: "p", Ptype: "p", Params: []string{"one", "data1"}},
+		},
+		{
+			name: "Field values out of range",
+			msg:  watcher.UpdateMessage{Type: watcher.UpdateTypeRemoveFilteredPolicy, Sec: "p", Ptype: "p", Params: []string{"2", "read", "extra"}},
+		},
+		{
+			name: "Negative field index",
+			msg:  watcher.UpdateMessage{Type: watcher.UpdateTypeRemoveFilteredPolicy, Sec: "p", Ptype: "p", Params: []string{"alice"}, FieldIndex: -1, HasFieldIndex: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := watcher.ValidateUpdateMessage(m, tt.msg)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, watcher.ErrInvalidUpdateMessage)
+			}
+		})
+	}
+}
+
+func TestWatcherExRejectsInvalidMessages(t *testing.T) {
+	endpointURL := "mem://casbin?shared=true"
+
+	m, err := model.NewModelFromFile("./test_data/model.conf")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updateCh := make(chan watcher.UpdateMessage, 1)
+	errCh := make(chan error, 1)
+
+	updater, err := watcher.NewWatcherEx(ctx, endpointURL)
+	require.NoError(t, err)
+	defer updater.Close()
+
+	listener, err := watcher.NewWatcherEx(ctx, endpointURL,
+		watcher.WithModel(m),
+		watcher.WithErrorHandler(func(err error) {
+			errCh <- err
+		}),
+	)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	err = listener.SetUpdateMessageCallback(func(msg watcher.UpdateMessage) {
+		updateCh <- msg
+	})
+	require.NoError(t, err)
+
+	err = updater.UpdateForAddPolicy("p", "p", "alice", "data1")
+	require.NoError(t, err)
+
+	select {
+	case err := <-errCh:
+		require.ErrorIs(t, err, watcher.ErrInvalidUpdateMessage)
+	case msg := <-updateCh:
+		t.Fatalf("Invalid message should not have been delivered, got: %v", msg)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Listener didn't report the invalid message in time")
+	}
+
+	err = updater.UpdateForAddPolicy("p", "p", "alice", "data1", "read")
+	require.NoError(t, err)
+
+	select {
+	case msg := <-updateCh:
+		require.Equal(t, []string{"alice", "data1", "read"}, msg.Params)
+	case err := <-errCh:
+		t.Fatalf("Valid message should not have been rejected, got: %s", err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Listener didn't receive the valid message in time")
+	}
+}
@@ -2,8 +2,10 @@ package watcher
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 
@@ -27,14 +29,24 @@ const (
 	UpdateTypeRemovePolicies       = "remove-policies"
 )
 
+// MetadataUpdateType records the update type of a published message, for example UpdateTypePolicyChanged.
+// It allows drivers to handle notices that require a full reload differently from incremental updates.
+const MetadataUpdateType = "update-type"
+
 // baseWatcher contains the common logic for both Watcher and Ex.
 type baseWatcher struct {
 	pubsub       PubSub
 	topic        string
 	callbackFunc func(string)
+	messageFunc  func(*message.Message) // messageFunc is set by Ex to receive decoded updates
 	callbackMu   sync.RWMutex
 	closed       chan struct{}
 	logger       watermill.LoggerAdapter
+	errorHandler func(error)
+	claimCheck   *ClaimCheck
+	// ctx is cancelled on Close, which aborts pending blob store operations.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // Option is a functional option for configuring the Watcher.
@@ -44,6 +56,10 @@ type options struct {
 	Topic  string
 	Logger watermill.LoggerAdapter
 	Codec  MarshalUnmarshaler // Codec is only used by Ex, but passed via options
+	Model  model.Model        // Model is only used by Ex to validate received updates
+
+	ClaimCheck   *ClaimCheck
+	ErrorHandler func(error)
 }
 
 // WithTopic sets the Watermill topic to use for updates.
@@ -67,6 +83,22 @@ func WithCodec(codec MarshalUnmarshaler) Option {
 	}
 }
 
+// WithModel enables validation of received UpdateMessages against the policy definitions of the model.
+// Invalid messages are rejected and reported instead of being delivered to the callback.
+func WithModel(m model.Model) Option {
+	return func(o *options) {
+		o.Model = m
+	}
+}
+
+// WithErrorHandler sets a function that is called with every error encountered while receiving
+// a message, such as decoding failures or rejected UpdateMessages. Errors are always logged.
+func WithErrorHandler(handler func(error)) Option {
+	return func(o *options) {
+		o.ErrorHandler = handler
+	}
+}
+
 // newBaseWatcher creates a new base watcher instance with the provided options.
 func newBaseWatcher(ctx context.Context, connectionURL string, o *options) (*baseWatcher, error) {
 	u, err := url.Parse(connectionURL)
@@ -88,19 +120,27 @@ func newBaseWatcher(ctx context.Context, connectionURL string, o *options) (*bas
 	}
 
 	w := &baseWatcher{
-		pubsub: ps,
-		topic:  o.Topic,
-		closed: make(chan struct{}),
-		logger: o.Logger,
+		pubsub:       ps,
+		topic:        o.Topic,
+		closed:       make(chan struct{}),
+		logger:       o.Logger,
+		errorHandler: o.ErrorHandler,
+		claimCheck:   o.ClaimCheck,
 	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
 
 	if err := w.startSubscribe(ctx); err != nil {
+		w.cancel()
 		if closeErr := ps.Close(); closeErr != nil {
 			w.logger.Error("failed to close pubsub", closeErr, nil)
 		}
 		return nil, err
 	}
 
+	if w.claimCheck != nil && w.claimCheck.TTL > 0 {
+		go w.claimCheck.collectGarbage(w.ctx, w.logger)
+	}
+
 	return w, nil
 }
 
@@ -132,6 +172,10 @@ func parseOptions(connectionURL string, opts ...Option) (*options, error) {
 		o.Topic = DefaultTopic
 	}
 
+	if o.ClaimCheck != nil && o.ClaimCheck.Store == nil {
+		return nil, errors.New("claim-check requires a blob store")
+	}
+
 	return o, nil
 }
 
@@ -162,12 +206,27 @@ func (w *baseWatcher) startSubscribe(ctx context.Context) error {
 func (w *baseWatcher) handleMessage(msg *message.Message) {
 	w.callbackMu.RLock()
 	callback := w.callbackFunc
+	messageFunc := w.messageFunc
 	w.callbackMu.RUnlock()
 
-	if callback == nil {
+	if callback == nil && messageFunc == nil {
 		return
 	}
 
+	if msg.Metadata.Get(MetadataClaimCheckKey) != "" {
+		if w.claimCheck == nil {
+			w.reportError("received claim-check message without a configured blob store", errors.New("claim-check is not configured"), msg)
+			return
+		}
+		ctx, cancel := w.claimCheck.withTimeout(w.ctx)
+		err := w.claimCheck.checkIn(ctx, msg)
+		cancel()
+		if err != nil {
+			w.reportError("failed to resolve claim-check payload", err, msg)
+			return
+		}
+	}
+
 	defer func() {
 		if r := recover(); r != nil {
 			var err error
@@ -183,12 +242,25 @@ func (w *baseWatcher) handleMessage(msg *message.Message) {
 		}
 	}()
 
+	// For Ex, a registered update message callback takes precedence and receives the decoded UpdateMessage.
+	if messageFunc != nil {
+		messageFunc(msg)
+		return
+	}
+
 	// For Watcher (basic mode), the payload is expected to be a simple string.
-	// For WatcherEx, the payload is an UpdateMessage, but the callbackFunc is for Watcher.
-	// The WatcherEx does not use callbackFunc for receiving updates.
+	// For Ex without an update message callback, the raw encoded payload is passed through.
 	callback(string(msg.Payload))
 }
 
+// reportError logs an error that occurred while receiving msg and passes it to the error handler, if any.
+func (w *baseWatcher) reportError(logMsg string, err error, msg *message.Message) {
+	w.logger.Error(logMsg, err, watermill.LogFields{"uuid": msg.UUID})
+	if w.errorHandler != nil {
+		w.errorHandler(err)
+	}
+}
+
 func (w *baseWatcher) SetUpdateCallback(callback func(string)) error {
 	w.callbackMu.Lock()
 	defer w.callbackMu.Unlock()
@@ -198,6 +270,20 @@ func (w *baseWatcher) SetUpdateCallback(callback func(string)) error {
 
 func (w *baseWatcher) Update() error {
 	msg := message.NewMessage(watermill.NewUUID(), []byte("update"))
+	msg.Metadata.Set(MetadataUpdateType, UpdateTypePolicyChanged)
+	return w.publish(msg)
+}
+
+// publish sends msg to the watcher's topic, storing its payload in the claim-check store if required.
+func (w *baseWatcher) publish(msg *message.Message) error {
+	if w.claimCheck != nil {
+		ctx, cancel := w.claimCheck.withTimeout(w.ctx)
+		err := w.claimCheck.checkOut(ctx, msg)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
 	return w.pubsub.Publish(w.topic, msg)
 }
 
@@ -212,6 +298,7 @@ func (w *baseWatcher) closeInternal() error {
 	}
 
 	close(w.closed)
+	w.cancel()
 	if err := w.pubsub.Close(); err != nil {
 		w.logger.Error("failed to close pubsub", err, nil)
 		return err
@@ -247,6 +334,7 @@ func NewWatcher(ctx context.Context, connectionURL string, opts ...Option) (*Wat
 type Ex struct {
 	*baseWatcher
 	codec MarshalUnmarshaler // Codec is specific to Ex
+	model model.Model        // model is used to validate received updates, guarded by callbackMu
 }
 
 // NewWatcherEx creates a new Ex (extended mode).
@@ -262,6 +350,7 @@ func NewWatcherEx(ctx context.Context, connectionURL string, opts ...Option) (*E
 	return &Ex{
 		baseWatcher: base,
 		codec:       o.Codec,
+		model:       o.Model,
 	}, nil
 }
 
@@ -272,15 +361,124 @@ type UpdateMessage struct {
 	Ptype  string
 	Params []string
 	Rules  [][]string
+	// FieldIndex is the index of the first filtered field for UpdateTypeRemoveFilteredPolicy,
+	// in which case Params holds the field values and HasFieldIndex is set.
+	FieldIndex int
+	// HasFieldIndex marks that FieldIndex is set. Codecs such as gob omit zero values, so index 0
+	// cannot be told apart from a missing index by FieldIndex alone.
+	HasFieldIndex bool
 }
 
 func (w *Ex) publishUpdate(u UpdateMessage) error {
-	payload, err := w.codec.Marshal(u)
+	metadata := message.Metadata{}
+	var payload []byte
+	var err error
+	if mc, ok := w.codec.(MetadataMarshalUnmarshaler); ok {
+		payload, err = mc.MarshalWithMetadata(u, metadata)
+	} else {
+		payload, err = w.codec.Marshal(u)
+	}
 	if err != nil {
 		return err
 	}
 	msg := message.NewMessage(watermill.NewUUID(), payload)
-	return w.pubsub.Publish(w.topic, msg)
+	msg.Metadata = metadata
+	if ct, ok := w.codec.(ContentTyper); ok && ct.ContentType() != "" {
+		msg.Metadata.Set(MetadataContentType, ct.ContentType())
+	}
+	msg.Metadata.Set(MetadataUpdateType, u.Type)
+	return w.publish(msg)
+}
+
+// SetUpdateMessageCallback sets the callback function that receives decoded UpdateMessages
+// published by other Ex instances. Once set, it replaces the string callback from SetUpdateCallback.
+// The codec is selected from the message's content type, falling back to the codec set by WithCodec.
+func (w *Ex) SetUpdateMessageCallback(callback func(UpdateMessage)) error {
+	w.callbackMu.Lock()
+	defer w.callbackMu.Unlock()
+	if callback == nil {
+		w.messageFunc = nil
+		return nil
+	}
+	w.messageFunc = func(msg *message.Message) {
+		if isReloadMessage(msg) {
+			callback(UpdateMessage{Type: UpdateTypePolicyChanged})
+			return
+		}
+		u, err := w.decodeMessage(msg)
+		if err != nil {
+			w.reportError("failed to decode update message", err, msg)
+			return
+		}
+		w.callbackMu.RLock()
+		m := w.model
+		w.callbackMu.RUnlock()
+		if m != nil {
+			if err := ValidateUpdateMessage(m, u); err != nil {
+				w.reportError("rejected invalid update message", err, msg)
+				return
+			}
+		}
+		callback(u)
+	}
+	return nil
+}
+
+// normalizeUpdateMessage converts a remove-filtered update from the legacy layout, in which the
+// field index is encoded as the first element of Params, to the layout using FieldIndex.
+// Messages whose legacy field index is not a number are left unchanged.
+func normalizeUpdateMessage(u *UpdateMessage) {
+	if u.Type != UpdateTypeRemoveFilteredPolicy || u.HasFieldIndex || len(u.Params) == 0 {
+		return
+	}
+	fieldIndex, err := strconv.Atoi(u.Params[0])
+	if err != nil {
+		return
+	}
+	u.FieldIndex, u.HasFieldIndex = fieldIndex, true
+	u.Params = u.Params[1:]
+}
+
+// SetModel sets the model used to validate received UpdateMessages, replacing the one set by WithModel.
+// A typical value is Enforcer.GetModel(). A nil model disables validation.
+func (w *Ex) SetModel(m model.Model) {
+	w.callbackMu.Lock()
+	defer w.callbackMu.Unlock()
+	w.model = m
+}
+
+// decodeMessage decodes the payload of msg into an UpdateMessage.
+func (w *Ex) decodeMessage(msg *message.Message) (UpdateMessage, error) {
+	var u UpdateMessage
+	codec := w.codec
+	if ct := msg.Metadata.Get(MetadataContentType); ct != "" {
+		c, ok := CodecForContentType(ct)
+		if !ok {
+			return u, fmt.Errorf("no codec registered for content type: %s", ct)
+		}
+		codec = c
+	}
+	if mc, ok := codec.(MetadataMarshalUnmarshaler); ok {
+		if err := mc.UnmarshalWithMetadata(msg.Payload, msg.Metadata, &u); err != nil {
+			return u, err
+		}
+		normalizeUpdateMessage(&u)
+		return u, nil
+	}
+	// Compression is recorded in the metadata independently of the codec, so it is undone first.
+	maxSize := int64(DefaultMaxDecompressedSize)
+	if cc, ok := w.codec.(*compressionMarshalUnmarshaler); ok {
+		maxSize = cc.maxSize
+	}
+	payload, err := decompress(msg.Metadata.Get(MetadataContentEncoding), msg.Payload, maxSize)
+	if err != nil {
+		return u, err
+	}
+	if err := codec.Unmarshal(payload, &u); err != nil {
+		return u, err
+	}
+	normalizeUpdateMessage(&u)
+	return u, nil
 }
 
 // Update calls the update callback of other instances to synchronize their policy.
@@ -299,10 +497,12 @@ func (w *Ex) UpdateForRemovePolicy(sec, ptype string, params ...string) error {
 
 func (w *Ex) UpdateForRemoveFilteredPolicy(sec, ptype string, fieldIndex int, fieldValues ...string) error {
 	return w.publishUpdate(UpdateMessage{
-		Type:   UpdateTypeRemoveFilteredPolicy,
-		Sec:    sec,
-		Ptype:  ptype,
-		Params: append([]string{fmt.Sprintf("%d", fieldIndex)}, fieldValues...),
+		Type:          UpdateTypeRemoveFilteredPolicy,
+		Sec:           sec,
+		Ptype:         ptype,
+		Params:        fieldValues,
+		FieldIndex:    fieldIndex,
+		HasFieldIndex: true,
 	})
 }
 
@@ -1,19 +1,70 @@
 package watcher_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/casbin/casbin/v3"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/klauspost/compress/zstd"
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
 	gnatsd "github.com/nats-io/nats-server/v2/test"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
 
 	"github.com/origadmin/casbin-watcher/v3"
+	"github.com/origadmin/casbin-watcher/v3/blobstore/file"
+	consuldriver "github.com/origadmin/casbin-watcher/v3/drivers/consul"
+	_ "github.com/origadmin/casbin-watcher/v3/drivers/etcd"
+	fswatchdriver "github.com/origadmin/casbin-watcher/v3/drivers/fswatch"
+	gossipdriver "github.com/origadmin/casbin-watcher/v3/drivers/gossip"
+	grpcdriver "github.com/origadmin/casbin-watcher/v3/drivers/grpc"
+	"github.com/origadmin/casbin-watcher/v3/drivers/grpc/relay"
+	httpdriver "github.com/origadmin/casbin-watcher/v3/drivers/http"
+	iodriver "github.com/origadmin/casbin-watcher/v3/drivers/io"
 	_ "github.com/origadmin/casbin-watcher/v3/drivers/mem"
+	mqttdriver "github.com/origadmin/casbin-watcher/v3/drivers/mqtt"
 	_ "github.com/origadmin/casbin-watcher/v3/drivers/nats"
+	_ "github.com/origadmin/casbin-watcher/v3/drivers/redis"
+	_ "github.com/origadmin/casbin-watcher/v3/drivers/redisstream"
+	"github.com/origadmin/casbin-watcher/v3/drivers/sse"
+	_ "github.com/origadmin/casbin-watcher/v3/drivers/unix"
+	"github.com/origadmin/casbin-watcher/v3/drivers/ws"
 )
 
 func TestNATSWatcher(t *testing.T) {
@@ -54,9 +105,14 @@ func TestNATSWatcher(t *testing.T) {
 }
 
 func testWithEnforcer(t *testing.T, endpointURL string) {
+	testWithEnforcerContext(t, context.Background(), endpointURL)
+}
+
+// testWithEnforcerContext is like testWithEnforcer but passes driver configuration through ctx.
+func testWithEnforcerContext(t *testing.T, ctx context.Context, endpointURL string) {
 	updateCh := make(chan string, 1)
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	w, err := watcher.NewWatcher(ctx, endpointURL)
@@ -96,6 +152,454 @@ func TestWithEnforcerNATS(t *testing.T) {
 	testWithEnforcer(t, natsURL)
 }
 
+func TestWithEnforcerHTTP(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// The webhook receiver is registered on the test server's mux, which is also the only peer.
+	ctx := httpdriver.WithServeMux(context.Background(), mux)
+	endpointURL := fmt.Sprintf("http://casbin/casbin-topic?peers=%s&path_prefix=/casbin", server.URL)
+
+	testWithEnforcerContext(t, ctx, endpointURL)
+}
+
+func TestHTTPWatcherServeMux(t *testing.T) {
+	mux := http.NewServeMux()
+	ctx := httpdriver.WithServeMux(context.Background(), mux)
+
+	// Without a prefix, the receiver would take over every route of the mux.
+	_, err := watcher.NewWatcher(ctx, "http:///casbin-topic?peers=http://localhost:8080")
+	require.ErrorContains(t, err, "requires a 'path_prefix' query parameter")
+
+	// The receiver is served by the application, so the driver does not listen itself.
+	_, err = watcher.NewWatcher(ctx, "http:///casbin-topic?path_prefix=/casbin&listen_addr="+freeAddr(t))
+	require.ErrorContains(t, err, "'listen_addr' query parameter cannot be used")
+
+	w, err := watcher.NewWatcher(ctx, "http:///casbin-topic?path_prefix=/casbin")
+	require.NoError(t, err)
+	defer w.Close()
+
+	// A second receiver with the same prefix is rejected instead of panicking.
+	_, err = watcher.NewWatcher(ctx, "http:///casbin-topic?path_prefix=/casbin")
+	require.ErrorContains(t, err, `failed to register http receiver on "/casbin/"`)
+
+	other, err := watcher.NewWatcher(ctx, "http:///casbin-topic?path_prefix=/other")
+	require.NoError(t, err)
+	defer other.Close()
+}
+
+func TestHTTPWatcherPeers(t *testing.T) {
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	peers := "http://" + addrs[0] + ",http://" + addrs[1]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every node runs its own receiver and lists all nodes, itself included, as peers.
+	var nodes []*watcher.Watcher
+	var received []chan string
+	for _, addr := range addrs {
+		endpointURL := fmt.Sprintf("http:///casbin-topic?listen_addr=%s&path_prefix=/casbin&peers=%s", addr, peers)
+		w, err := watcher.NewWatcher(ctx, endpointURL)
+		require.NoError(t, err)
+		defer w.Close()
+
+		ch := make(chan string, 10)
+		require.NoError(t, w.SetUpdateCallback(func(msg string) {
+			ch <- msg
+		}))
+		nodes = append(nodes, w)
+		received = append(received, ch)
+	}
+
+	// The receivers are started in the background.
+	for _, addr := range addrs {
+		require.Eventually(t, func() bool {
+			resp, err := http.Post("http://"+addr+"/casbin/probe", "text/plain", nil)
+			if err != nil {
+				return false
+			}
+			resp.Body.Close()
+			return true
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// The receiver only handles the topic under path_prefix.
+	resp, err := http.Post("http://"+addrs[0]+"/casbin-topic", "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// An update of either node reaches the other one.
+	for i, w := range nodes {
+		require.NoError(t, w.Update())
+		select {
+		case <-received[1-i]:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Node %d didn't receive the update of node %d in time", 1-i, i)
+		}
+	}
+}
+
+func TestWithEnforcerSSE(t *testing.T) {
+	hub := sse.NewHub(sse.HubConfig{})
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	defer hub.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	endpointURL := fmt.Sprintf("sse://%s/casbin-topic", parsedURL.Host)
+
+	testWithEnforcer(t, endpointURL)
+}
+
+func TestSSEWatcherResume(t *testing.T) {
+	hub := sse.NewHub(sse.HubConfig{})
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	defer hub.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	endpointURL := fmt.Sprintf("sse://%s/casbin-topic?reconnect_wait=10ms", parsedURL.Host)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The updater hosts the hub, while the listener connects to it over HTTP.
+	updater, err := watcher.NewWatcher(sse.WithHub(ctx, hub), endpointURL)
+	require.NoError(t, err)
+	defer updater.Close()
+
+	listener, err := watcher.NewWatcher(ctx, endpointURL)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	listenerCh := make(chan string, 10)
+	err = listener.SetUpdateCallback(func(msg string) {
+		listenerCh <- msg
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			// Break the event stream; the update must be delivered after the listener reconnects.
+			server.CloseClientConnections()
+		}
+		err = updater.Update()
+		require.NoError(t, err)
+
+		select {
+		case <-listenerCh:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Listener didn't receive update %d in time", i+1)
+		}
+	}
+
+	select {
+	case msg := <-listenerCh:
+		t.Fatalf("Listener received an update twice: %s", msg)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestSSEHubMultiLinePublish(t *testing.T) {
+	hub := sse.NewHub(sse.HubConfig{})
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	defer hub.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	u, err := url.Parse(fmt.Sprintf("sse://%s/casbin-topic", parsedURL.Host))
+	require.NoError(t, err)
+	ps, err := (&sse.Driver{}).NewPubSub(context.Background(), u, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer ps.Close()
+	messages, err := ps.Subscribe(context.Background(), "casbin-topic")
+	require.NoError(t, err)
+
+	// Publishers that are not watchers may send indented JSON, which must not break the event stream framing.
+	body, err := json.MarshalIndent(map[string]any{
+		"uuid":     "indented",
+		"metadata": map[string]string{watcher.MetadataUpdateType: watcher.UpdateTypePolicyChanged},
+		"payload":  []byte("update"),
+	}, "", "  ")
+	require.NoError(t, err)
+	require.Contains(t, string(body), "\n")
+	resp, err := http.Post(server.URL+"/casbin-topic", "application/json", strings.NewReader(string(body)))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	select {
+	case msg := <-messages:
+		require.Equal(t, "indented", msg.UUID)
+		require.Equal(t, []byte("update"), []byte(msg.Payload))
+		require.Equal(t, watcher.UpdateTypePolicyChanged, msg.Metadata.Get(watcher.MetadataUpdateType))
+		msg.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("The message was not delivered in time")
+	}
+}
+
+func TestSSEHubLimits(t *testing.T) {
+	hub := sse.NewHub(sse.HubConfig{MaxMessageSize: 1024})
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	defer hub.Close()
+
+	// Publish requests above the limit are rejected without reading them entirely.
+	body := fmt.Sprintf(`{"uuid":"large","payload":%q}`, strings.Repeat("p", 2048))
+	resp, err := http.Post(server.URL+"/casbin-topic", "application/json", strings.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// A hub that cannot bind its address is reported by NewWatcher.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	_, err = watcher.NewWatcher(context.Background(), "sse:///casbin-topic?listen_addr="+lis.Addr().String())
+	require.ErrorContains(t, err, "failed to listen on "+lis.Addr().String())
+}
+
+func TestWithEnforcerWebSocket(t *testing.T) {
+	hub := ws.NewHub(ws.HubConfig{})
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	defer hub.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	endpointURL := fmt.Sprintf("ws://%s/casbin-topic", parsedURL.Host)
+
+	testWithEnforcer(t, endpointURL)
+}
+
+func TestWebSocketWatcherReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+
+	hub := ws.NewHub(ws.HubConfig{})
+	server := httptest.NewUnstartedServer(hub)
+	server.Listener = listener
+	server.Start()
+
+	endpointURL := fmt.Sprintf("ws://%s/casbin-topic?reconnect_wait=10ms", addr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := watcher.NewWatcher(ctx, endpointURL)
+	require.NoError(t, err)
+	defer client.Close()
+
+	clientCh := make(chan string, 10)
+	err = client.SetUpdateCallback(func(msg string) {
+		clientCh <- msg
+	})
+	require.NoError(t, err)
+
+	// Restart the hub on the same address; the client must rejoin the room.
+	require.NoError(t, hub.Close())
+	server.Close()
+
+	listener, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	hub = ws.NewHub(ws.HubConfig{})
+	server = httptest.NewUnstartedServer(hub)
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+	defer hub.Close()
+
+	updater, err := watcher.NewWatcher(ws.WithHub(ctx, hub), endpointURL)
+	require.NoError(t, err)
+	defer updater.Close()
+
+	// Updates sent before the client has rejoined are lost, so keep sending until one arrives.
+	deadline := time.After(time.Second * 5)
+	for {
+		err = updater.Update()
+		require.NoError(t, err)
+
+		select {
+		case <-clientCh:
+			return
+		case <-time.After(time.Millisecond * 50):
+		case <-deadline:
+			t.Fatal("Client didn't receive an update after the hub restarted")
+		}
+	}
+}
+
+func TestWebSocketWatcherPingInterval(t *testing.T) {
+	// The hub pings far less often than the watcher's read deadline would allow.
+	hub := ws.NewHub(ws.HubConfig{PingInterval: time.Hour})
+	server := httptest.NewServer(hub)
+	defer server.Close()
+	defer hub.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	endpointURL := fmt.Sprintf("ws://%s/casbin-topic?ping_interval=20ms&reconnect_wait=1h", parsedURL.Host)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := watcher.NewWatcher(ctx, endpointURL)
+	require.NoError(t, err)
+	defer client.Close()
+
+	clientCh := make(chan string, 10)
+	require.NoError(t, client.SetUpdateCallback(func(msg string) {
+		clientCh <- msg
+	}))
+
+	// The hub's pongs keep the connection alive for many of the watcher's intervals, so it is not reconnected.
+	time.Sleep(200 * time.Millisecond)
+
+	updater, err := watcher.NewWatcher(ws.WithHub(ctx, hub), endpointURL)
+	require.NoError(t, err)
+	defer updater.Close()
+	require.NoError(t, updater.Update())
+
+	select {
+	case <-clientCh:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client lost the connection to the hub")
+	}
+}
+
+func TestWebSocketHubListenError(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+
+	// A hub that cannot bind its address is reported by NewWatcher.
+	_, err = watcher.NewWatcher(context.Background(), "ws:///casbin-topic?listen_addr="+lis.Addr().String())
+	require.ErrorContains(t, err, "failed to listen on "+lis.Addr().String())
+}
+
+// startRelay serves a relay on lis and returns a function that stops it.
+func startRelay(lis net.Listener, opts ...grpc.ServerOption) func() {
+	relayServer := relay.NewServer()
+	server := grpc.NewServer(opts...)
+	relay.Register(server, relayServer)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	return func() {
+		_ = relayServer.Close()
+		server.Stop()
+	}
+}
+
+func TestWithEnforcerGRPC(t *testing.T) {
+	lis := bufconn.Listen(1 << 20)
+	stop := startRelay(lis)
+	defer stop()
+
+	ctx := grpcdriver.WithDialOptions(context.Background(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+	)
+	testWithEnforcerContext(t, ctx, "grpc://bufnet/casbin-topic")
+}
+
+func TestGRPCWatcherMTLS(t *testing.T) {
+	caFile, certFile, keyFile := writeTestCertificates(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	caPEM, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	require.True(t, clientCAs.AppendCertsFromPEM(caPEM))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	stop := startRelay(lis, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})))
+	defer stop()
+
+	query := url.Values{}
+	query.Set("ca_file", caFile)
+	query.Set("cert_file", certFile)
+	query.Set("key_file", keyFile)
+	testWithEnforcer(t, "grpc://"+lis.Addr().String()+"/casbin-topic?"+query.Encode())
+
+	// Without a client certificate, the relay rejects the connection.
+	query.Del("cert_file")
+	query.Del("key_file")
+	query.Set("timeout", "1s")
+	_, err = watcher.NewWatcher(context.Background(), "grpc://"+lis.Addr().String()+"/casbin-topic?"+query.Encode())
+	require.Error(t, err)
+}
+
+func TestGRPCWatcherReconnect(t *testing.T) {
+	var mu sync.Mutex
+	lis := bufconn.Listen(1 << 20)
+	stop := startRelay(lis)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = grpcdriver.WithDialOptions(ctx,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			mu.Lock()
+			current := lis
+			mu.Unlock()
+			return current.DialContext(ctx)
+		}),
+	)
+	endpointURL := "grpc://bufnet/casbin-topic?reconnect_wait=10ms&timeout=5s"
+
+	listener, err := watcher.NewWatcher(ctx, endpointURL)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	listenerCh := make(chan string, 10)
+	err = listener.SetUpdateCallback(func(msg string) {
+		listenerCh <- msg
+	})
+	require.NoError(t, err)
+
+	// Restart the relay; the listener must re-open its stream and subscribe again.
+	stop()
+	mu.Lock()
+	lis = bufconn.Listen(1 << 20)
+	stop = startRelay(lis)
+	mu.Unlock()
+	defer stop()
+
+	updater, err := watcher.NewWatcher(ctx, endpointURL)
+	require.NoError(t, err)
+	defer updater.Close()
+
+	// Updates sent before the listener has subscribed again are lost, so keep sending until one arrives.
+	deadline := time.After(time.Second * 10)
+	for {
+		err = updater.Update()
+		require.NoError(t, err)
+
+		select {
+		case <-listenerCh:
+			return
+		case <-time.After(time.Millisecond * 50):
+		case <-deadline:
+			t.Fatal("Listener didn't receive an update after the relay restarted")
+		}
+	}
+}
+
 func TestWithEnforcerMemory(t *testing.T) {
 	endpointURL := "mem://casbin?shared=true"
 	testWithEnforcer(t, endpointURL)
@@ -147,6 +651,14 @@ func TestWatcherEx(t *testing.T) {
 			name:  "JSON Codec",
 			codec: watcher.JSONCodec(),
 		},
+		{
+			name:  "MessagePack Codec",
+			codec: watcher.MsgpackCodec(),
+		},
+		{
+			name:  "CBOR Codec",
+			codec: watcher.CBORCodec(),
+		},
 	}
 
 	for _, tt := range tests {
@@ -200,3 +712,1305 @@ func TestWatcherEx(t *testing.T) {
 		})
 	}
 }
+
+func TestWatcherExContentTypeNegotiation(t *testing.T) {
+	endpointURL := "mem://casbin?shared=true"
+
+	tests := []struct {
+		name  string
+		codec watcher.MarshalUnmarshaler
+	}{
+		{name: "GOB Codec", codec: watcher.DefaultCodec()},
+		{name: "JSON Codec", codec: watcher.JSONCodec()},
+		{name: "MessagePack Codec", codec: watcher.MsgpackCodec()},
+		{name: "CBOR Codec", codec: watcher.CBORCodec()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			updateCh := make(chan watcher.UpdateMessage, 1)
+
+			updater, err := watcher.NewWatcherEx(ctx, endpointURL, watcher.WithCodec(tt.codec))
+			require.NoError(t, err)
+			defer updater.Close()
+
+			// The listener keeps the default codec and must select the decoder from the content type.
+			listener, err := watcher.NewWatcherEx(ctx, endpointURL)
+			require.NoError(t, err)
+			defer listener.Close()
+
+			err = listener.SetUpdateMessageCallback(func(msg watcher.UpdateMessage) {
+				updateCh <- msg
+			})
+			require.NoError(t, err)
+
+			err = updater.UpdateForAddPolicies("p", "p", []string{"alice", "data1", "read"}, []string{"bob", "data2", "write"})
+			require.NoError(t, err)
+
+			select {
+			case updateMsg := <-updateCh:
+				require.Equal(t, watcher.UpdateTypeAddPolicies, updateMsg.Type)
+				require.Equal(t, "p", updateMsg.Sec)
+				require.Equal(t, "p", updateMsg.Ptype)
+				require.Equal(t, [][]string{{"alice", "data1", "read"}, {"bob", "data2", "write"}}, updateMsg.Rules)
+			case <-time.After(time.Second * 5):
+				t.Fatal("Listener didn't receive message for AddPolicies in time")
+			}
+		})
+	}
+}
+
+func TestWatcherExCompression(t *testing.T) {
+	endpointURL := "mem://casbin?shared=true"
+
+	rules := make([][]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		rules = append(rules, []string{fmt.Sprintf("user%d", i), fmt.Sprintf("data%d", i), "read"})
+	}
+
+	for _, algorithm := range []string{watcher.CompressionGzip, watcher.CompressionZstd, watcher.CompressionSnappy} {
+		t.Run(algorithm, func(t *testing.T) {
+			codec := watcher.CompressionCodec(watcher.JSONCodec(), algorithm, 1024)
+
+			// Small payloads stay raw, large payloads are compressed.
+			small, err := codec.Marshal(watcher.UpdateMessage{Type: watcher.UpdateTypePolicyChanged})
+			require.NoError(t, err)
+			raw, err := watcher.JSONCodec().Marshal(watcher.UpdateMessage{Type: watcher.UpdateTypePolicyChanged})
+			require.NoError(t, err)
+			require.Equal(t, raw, small)
+
+			large, err := codec.Marshal(watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicies, Rules: rules})
+			require.NoError(t, err)
+			raw, err = watcher.JSONCodec().Marshal(watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicies, Rules: rules})
+			require.NoError(t, err)
+			require.Less(t, len(large), len(raw))
+
+			var decoded watcher.UpdateMessage
+			require.NoError(t, codec.Unmarshal(large, &decoded))
+			require.Equal(t, rules, decoded.Rules)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			updateCh := make(chan watcher.UpdateMessage, 1)
+
+			updater, err := watcher.NewWatcherEx(ctx, endpointURL, watcher.WithCodec(codec))
+			require.NoError(t, err)
+			defer updater.Close()
+
+			// The listener is not configured for compression and relies on the message metadata.
+			listener, err := watcher.NewWatcherEx(ctx, endpointURL)
+			require.NoError(t, err)
+			defer listener.Close()
+
+			err = listener.SetUpdateMessageCallback(func(msg watcher.UpdateMessage) {
+				updateCh <- msg
+			})
+			require.NoError(t, err)
+
+			err = updater.UpdateForAddPolicies("p", "p", rules...)
+			require.NoError(t, err)
+
+			select {
+			case updateMsg := <-updateCh:
+				require.Equal(t, watcher.UpdateTypeAddPolicies, updateMsg.Type)
+				require.Equal(t, rules, updateMsg.Rules)
+			case <-time.After(time.Second * 5):
+				t.Fatal("Listener didn't receive message for AddPolicies in time")
+			}
+		})
+	}
+}
+
+func TestCompressionCodecLimits(t *testing.T) {
+	const limit = 1 << 20
+	bomb := watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicies, Rules: [][]string{{strings.Repeat("a", 2*limit)}}}
+	fits := watcher.UpdateMessage{Type: watcher.UpdateTypeAddPolicies, Rules: [][]string{{strings.Repeat("a", limit/2)}}}
+
+	for _, algorithm := range []string{watcher.CompressionGzip, watcher.CompressionZstd, watcher.CompressionSnappy} {
+		t.Run(algorithm, func(t *testing.T) {
+			sender := watcher.CompressionCodec(watcher.JSONCodec(), algorithm, 0).(watcher.MetadataMarshalUnmarshaler)
+			receiver := watcher.CompressionCodec(watcher.JSONCodec(), algorithm, 0,
+				watcher.WithMaxDecompressedSize(limit)).(watcher.MetadataMarshalUnmarshaler)
+
+			metadata := message.Metadata{}
+			data, err := sender.MarshalWithMetadata(fits, metadata)
+			require.NoError(t, err)
+			var decoded watcher.UpdateMessage
+			require.NoError(t, receiver.UnmarshalWithMetadata(data, metadata, &decoded))
+			require.Equal(t, fits.Rules, decoded.Rules)
+
+			// A small payload that expands beyond the limit is rejected.
+			metadata = message.Metadata{}
+			data, err = sender.MarshalWithMetadata(bomb, metadata)
+			require.NoError(t, err)
+			require.Less(t, len(data), limit)
+			require.ErrorContains(t, receiver.UnmarshalWithMetadata(data, metadata, &decoded), "exceeds the maximum size")
+			require.Error(t, receiver.Unmarshal(data, &decoded))
+		})
+	}
+
+	// zstd frames written as a stream do not declare their size in advance. A small window keeps the frame within the
+	// memory limit of the decoder, so that the limit of the decompressed size applies.
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf, zstd.WithWindowSize(64<<10))
+	require.NoError(t, err)
+	for i := 0; i < 2*limit/1024; i++ {
+		_, err = zw.Write(bytes.Repeat([]byte("a"), 1024))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	receiver := watcher.CompressionCodec(watcher.JSONCodec(), watcher.CompressionZstd, 0,
+		watcher.WithMaxDecompressedSize(limit)).(watcher.MetadataMarshalUnmarshaler)
+	metadata := message.Metadata{watcher.MetadataContentEncoding: watcher.CompressionZstd}
+	var decoded watcher.UpdateMessage
+	require.ErrorContains(t, receiver.UnmarshalWithMetadata(buf.Bytes(), metadata, &decoded), "exceeds the maximum size")
+
+	// Unsupported algorithms are rejected when the codec is created, not on the first large payload.
+	require.PanicsWithValue(t, "watcher: unsupported compression algorithm gzp", func() {
+		watcher.CompressionCodec(watcher.JSONCodec(), "gzp", 1024)
+	})
+}
+
+func TestWatcherExClaimCheck(t *testing.T) {
+	endpointURL := "mem://casbin?shared=true"
+
+	store, err := file.NewStore(t.TempDir())
+	require.NoError(t, err)
+	claimCheck := watcher.WithClaimCheck(watcher.ClaimCheck{Store: store, Threshold: 256})
+
+	rules := make([][]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		rules = append(rules, []string{fmt.Sprintf("user%d", i), fmt.Sprintf("data%d", i), "read"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updateCh := make(chan watcher.UpdateMessage, 1)
+
+	updater, err := watcher.NewWatcherEx(ctx, endpointURL, claimCheck)
+	require.NoError(t, err)
+	defer updater.Close()
+
+	listener, err := watcher.NewWatcherEx(ctx, endpointURL, claimCheck)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	err = listener.SetUpdateMessageCallback(func(msg watcher.UpdateMessage) {
+		updateCh <- msg
+	})
+	require.NoError(t, err)
+
+	err = updater.UpdateForAddPolicies("p", "p", rules...)
+	require.NoError(t, err)
+
+	select {
+	case updateMsg := <-updateCh:
+		require.Equal(t, watcher.UpdateTypeAddPolicies, updateMsg.Type)
+		require.Equal(t, rules, updateMsg.Rules)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Listener didn't receive claim-check message in time")
+	}
+
+	// Garbage collection removes the stored payload.
+	require.NoError(t, store.DeleteOlderThan(ctx, time.Now().Add(time.Second)))
+	err = updater.UpdateForRemovePolicy("p", "p", "alice", "data1", "read")
+	require.NoError(t, err)
+
+	select {
+	case updateMsg := <-updateCh:
+		require.Equal(t, watcher.UpdateTypeRemovePolicy, updateMsg.Type)
+		require.Equal(t, []string{"alice", "data1", "read"}, updateMsg.Params)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Listener didn't receive inline message in time")
+	}
+}
+
+// countingStore counts the garbage collection runs of the wrapped store.
+type countingStore struct {
+	watcher.BlobStore
+
+	mu   sync.Mutex
+	runs int
+}
+
+func (s *countingStore) DeleteOlderThan(ctx context.Context, before time.Time) error {
+	s.mu.Lock()
+	s.runs++
+	s.mu.Unlock()
+	return s.BlobStore.DeleteOlderThan(ctx, before)
+}
+
+func (s *countingStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.runs
+}
+
+func TestWatcherClaimCheckGarbageCollection(t *testing.T) {
+	fileStore, err := file.NewStore(t.TempDir())
+	require.NoError(t, err)
+	store := &countingStore{BlobStore: fileStore}
+
+	ctx := context.Background()
+	require.NoError(t, store.Put(ctx, "old", []byte("old payload")))
+
+	w, err := watcher.NewWatcher(ctx, "mem://casbin-gc", watcher.WithClaimCheck(watcher.ClaimCheck{
+		Store:      store,
+		TTL:        50 * time.Millisecond,
+		GCInterval: 10 * time.Millisecond,
+	}))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := store.Get(ctx, "old")
+		return errors.Is(err, watcher.ErrBlobNotFound)
+	}, 5*time.Second, 10*time.Millisecond, "The old blob was not collected")
+
+	// Garbage collection stops when the watcher is closed.
+	w.Close()
+	runs := store.count()
+	time.Sleep(50 * time.Millisecond)
+	require.LessOrEqual(t, store.count(), runs+1)
+}
+
+// blockingStore is a blob store whose reads block until their context ends.
+type blockingStore struct {
+	watcher.BlobStore
+}
+
+func (s *blockingStore) Get(ctx context.Context, _ string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestWatcherClaimCheckTimeout(t *testing.T) {
+	fileStore, err := file.NewStore(t.TempDir())
+	require.NoError(t, err)
+	endpointURL := "mem://casbin-claim-check-timeout?shared=true"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updater, err := watcher.NewWatcher(ctx, endpointURL, watcher.WithClaimCheck(watcher.ClaimCheck{
+		Store:     fileStore,
+		Threshold: 1,
+	}))
+	require.NoError(t, err)
+	defer updater.Close()
+
+	errCh := make(chan error, 1)
+	listener, err := watcher.NewWatcher(ctx, endpointURL,
+		watcher.WithClaimCheck(watcher.ClaimCheck{
+			Store:   &blockingStore{BlobStore: fileStore},
+			Timeout: 50 * time.Millisecond,
+		}),
+		watcher.WithErrorHandler(func(err error) {
+			errCh <- err
+		}),
+	)
+	require.NoError(t, err)
+	defer listener.Close()
+	require.NoError(t, listener.SetUpdateCallback(func(string) {
+		t.Error("The callback must not be called without the payload")
+	}))
+
+	require.NoError(t, updater.Update())
+	select {
+	case err := <-errCh:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(5 * time.Second):
+		t.Fatal("The fetch of the payload did not time out")
+	}
+
+	// A claim-check without a store is rejected.
+	_, err = watcher.NewWatcher(ctx, endpointURL, watcher.WithClaimCheck(watcher.ClaimCheck{Threshold: 1}))
+	require.Error(t, err)
+}
+
+// legacyDriver hands out a single gochannel Pub/Sub so that tests can publish raw messages.
+type legacyDriver struct {
+	pubsub *gochannel.GoChannel
+}
+
+func (d *legacyDriver) NewPubSub(_ context.Context, _ *url.URL, _ watermill.LoggerAdapter) (watcher.PubSub, error) {
+	return &pubSubWrapper{PubSub: d.pubsub, shared: true}, nil
+}
+
+func TestWatcherExRemoveFilteredPolicy(t *testing.T) {
+	driver := &legacyDriver{pubsub: gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})}
+	defer driver.pubsub.Close()
+	watcher.RegisterDriver("test-legacy", driver)
+	endpointURL := "test-legacy://casbin"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	updateCh := make(chan watcher.UpdateMessage, 1)
+
+	updater, err := watcher.NewWatcherEx(ctx, endpointURL)
+	require.NoError(t, err)
+	defer updater.Close()
+
+	listener, err := watcher.NewWatcherEx(ctx, endpointURL)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	err = listener.SetUpdateMessageCallback(func(msg watcher.UpdateMessage) {
+		updateCh <- msg
+	})
+	require.NoError(t, err)
+
+	assertFiltered := func(t *testing.T, fieldIndex int, fieldValues ...string) {
+		select {
+		case updateMsg := <-updateCh:
+			require.Equal(t, watcher.UpdateTypeRemoveFilteredPolicy, updateMsg.Type)
+			require.True(t, updateMsg.HasFieldIndex)
+			require.Equal(t, fieldIndex, updateMsg.FieldIndex)
+			require.Equal(t, fieldValues, updateMsg.Params)
+		case <-time.After(time.Second * 5):
+			t.Fatal("Listener didn't receive message for RemoveFilteredPolicy in time")
+		}
+	}
+
+	t.Run("FieldIndex", func(t *testing.T) {
+		err := updater.UpdateForRemoveFilteredPolicy("p", "p", 1, "data1", "read")
+		require.NoError(t, err)
+		assertFiltered(t, 1, "data1", "read")
+	})
+
+	t.Run("FieldIndex 0", func(t *testing.T) {
+		// gob omits zero values, so index 0 must not be mistaken for the legacy layout,
+		// even if the first field value is a number.
+		err := updater.UpdateForRemoveFilteredPolicy("p", "p", 0, "1", "data1")
+		require.NoError(t, err)
+		assertFiltered(t, 0, "1", "data1")
+	})
+
+	t.Run("Legacy layout", func(t *testing.T) {
+		// Older publishers encode the field index as the first element of Params.
+		payload, err := watcher.DefaultCodec().Marshal(watcher.UpdateMessage{
+			Type:   watcher.UpdateTypeRemoveFilteredPolicy,
+			Sec:    "p",
+			Ptype:  "p",
+			Params: []string{"1", "data1", "read"},
+		})
+		require.NoError(t, err)
+		err = driver.pubsub.Publish(watcher.DefaultTopic, message.NewMessage(watermill.NewUUID(), payload))
+		require.NoError(t, err)
+		assertFiltered(t, 1, "data1", "read")
+	})
+}
+
+func TestWithEnforcerRedis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	testWithEnforcer(t, "redis://"+mr.Addr()+"/casbin-topic")
+}
+
+func TestRedisStreamWatcherCleanup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	ctx := context.Background()
+
+	// A group left behind by a watcher that was not closed. miniredis records the activity of a consumer on XCLAIM only.
+	const staleGroup = "casbin-watcher-stale"
+	require.NoError(t, rdb.XGroupCreateMkStream(ctx, watcher.DefaultTopic, staleGroup, "$").Err())
+	require.NoError(t, rdb.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   watcher.DefaultTopic,
+		Group:    staleGroup,
+		Consumer: "consumer",
+		Messages: []string{"0-1"},
+	}).Err())
+
+	w, err := watcher.NewWatcher(ctx, "redisstream://"+mr.Addr()+"?maxlen=2&group_idle_timeout=300ms")
+	require.NoError(t, err)
+	require.NoError(t, w.SetUpdateCallback(func(string) {}))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Update())
+	}
+	length, err := rdb.XLen(ctx, watcher.DefaultTopic).Result()
+	require.NoError(t, err)
+	require.LessOrEqual(t, length, int64(2))
+
+	// The janitor removes the stale group but keeps the group of the running watcher.
+	require.Eventually(t, func() bool {
+		groups, err := rdb.XInfoGroups(ctx, watcher.DefaultTopic).Result()
+		return err == nil && len(groups) == 1 && groups[0].Name != staleGroup
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Closing the watcher deletes its own group.
+	w.Close()
+	groups, err := rdb.XInfoGroups(ctx, watcher.DefaultTopic).Result()
+	require.NoError(t, err)
+	require.Empty(t, groups)
+}
+
+// freeAddr returns a local address that is not in use.
+func freeAddr(t *testing.T) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+// startEtcd starts a single-member etcd server that stores its data in dir and serves clients on clientAddr.
+// The configure functions can change the configuration before the server is started.
+func startEtcd(t *testing.T, dir, clientAddr, peerAddr string, configure ...func(cfg *embed.Config)) *embed.Etcd {
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	cfg.LogLevel = "error"
+	clientURL := url.URL{Scheme: "http", Host: clientAddr}
+	peerURL := url.URL{Scheme: "http", Host: peerAddr}
+	cfg.ListenClientUrls = []url.URL{clientURL}
+	cfg.AdvertiseClientUrls = []url.URL{clientURL}
+	cfg.ListenPeerUrls = []url.URL{peerURL}
+	cfg.AdvertisePeerUrls = []url.URL{peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	for _, fn := range configure {
+		fn(cfg)
+	}
+
+	e, err := embed.StartEtcd(cfg)
+	require.NoError(t, err)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		e.Close()
+		t.Fatal("timeout waiting for etcd to start")
+	}
+	return e
+}
+
+func TestWithEnforcerEtcd(t *testing.T) {
+	clientAddr := freeAddr(t)
+	e := startEtcd(t, t.TempDir(), clientAddr, freeAddr(t))
+	defer e.Close()
+
+	testWithEnforcer(t, "etcd://"+clientAddr+"/casbin-topic")
+}
+
+func TestEtcdWatcherCompaction(t *testing.T) {
+	dir := t.TempDir()
+	clientAddr := freeAddr(t)
+	peerAddr := freeAddr(t)
+	e := startEtcd(t, dir, clientAddr, peerAddr)
+	defer func() {
+		e.Close()
+	}()
+
+	ctx := context.Background()
+	w, err := watcher.NewWatcherEx(ctx, "etcd://"+clientAddr+"/casbin-topic?ttl=1m&reconnect_wait=10ms")
+	require.NoError(t, err)
+	defer w.Close()
+	updates := make(chan watcher.UpdateMessage, 10)
+	require.NoError(t, w.SetUpdateMessageCallback(func(u watcher.UpdateMessage) {
+		updates <- u
+	}))
+
+	// Published keys are attached to a lease.
+	require.NoError(t, w.UpdateForAddPolicy("p", "p", "alice", "data1", "read"))
+	select {
+	case u := <-updates:
+		require.Equal(t, watcher.UpdateTypeAddPolicy, u.Type)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the update")
+	}
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{clientAddr}, DialTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	resp, err := cli.Get(ctx, "casbin-topic/", clientv3.WithPrefix())
+	require.NoError(t, err)
+	require.Len(t, resp.Kvs, 1)
+	require.NotZero(t, resp.Kvs[0].Lease)
+	cli.Close()
+
+	// While the watcher is cut off, updates are published and the history is compacted.
+	e.Close()
+	otherAddr := freeAddr(t)
+	e = startEtcd(t, dir, otherAddr, peerAddr)
+	cli, err = clientv3.New(clientv3.Config{Endpoints: []string{otherAddr}, DialTimeout: 5 * time.Second})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = cli.Put(ctx, fmt.Sprintf("casbin-topic/missed-%d", i), "missed")
+		require.NoError(t, err)
+	}
+	put, err := cli.Put(ctx, "other-topic/key", "value")
+	require.NoError(t, err)
+	_, err = cli.Compact(ctx, put.Header.Revision)
+	require.NoError(t, err)
+	cli.Close()
+	e.Close()
+
+	// When it reconnects, the watcher cannot resume and requests a full reload instead.
+	e = startEtcd(t, dir, clientAddr, peerAddr)
+	select {
+	case u := <-updates:
+		require.Equal(t, watcher.UpdateTypePolicyChanged, u.Type)
+	case <-time.After(30 * time.Second):
+		t.Fatal("timeout waiting for the reload")
+	}
+
+	// The watcher keeps receiving updates afterwards.
+	require.NoError(t, w.UpdateForRemovePolicy("p", "p", "alice", "data1", "read"))
+	select {
+	case u := <-updates:
+		require.Equal(t, watcher.UpdateTypeRemovePolicy, u.Type)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for the update")
+	}
+}
+
+// writeTestCertificates writes a CA certificate and a certificate for 127.0.0.1, which is valid for servers and
+// clients, to dir as PEM files.
+func writeTestCertificates(t *testing.T, dir string) (caFile, certFile, keyFile string) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "casbin-watcher test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caTemplate, &key.PublicKey, caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	writePEM := func(name, blockType string, bytes []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes}), 0o600))
+		return path
+	}
+	return writePEM("ca.pem", "CERTIFICATE", caDER),
+		writePEM("cert.pem", "CERTIFICATE", der),
+		writePEM("key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func TestEtcdWatcherTLSNamespace(t *testing.T) {
+	caFile, certFile, keyFile := writeTestCertificates(t, t.TempDir())
+	clientAddr := freeAddr(t)
+	e := startEtcd(t, t.TempDir(), clientAddr, freeAddr(t), func(cfg *embed.Config) {
+		clientURL := url.URL{Scheme: "https", Host: clientAddr}
+		cfg.ListenClientUrls = []url.URL{clientURL}
+		cfg.AdvertiseClientUrls = []url.URL{clientURL}
+		cfg.ClientTLSInfo.CertFile = certFile
+		cfg.ClientTLSInfo.KeyFile = keyFile
+		cfg.ClientTLSInfo.TrustedCAFile = caFile
+		cfg.ClientTLSInfo.ClientCertAuth = true
+	})
+	defer e.Close()
+
+	query := url.Values{}
+	query.Set("ca_file", caFile)
+	query.Set("cert_file", certFile)
+	query.Set("key_file", keyFile)
+	query.Set("namespace", "app1/")
+	query.Set("keepalive_time", "10s")
+	query.Set("keepalive_timeout", "5s")
+	testWithEnforcer(t, "etcd://"+clientAddr+"/casbin-topic?"+query.Encode())
+
+	// Without a client certificate, the connection is rejected.
+	query.Del("cert_file")
+	query.Del("key_file")
+	query.Set("dial_timeout", "1s")
+	_, err := watcher.NewWatcher(context.Background(), "etcd://"+clientAddr+"/casbin-topic?"+query.Encode())
+	require.Error(t, err)
+
+	// The keys were written in the namespace.
+	tlsConfig := &tls.Config{RootCAs: x509.NewCertPool(), MinVersion: tls.VersionTLS12}
+	caPEM, err := os.ReadFile(caFile)
+	require.NoError(t, err)
+	require.True(t, tlsConfig.RootCAs.AppendCertsFromPEM(caPEM))
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.NoError(t, err)
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	cli, err := clientv3.New(clientv3.Config{Endpoints: []string{clientAddr}, DialTimeout: 5 * time.Second, TLS: tlsConfig})
+	require.NoError(t, err)
+	defer cli.Close()
+	resp, err := cli.Get(context.Background(), "app1/casbin-topic/", clientv3.WithPrefix(), clientv3.WithCountOnly())
+	require.NoError(t, err)
+	require.NotZero(t, resp.Count)
+}
+
+// startMQTTBroker starts an MQTT broker and returns its address. Without a ledger, all clients are allowed.
+func startMQTTBroker(t *testing.T, ledger *auth.Ledger) string {
+	server := mqttserver.New(&mqttserver.Options{InlineClient: true})
+	if ledger == nil {
+		require.NoError(t, server.AddHook(new(auth.AllowHook), nil))
+	} else {
+		require.NoError(t, server.AddHook(new(auth.Hook), &auth.Options{Ledger: ledger}))
+	}
+	addr := freeAddr(t)
+	require.NoError(t, server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})))
+	require.NoError(t, server.Serve())
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	return addr
+}
+
+func TestWithEnforcerMQTT(t *testing.T) {
+	addr := startMQTTBroker(t, nil)
+	testWithEnforcer(t, "mqtt://"+addr+"/casbin-topic")
+}
+
+func TestWithEnforcerMQTT5(t *testing.T) {
+	addr := startMQTTBroker(t, nil)
+	testWithEnforcer(t, "mqtt://"+addr+"/casbin-topic?protocol=5&qos=2")
+}
+
+func TestMQTTWatcherRetained(t *testing.T) {
+	addr := startMQTTBroker(t, &auth.Ledger{
+		Auth: auth.AuthRules{
+			{Username: "casbin", Password: "secret", Allow: true},
+		},
+	})
+
+	for _, protocol := range []string{"3.1.1", "5"} {
+		t.Run(protocol, func(t *testing.T) {
+			endpointURL := "mqtt://casbin:secret@" + addr + "/casbin-" + protocol + "?retain=true&protocol=" + protocol
+
+			// The notice is retained by the broker, so a watcher that starts later receives it.
+			publisher, err := watcher.NewWatcher(context.Background(), endpointURL)
+			require.NoError(t, err)
+			defer publisher.Close()
+			require.NoError(t, publisher.Update())
+
+			// The subscription is made through the driver, so that no message is missed before a callback is set.
+			u, err := url.Parse(endpointURL)
+			require.NoError(t, err)
+			ps, err := (&mqttdriver.Driver{}).NewPubSub(context.Background(), u, watermill.NopLogger{})
+			require.NoError(t, err)
+			defer ps.Close()
+			messages, err := ps.Subscribe(context.Background(), "casbin-"+protocol)
+			require.NoError(t, err)
+
+			select {
+			case msg := <-messages:
+				require.Equal(t, watcher.UpdateTypePolicyChanged, msg.Metadata.Get(watcher.MetadataUpdateType))
+				msg.Ack()
+			case <-time.After(5 * time.Second):
+				t.Fatal("The retained notice was not delivered in time")
+			}
+		})
+	}
+
+	// Clients without valid credentials are rejected.
+	_, err := watcher.NewWatcher(context.Background(), "mqtt://casbin:wrong@"+addr+"/casbin-topic?timeout=1s")
+	require.Error(t, err)
+	_, err = watcher.NewWatcher(context.Background(), "mqtt://casbin:wrong@"+addr+"/casbin-topic?protocol=5&timeout=1s")
+	require.Error(t, err)
+
+	// A persistent session requires a client ID.
+	_, err = watcher.NewWatcher(context.Background(), "mqtt://casbin:secret@"+addr+"/casbin-topic?clean_session=false")
+	require.Error(t, err)
+}
+
+// TestMQTTDeliverWhileHandling checks that a message that is being handled does not hold up the client, so that
+// messages for other subscriptions are still delivered.
+func TestMQTTDeliverWhileHandling(t *testing.T) {
+	addr := startMQTTBroker(t, &auth.Ledger{
+		Auth: auth.AuthRules{
+			{Username: "casbin", Password: "secret", Allow: true},
+		},
+	})
+
+	for _, protocol := range []string{"3.1.1", "5"} {
+		t.Run(protocol, func(t *testing.T) {
+			topic := "casbin-handling-" + protocol
+			u, err := url.Parse("mqtt://casbin:secret@" + addr + "/" + topic + "?qos=1&protocol=" + protocol)
+			require.NoError(t, err)
+			ps, err := (&mqttdriver.Driver{}).NewPubSub(context.Background(), u, watermill.NopLogger{})
+			require.NoError(t, err)
+			defer ps.Close()
+			slow, err := ps.Subscribe(context.Background(), topic+"-slow")
+			require.NoError(t, err)
+			fast, err := ps.Subscribe(context.Background(), topic+"-fast")
+			require.NoError(t, err)
+
+			require.NoError(t, ps.Publish(topic+"-slow", message.NewMessage("slow", []byte("1"))))
+			var pending *message.Message
+			select {
+			case pending = <-slow:
+				require.Equal(t, "slow", pending.UUID)
+			case <-time.After(5 * time.Second):
+				t.Fatal("The first message was not delivered in time")
+			}
+			defer pending.Ack()
+
+			require.NoError(t, ps.Publish(topic+"-fast", message.NewMessage("fast", []byte("2"))))
+			select {
+			case msg := <-fast:
+				require.Equal(t, "fast", msg.UUID)
+				msg.Ack()
+			case <-time.After(5 * time.Second):
+				t.Fatal("The second message was held up by the first one")
+			}
+		})
+	}
+}
+
+func TestMQTTQueueLimit(t *testing.T) {
+	addr := startMQTTBroker(t, &auth.Ledger{
+		Auth: auth.AuthRules{
+			{Username: "casbin", Password: "secret", Allow: true},
+		},
+	})
+
+	topic := "casbin-queue-limit"
+	u, err := url.Parse("mqtt://casbin:secret@" + addr + "/" + topic + "?qos=1")
+	require.NoError(t, err)
+	logger := watermill.NewCaptureLogger()
+	ps, err := (&mqttdriver.Driver{}).NewPubSub(context.Background(), u, logger)
+	require.NoError(t, err)
+	defer ps.Close()
+	messages, err := ps.Subscribe(context.Background(), topic)
+	require.NoError(t, err)
+
+	// While the first message is not acknowledged, the following ones are queued up to the limit of 256.
+	require.NoError(t, ps.Publish(topic, message.NewMessage("pending", []byte("0"))))
+	var pending *message.Message
+	select {
+	case pending = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The first message was not delivered in time")
+	}
+	const queueSize, published = 256, 300
+	for i := 0; i < published; i++ {
+		require.NoError(t, ps.Publish(topic, message.NewMessage(strconv.Itoa(i), []byte("update"))))
+	}
+
+	// The messages beyond the limit are dropped and logged.
+	require.Eventually(t, func() bool {
+		return len(logger.Captured()[watermill.ErrorLogLevel]) == published-queueSize
+	}, 5*time.Second, 10*time.Millisecond)
+
+	pending.Ack()
+	for i := 0; i < queueSize; i++ {
+		select {
+		case msg := <-messages:
+			require.Equal(t, strconv.Itoa(i), msg.UUID)
+			msg.Ack()
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Queued message %d was not delivered in time", i)
+		}
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("Dropped message %s was delivered", msg.UUID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// consulStandIn is a stand-in for the parts of the Consul HTTP API that the consul driver uses:
+// the KV store and user events, both with blocking queries, and ACL tokens.
+type consulStandIn struct {
+	token string
+
+	mu      sync.Mutex
+	index   uint64
+	kv      map[string]*consulapi.KVPair
+	events  []*consulapi.UserEvent
+	changed chan struct{}
+}
+
+func startConsulStandIn(t *testing.T, token string) string {
+	c := &consulStandIn{
+		token:   token,
+		index:   1, // Like a server with history, so that the index of the first write is above that of the empty store.
+		kv:      make(map[string]*consulapi.KVPair),
+		changed: make(chan struct{}),
+	}
+	s := httptest.NewServer(c)
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().String()
+}
+
+// eventIndex returns the index of the events named name, which Consul derives from the ID of the newest one.
+func (c *consulStandIn) eventIndex(name string) (uint64, []*consulapi.UserEvent) {
+	var events []*consulapi.UserEvent
+	for _, event := range c.events {
+		if event.Name == name {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return 1, events
+	}
+	return (&consulapi.Client{}).Event().IDToIndex(events[len(events)-1].ID), events
+}
+
+func (c *consulStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != c.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	query := r.URL.Query()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// update records a change and wakes up the blocking queries.
+	update := func() {
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+	// block waits while the index of a blocking query has not changed.
+	block := func(index func() uint64) {
+		waitIndex, _ := strconv.ParseUint(query.Get("index"), 10, 64)
+		wait, _ := time.ParseDuration(query.Get("wait"))
+		timeout := time.After(wait)
+		for waitIndex > 0 && index() == waitIndex {
+			changed := c.changed
+			c.mu.Unlock()
+			select {
+			case <-changed:
+			case <-timeout:
+			case <-r.Context().Done():
+			}
+			c.mu.Lock()
+			if r.Context().Err() != nil || changed == c.changed {
+				return
+			}
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		switch r.Method {
+		case http.MethodPut:
+			value, _ := io.ReadAll(r.Body)
+			c.index++
+			c.kv[key] = &consulapi.KVPair{Key: key, Value: value, CreateIndex: c.index, ModifyIndex: c.index}
+			update()
+			_, _ = w.Write([]byte("true"))
+		case http.MethodDelete:
+			delete(c.kv, key)
+			c.index++
+			update()
+			_, _ = w.Write([]byte("true"))
+		default:
+			block(func() uint64 { return c.index })
+			var pairs []*consulapi.KVPair
+			var keys []string
+			for k, pair := range c.kv {
+				if strings.HasPrefix(k, key) {
+					pairs = append(pairs, pair)
+					keys = append(keys, k)
+				}
+			}
+			w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+			if len(pairs) == 0 {
+				w.WriteHeader(http.StatusNotFound)
+			} else if query.Has("keys") {
+				_ = json.NewEncoder(w).Encode(keys)
+			} else {
+				_ = json.NewEncoder(w).Encode(pairs)
+			}
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/event/fire/"):
+		payload, _ := io.ReadAll(r.Body)
+		event := &consulapi.UserEvent{
+			ID:      watermill.NewUUID(),
+			Name:    strings.TrimPrefix(r.URL.Path, "/v1/event/fire/"),
+			Payload: payload,
+		}
+		c.events = append(c.events, event)
+		update()
+		_ = json.NewEncoder(w).Encode(event)
+	case r.URL.Path == "/v1/event/list":
+		name := query.Get("name")
+		block(func() uint64 {
+			index, _ := c.eventIndex(name)
+			return index
+		})
+		index, events := c.eventIndex(name)
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		_ = json.NewEncoder(w).Encode(events)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestWithEnforcerConsul(t *testing.T) {
+	addr := startConsulStandIn(t, "secret")
+	testWithEnforcer(t, "consul://"+addr+"/casbin?token=secret&datacenter=dc1&wait_time=1s")
+}
+
+func TestWithEnforcerConsulEvent(t *testing.T) {
+	addr := startConsulStandIn(t, "secret")
+	testWithEnforcer(t, "consul://"+addr+"/casbin?mode=event&token=secret&wait_time=1s")
+}
+
+func TestConsulWatcher(t *testing.T) {
+	addr := startConsulStandIn(t, "secret")
+
+	for _, mode := range []string{"kv", "event"} {
+		t.Run(mode, func(t *testing.T) {
+			u, err := url.Parse("consul://" + addr + "/casbin?token=secret&wait_time=1s&reconnect_wait=10ms&mode=" + mode)
+			require.NoError(t, err)
+			ps, err := (&consuldriver.Driver{}).NewPubSub(context.Background(), u, watermill.NopLogger{})
+			require.NoError(t, err)
+			defer ps.Close()
+
+			// Messages published before the subscription are not delivered.
+			require.NoError(t, ps.Publish("casbin", message.NewMessage("old", []byte("old"))))
+			messages, err := ps.Subscribe(context.Background(), "casbin")
+			require.NoError(t, err)
+
+			msg := message.NewMessage(watermill.NewUUID(), []byte("update"))
+			msg.Metadata.Set(watcher.MetadataUpdateType, watcher.UpdateTypePolicyChanged)
+			require.NoError(t, ps.Publish("casbin", msg))
+
+			// A nacked message is delivered again, with its metadata.
+			for _, nack := range []bool{true, false} {
+				select {
+				case received := <-messages:
+					require.Equal(t, msg.UUID, received.UUID)
+					require.Equal(t, watcher.UpdateTypePolicyChanged, received.Metadata.Get(watcher.MetadataUpdateType))
+					if nack {
+						received.Nack()
+					} else {
+						received.Ack()
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("The message was not delivered in time")
+				}
+			}
+		})
+	}
+
+	// Clients without a valid ACL token are rejected.
+	_, err := watcher.NewWatcher(context.Background(), "consul://"+addr+"/casbin?token=wrong")
+	require.Error(t, err)
+}
+
+func TestWithEnforcerUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hub.sock")
+	testWithEnforcer(t, "unix:///casbin?listen=true&path="+url.QueryEscape(path))
+}
+
+// requireUnixUpdate calls Update on updater until receiver gets an update, since updates sent
+// before a watcher has joined the room of the hub are lost.
+func requireUnixUpdate(t *testing.T, updater *watcher.Watcher, received <-chan string) {
+	deadline := time.After(time.Second * 5)
+	for {
+		require.NoError(t, updater.Update())
+
+		select {
+		case <-received:
+			return
+		case <-time.After(time.Millisecond * 50):
+		case <-deadline:
+			t.Fatal("The update was not received in time")
+		}
+	}
+}
+
+func TestUnixWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hub.sock")
+	hubURL := "unix:///casbin?listen=true&path=" + url.QueryEscape(path)
+	clientURL := "unix:///casbin?reconnect_wait=10ms&path=" + url.QueryEscape(path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hub, err := watcher.NewWatcher(ctx, hubURL)
+	require.NoError(t, err)
+	defer func() { hub.Close() }()
+
+	// The socket is only accessible to its owner by default.
+	fi, err := os.Lstat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.ModeSocket, fi.Mode().Type())
+	require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	// A second hub cannot take over the socket.
+	_, err = watcher.NewWatcher(ctx, hubURL)
+	require.Error(t, err)
+
+	client, err := watcher.NewWatcher(ctx, clientURL)
+	require.NoError(t, err)
+	defer client.Close()
+
+	hubCh := make(chan string, 10)
+	require.NoError(t, hub.SetUpdateCallback(func(msg string) {
+		hubCh <- msg
+	}))
+	clientCh := make(chan string, 10)
+	require.NoError(t, client.SetUpdateCallback(func(msg string) {
+		clientCh <- msg
+	}))
+
+	requireUnixUpdate(t, hub, clientCh)
+	requireUnixUpdate(t, client, hubCh)
+
+	// Restart the hub on the same socket; the client must rejoin the room.
+	hub.Close()
+	_, err = os.Lstat(path)
+	require.True(t, os.IsNotExist(err), "The socket was not removed")
+	hub, err = watcher.NewWatcher(ctx, hubURL)
+	require.NoError(t, err)
+	requireUnixUpdate(t, hub, clientCh)
+
+	// Clients refuse to connect to a file that is not a socket.
+	regular := filepath.Join(dir, "regular")
+	require.NoError(t, os.WriteFile(regular, nil, 0o600))
+	_, err = watcher.NewWatcher(ctx, "unix:///casbin?path="+url.QueryEscape(regular))
+	require.Error(t, err)
+}
+
+func TestWithEnforcerGossip(t *testing.T) {
+	testWithEnforcer(t, "gossip://127.0.0.1:0/casbin?profile=local")
+}
+
+func TestGossipWatcher(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	seedAddr := freeAddr(t)
+	seedURL := fmt.Sprintf("gossip://%s/casbin?profile=local&key=%s", seedAddr, url.QueryEscape(key))
+	memberURL := fmt.Sprintf("gossip://127.0.0.1:0/casbin?profile=local&seeds=%s&key=%s", seedAddr, url.QueryEscape(key))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Every member receives the updates of the others.
+	var members []*watcher.Watcher
+	var received []chan string
+	for i := 0; i < 3; i++ {
+		endpointURL := memberURL
+		if i == 0 {
+			endpointURL = seedURL
+		}
+		w, err := watcher.NewWatcher(ctx, endpointURL)
+		require.NoError(t, err)
+		defer w.Close()
+
+		ch := make(chan string, 10)
+		require.NoError(t, w.SetUpdateCallback(func(msg string) {
+			ch <- msg
+		}))
+		members = append(members, w)
+		received = append(received, ch)
+	}
+
+	require.NoError(t, members[2].Update())
+	for _, ch := range received[:2] {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The update was not disseminated in time")
+		}
+	}
+
+	newPubSub := func(endpointURL string) watcher.PubSub {
+		u, err := url.Parse(endpointURL)
+		require.NoError(t, err)
+		ps, err := (&gossipdriver.Driver{}).NewPubSub(ctx, u, watermill.NopLogger{})
+		require.NoError(t, err)
+		t.Cleanup(func() { ps.Close() })
+		return ps
+	}
+
+	// Messages too large for a gossip packet are sent over TCP, with their metadata. The sender joins last, so that it
+	// learns about the receiver when it joins.
+	receiver := newPubSub(memberURL)
+	sender := newPubSub(memberURL)
+	wrongKey := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	outsider := newPubSub(fmt.Sprintf("gossip://127.0.0.1:0/casbin?profile=local&seeds=%s&key=%s", seedAddr, url.QueryEscape(wrongKey)))
+	messages, err := receiver.Subscribe(ctx, "large")
+	require.NoError(t, err)
+	outsiderMessages, err := outsider.Subscribe(ctx, "large")
+	require.NoError(t, err)
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte(strings.Repeat("p", 8192)))
+	msg.Metadata.Set(watcher.MetadataUpdateType, watcher.UpdateTypePolicyChanged)
+	require.NoError(t, sender.Publish("large", msg))
+	select {
+	case got := <-messages:
+		require.Equal(t, msg.UUID, got.UUID)
+		require.Equal(t, msg.Payload, got.Payload)
+		require.Equal(t, watcher.UpdateTypePolicyChanged, got.Metadata.Get(watcher.MetadataUpdateType))
+		got.Ack()
+	case <-time.After(5 * time.Second):
+		t.Fatal("The large message was not delivered in time")
+	}
+
+	// A member with another encryption key cannot join the cluster.
+	select {
+	case <-outsiderMessages:
+		t.Fatal("A member with the wrong key received a message")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func TestWithEnforcerFSWatch(t *testing.T) {
+	testWithEnforcer(t, "fswatch:///casbin?dir="+url.QueryEscape(t.TempDir()))
+}
+
+func TestFSWatchWatcher(t *testing.T) {
+	for _, poll := range []bool{false, true} {
+		t.Run(fmt.Sprintf("poll=%t", poll), func(t *testing.T) {
+			dir := t.TempDir()
+			u, err := url.Parse(fmt.Sprintf("fswatch:///casbin?dir=%s&poll=%t&poll_interval=50ms&retry_wait=10ms",
+				url.QueryEscape(dir), poll))
+			require.NoError(t, err)
+			ps, err := (&fswatchdriver.Driver{}).NewPubSub(context.Background(), u, watermill.NopLogger{})
+			require.NoError(t, err)
+			defer ps.Close()
+
+			// Messages published before the subscription are not delivered.
+			require.NoError(t, ps.Publish("casbin", message.NewMessage("old", []byte("old"))))
+
+			// Expired event files and files left behind by failed publishers are deleted on publish.
+			expired := filepath.Join(dir, "casbin", fmt.Sprintf("%020d-expired.json", time.Now().Add(-2*time.Hour).UnixNano()))
+			require.NoError(t, os.WriteFile(expired, []byte("{}"), 0o644))
+			stale := filepath.Join(dir, "casbin", fmt.Sprintf(".%020d-stale.json.tmp", time.Now().Add(-2*time.Hour).UnixNano()))
+			require.NoError(t, os.WriteFile(stale, nil, 0o644))
+
+			messages, err := ps.Subscribe(context.Background(), "casbin")
+			require.NoError(t, err)
+
+			msg := message.NewMessage(watermill.NewUUID(), []byte("update"))
+			msg.Metadata.Set(watcher.MetadataUpdateType, watcher.UpdateTypePolicyChanged)
+			require.NoError(t, ps.Publish("casbin", msg))
+
+			// A nacked message is delivered again, with its metadata.
+			for _, nack := range []bool{true, false} {
+				select {
+				case received := <-messages:
+					require.Equal(t, msg.UUID, received.UUID)
+					require.Equal(t, watcher.UpdateTypePolicyChanged, received.Metadata.Get(watcher.MetadataUpdateType))
+					if nack {
+						received.Nack()
+					} else {
+						received.Ack()
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatal("The message was not delivered in time")
+				}
+			}
+
+			_, err = os.Stat(expired)
+			require.True(t, os.IsNotExist(err), "The expired event file was not deleted")
+			_, err = os.Stat(stale)
+			require.True(t, os.IsNotExist(err), "The stale temporary file was not deleted")
+			entries, err := os.ReadDir(filepath.Join(dir, "casbin"))
+			require.NoError(t, err)
+			require.Len(t, entries, 2)
+		})
+	}
+
+	// Topics cannot point outside the directory.
+	u, err := url.Parse("fswatch:///casbin?dir=" + url.QueryEscape(t.TempDir()))
+	require.NoError(t, err)
+	ps, err := (&fswatchdriver.Driver{}).NewPubSub(context.Background(), u, watermill.NopLogger{})
+	require.NoError(t, err)
+	defer ps.Close()
+	require.Error(t, ps.Publish("../casbin", message.NewMessage(watermill.NewUUID(), nil)))
+}
+
+func TestWithEnforcerIO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "casbin.jsonl")
+	testWithEnforcer(t, "io:///casbin?poll_interval=10ms&path="+url.QueryEscape(path))
+}
+
+func TestIOWatcher(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "casbin.jsonl")
+	newPubSub := func(query string) watcher.PubSub {
+		u, err := url.Parse("io:///casbin?poll_interval=10ms&retry_wait=10ms&" + query)
+		require.NoError(t, err)
+		ps, err := (&iodriver.Driver{}).NewPubSub(context.Background(), u, watermill.NopLogger{})
+		require.NoError(t, err)
+		t.Cleanup(func() { ps.Close() })
+		return ps
+	}
+	receive := func(messages <-chan *message.Message, want *message.Message, nack bool) {
+		select {
+		case got := <-messages:
+			require.Equal(t, want.UUID, got.UUID)
+			require.Equal(t, want.Payload, got.Payload)
+			require.Equal(t, want.Metadata.Get(watcher.MetadataUpdateType), got.Metadata.Get(watcher.MetadataUpdateType))
+			if nack {
+				got.Nack()
+			} else {
+				got.Ack()
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("The message was not delivered in time")
+		}
+	}
+
+	// One process appends to the log that another one follows.
+	publisher := newPubSub("out=" + url.QueryEscape(path))
+	require.NoError(t, publisher.Publish("casbin", message.NewMessage("old", []byte("old"))))
+	subscriber := newPubSub("in=" + url.QueryEscape(path) + "&out=" + url.QueryEscape(filepath.Join(dir, "other.jsonl")))
+	messages, err := subscriber.Subscribe(context.Background(), "casbin")
+	require.NoError(t, err)
+
+	// Messages written before the subscription and messages of other topics are not delivered, and a nacked
+	// message is delivered again, with its metadata.
+	msg := message.NewMessage(watermill.NewUUID(), []byte("update"))
+	msg.Metadata.Set(watcher.MetadataUpdateType, watcher.UpdateTypePolicyChanged)
+	require.NoError(t, publisher.Publish("other", message.NewMessage(watermill.NewUUID(), []byte("other"))))
+	require.NoError(t, publisher.Publish("casbin", msg))
+	receive(messages, msg, true)
+	receive(messages, msg, false)
+
+	// A line is only delivered once it is complete.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	partial := message.NewMessage(watermill.NewUUID(), []byte("partial"))
+	data, err := json.Marshal(map[string]any{"topic": "casbin", "uuid": partial.UUID, "payload": partial.Payload})
+	require.NoError(t, err)
+	_, err = f.Write(data[:10])
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = f.Write(append(data[10:], '\n'))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	receive(messages, partial, false)
+
+	// After the log is rotated, the publisher appends to a new file, which the subscriber follows.
+	require.NoError(t, os.Rename(path, path+".1"))
+	rotated := message.NewMessage(watermill.NewUUID(), []byte("rotated"))
+	require.NoError(t, publisher.Publish("casbin", rotated))
+	receive(messages, rotated, false)
+
+	// After the log is truncated in place, the subscriber reads it from the beginning.
+	require.NoError(t, os.Truncate(path, 0))
+	time.Sleep(50 * time.Millisecond)
+	truncated := message.NewMessage(watermill.NewUUID(), []byte("truncated"))
+	require.NoError(t, publisher.Publish("casbin", truncated))
+	receive(messages, truncated, false)
+
+	// With start=beginning, the whole log is read.
+	replay, err := newPubSub("start=beginning&path="+url.QueryEscape(path+".1")).Subscribe(context.Background(), "casbin")
+	require.NoError(t, err)
+	for _, want := range []*message.Message{message.NewMessage("old", []byte("old")), msg, partial} {
+		receive(replay, want, false)
+	}
+}